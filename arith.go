@@ -0,0 +1,883 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// Arithmetic
+//
+// Expressions are evaluated to one of four representations of
+// numbers: int64 for integers that fit a machine word, *big.Int for
+// larger integers, *big.Rat for rationals, and float64 for floats.
+// Results are always normalised, integers that fit an int64 are held
+// as an int64, and rationals with a denominator of 1 as integers, so
+// each number has a single representation. Arithmetic on operands of
+// mixed representations is done in the one with the highest rank.
+// Integer arithmetic is exact, operations on int64s that overflow are
+// redone on big integers.
+
+// num is the value of an arithmetic expression
+type num interface{}
+
+// The ranks of the representations of numbers
+const (
+	rankInt = iota
+	rankBig
+	rankRat
+	rankFloat
+)
+
+// maxBits bounds the size of the integers built by shifts and powers
+const maxBits = 1 << 24
+
+func rank(x num) int {
+	switch x.(type) {
+	case int64:
+		return rankInt
+	case *big.Int:
+		return rankBig
+	case *big.Rat:
+		return rankRat
+	default:
+		return rankFloat
+	}
+}
+
+// rank2 returns the rank that an operation on x and y is done in
+func rank2(x, y num) int {
+	if r := rank(y); r > rank(x) {
+		return r
+	}
+	return rank(x)
+}
+
+// toBig returns the integer x as a big integer
+func toBig(x num) *big.Int {
+	if i, ok := x.(int64); ok {
+		return big.NewInt(i)
+	}
+	return x.(*big.Int)
+}
+
+// toRat returns the exact value of x as a rational
+func toRat(x num) *big.Rat {
+	switch x := x.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(x)
+	case *big.Int:
+		return new(big.Rat).SetInt(x)
+	case *big.Rat:
+		return x
+	default:
+		return new(big.Rat).SetFloat64(x.(float64))
+	}
+}
+
+// toFloat returns the nearest float to x
+func toFloat(x num) (float64, error) {
+	var f float64
+	switch x := x.(type) {
+	case int64:
+		return float64(x), nil
+	case *big.Int:
+		f, _ = new(big.Float).SetInt(x).Float64()
+	case *big.Rat:
+		f, _ = x.Float64()
+	default:
+		return x.(float64), nil
+	}
+	if math.IsInf(f, 0) {
+		return 0, EvaluationError{"float_overflow"}
+	}
+	return f, nil
+}
+
+// norm returns the normal representation of x
+func norm(x num) num {
+	switch x := x.(type) {
+	case *big.Int:
+		if x.IsInt64() {
+			return x.Int64()
+		}
+	case *big.Rat:
+		if x.IsInt() {
+			return norm(new(big.Int).Set(x.Num()))
+		}
+	}
+	return x
+}
+
+// checkFloat returns f, or the error for a float result that cannot
+// be represented.
+func checkFloat(f float64) (num, error) {
+	switch {
+	case math.IsNaN(f):
+		return nil, EvaluationError{"undefined"}
+	case math.IsInf(f, 0):
+		return nil, EvaluationError{"float_overflow"}
+	}
+	return f, nil
+}
+
+// numSign returns -1, 0 or 1 depending on the sign of x
+func numSign(x num) int {
+	switch x := x.(type) {
+	case int64:
+		switch {
+		case x < 0:
+			return -1
+		case x > 0:
+			return 1
+		}
+		return 0
+	case *big.Int:
+		return x.Sign()
+	case *big.Rat:
+		return x.Sign()
+	default:
+		switch f := x.(float64); {
+		case f < 0:
+			return -1
+		case f > 0:
+			return 1
+		}
+		return 0
+	}
+}
+
+// cmpNum compares the values of x and y exactly, returning -1, 0 or 1
+func cmpNum(x, y num) int {
+	if a, ok := x.(int64); ok {
+		if b, ok := y.(int64); ok {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+	}
+	if f, ok := x.(float64); ok {
+		if g, ok := y.(float64); ok {
+			switch {
+			case f < g:
+				return -1
+			case f > g:
+				return 1
+			}
+			return 0
+		}
+	}
+	// floats convert exactly to rationals
+	return toRat(x).Cmp(toRat(y))
+}
+
+// numTerm returns the term for the number x
+func numTerm(x num) term.Term {
+	switch x := x.(type) {
+	case int64:
+		return term.NewInteger(x)
+	case *big.Int:
+		return term.NewBigInteger(x)
+	case *big.Rat:
+		return term.NewRational(x)
+	default:
+		return term.NewFloat(x.(float64))
+	}
+}
+
+// numCell returns the cell for the number x
+func (m *Machine) numCell(x num) Cell {
+	if i, ok := x.(int64); ok && i >= minInt && i <= maxInt {
+		return intCell(i)
+	}
+	return m.nums.cell(x)
+}
+
+// constNum returns the value of the number t
+func constNum(t term.Term) num {
+	switch t := t.(type) {
+	case *term.Integer:
+		if i, ok := t.Int64(); ok {
+			return i
+		}
+		return t.Value()
+	case term.Float:
+		return float64(t)
+	default:
+		return t.(*term.Rational).Value()
+	}
+}
+
+// cellNum returns the value of the number in an INT or NUM cell
+func (m *Machine) cellNum(c Cell) num {
+	if c.Tag() == INT {
+		return c.Int()
+	}
+	return m.nums.lookup(c)
+}
+
+// needInts returns a type error if any of xs is not an integer
+func needInts(xs ...num) error {
+	for _, x := range xs {
+		if rank(x) > rankBig {
+			return TypeError{"integer", numTerm(x)}
+		}
+	}
+	return nil
+}
+
+// divisor returns an error if x and y are not integers, or y is zero
+func divisor(x, y num) error {
+	if err := needInts(x, y); err != nil {
+		return err
+	}
+	if numSign(y) == 0 {
+		return EvaluationError{"zero_divisor"}
+	}
+	return nil
+}
+
+// intOp applies an operation on the integers x and y. small is used
+// if both are int64s, unless it reports that the result overflows,
+// large is used otherwise.
+func intOp(x, y num, small func(a, b int64) (int64, bool), large func(a, b *big.Int) *big.Int) num {
+	if a, ok := x.(int64); ok {
+		if b, ok := y.(int64); ok {
+			if r, ok := small(a, b); ok {
+				return r
+			}
+		}
+	}
+	return norm(large(toBig(x), toBig(y)))
+}
+
+// floatOp applies an operation on the values of x and y as floats
+func floatOp(x, y num, f func(a, b float64) float64) (num, error) {
+	a, err := toFloat(x)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toFloat(y)
+	if err != nil {
+		return nil, err
+	}
+	return checkFloat(f(a, b))
+}
+
+// floatFn returns a function of the value of its argument as a float
+func floatFn(f func(float64) float64) func(num) (num, error) {
+	return func(x num) (num, error) {
+		a, err := toFloat(x)
+		if err != nil {
+			return nil, err
+		}
+		return checkFloat(f(a))
+	}
+}
+
+// positive returns f, raising an error for arguments that are not
+// positive.
+func positive(f func(num) (num, error)) func(num) (num, error) {
+	return func(x num) (num, error) {
+		if numSign(x) <= 0 {
+			return nil, EvaluationError{"undefined"}
+		}
+		return f(x)
+	}
+}
+
+func add(x, y num) (num, error) {
+	switch rank2(x, y) {
+	case rankInt:
+		a, b := x.(int64), y.(int64)
+		if s := a + b; (s > a) == (b > 0) {
+			return s, nil
+		}
+		fallthrough
+	case rankBig:
+		return norm(new(big.Int).Add(toBig(x), toBig(y))), nil
+	case rankRat:
+		return norm(new(big.Rat).Add(toRat(x), toRat(y))), nil
+	default:
+		return floatOp(x, y, func(a, b float64) float64 { return a + b })
+	}
+}
+
+func sub(x, y num) (num, error) {
+	switch rank2(x, y) {
+	case rankInt:
+		a, b := x.(int64), y.(int64)
+		if d := a - b; (d < a) == (b > 0) {
+			return d, nil
+		}
+		fallthrough
+	case rankBig:
+		return norm(new(big.Int).Sub(toBig(x), toBig(y))), nil
+	case rankRat:
+		return norm(new(big.Rat).Sub(toRat(x), toRat(y))), nil
+	default:
+		return floatOp(x, y, func(a, b float64) float64 { return a - b })
+	}
+}
+
+func mul(x, y num) (num, error) {
+	switch rank2(x, y) {
+	case rankInt:
+		a, b := x.(int64), y.(int64)
+		if a == 0 || b == 0 {
+			return int64(0), nil
+		}
+		if p := a * b; p/b == a && !(a == math.MinInt64 && b == -1) {
+			return p, nil
+		}
+		fallthrough
+	case rankBig:
+		return norm(new(big.Int).Mul(toBig(x), toBig(y))), nil
+	case rankRat:
+		return norm(new(big.Rat).Mul(toRat(x), toRat(y))), nil
+	default:
+		return floatOp(x, y, func(a, b float64) float64 { return a * b })
+	}
+}
+
+// divide implements /, the quotient of two integers is an integer if
+// it is exact, and a float otherwise.
+func divide(x, y num) (num, error) {
+	if numSign(y) == 0 {
+		return nil, EvaluationError{"zero_divisor"}
+	}
+	switch rank2(x, y) {
+	case rankInt:
+		a, b := x.(int64), y.(int64)
+		if a%b == 0 && !(a == math.MinInt64 && b == -1) {
+			return a / b, nil
+		}
+		fallthrough
+	case rankBig:
+		q, r := new(big.Int).QuoRem(toBig(x), toBig(y), new(big.Int))
+		if r.Sign() == 0 {
+			return norm(q), nil
+		}
+		f, _ := new(big.Rat).SetFrac(toBig(x), toBig(y)).Float64()
+		return checkFloat(f)
+	case rankRat:
+		return norm(new(big.Rat).Quo(toRat(x), toRat(y))), nil
+	default:
+		return floatOp(x, y, func(a, b float64) float64 { return a / b })
+	}
+}
+
+// intDiv implements //, which truncates towards zero
+func intDiv(x, y num) (num, error) {
+	if err := divisor(x, y); err != nil {
+		return nil, err
+	}
+	return intOp(x, y,
+		func(a, b int64) (int64, bool) { return a / b, !(a == math.MinInt64 && b == -1) },
+		func(a, b *big.Int) *big.Int { return new(big.Int).Quo(a, b) },
+	), nil
+}
+
+// floorDiv implements div, which rounds towards negative infinity
+func floorDiv(x, y num) (num, error) {
+	if err := divisor(x, y); err != nil {
+		return nil, err
+	}
+	return intOp(x, y,
+		func(a, b int64) (int64, bool) {
+			q := a / b
+			if a%b != 0 && (a < 0) != (b < 0) {
+				q--
+			}
+			return q, !(a == math.MinInt64 && b == -1)
+		},
+		func(a, b *big.Int) *big.Int {
+			q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+			if r.Sign() != 0 && r.Sign() != b.Sign() {
+				q.Sub(q, big.NewInt(1))
+			}
+			return q
+		},
+	), nil
+}
+
+// rem returns the remainder of //, which has the sign of x
+func rem(x, y num) (num, error) {
+	if err := divisor(x, y); err != nil {
+		return nil, err
+	}
+	return intOp(x, y,
+		func(a, b int64) (int64, bool) { return a % b, true },
+		func(a, b *big.Int) *big.Int { return new(big.Int).Rem(a, b) },
+	), nil
+}
+
+// mod returns the remainder of div, which has the sign of y
+func mod(x, y num) (num, error) {
+	if err := divisor(x, y); err != nil {
+		return nil, err
+	}
+	return intOp(x, y,
+		func(a, b int64) (int64, bool) {
+			r := a % b
+			if r != 0 && (r < 0) != (b < 0) {
+				r += b
+			}
+			return r, true
+		},
+		func(a, b *big.Int) *big.Int {
+			r := new(big.Int).Rem(a, b)
+			if r.Sign() != 0 && r.Sign() != b.Sign() {
+				r.Add(r, b)
+			}
+			return r
+		},
+	), nil
+}
+
+// bitOp returns a bitwise operation on integers
+func bitOp(small func(a, b int64) int64, large func(z, a, b *big.Int) *big.Int) func(num, num) (num, error) {
+	return func(x, y num) (num, error) {
+		if err := needInts(x, y); err != nil {
+			return nil, err
+		}
+		return intOp(x, y,
+			func(a, b int64) (int64, bool) { return small(a, b), true },
+			func(a, b *big.Int) *big.Int { return large(new(big.Int), a, b) },
+		), nil
+	}
+}
+
+// shift shifts x left by y bits, or right if y is negative. Right
+// shifts round towards negative infinity.
+func shift(x, y num) (num, error) {
+	if err := needInts(x, y); err != nil {
+		return nil, err
+	}
+	var n int64
+	switch y := y.(type) {
+	case int64:
+		n = y
+	default:
+		n = int64(y.(*big.Int).Sign()) * (maxBits + 1)
+	}
+	if n > maxBits && numSign(x) != 0 {
+		return nil, ResourceError{"memory"}
+	}
+	if a, ok := x.(int64); ok {
+		switch {
+		case n <= -64:
+			return a >> 63, nil
+		case n < 0:
+			return a >> uint(-n), nil
+		case n < 63 && (a<<uint(n))>>uint(n) == a:
+			return a << uint(n), nil
+		}
+	}
+	if n < 0 {
+		if n < -maxBits {
+			n = -maxBits
+		}
+		return norm(new(big.Int).Rsh(toBig(x), uint(-n))), nil
+	}
+	return norm(new(big.Int).Lsh(toBig(x), uint(n))), nil
+}
+
+// shiftRight shifts x right by y bits
+func shiftRight(x, y num) (num, error) {
+	if err := needInts(x, y); err != nil {
+		return nil, err
+	}
+	y, _ = neg(y)
+	return shift(x, y)
+}
+
+func bitNot(x num) (num, error) {
+	if err := needInts(x); err != nil {
+		return nil, err
+	}
+	if a, ok := x.(int64); ok {
+		return ^a, nil
+	}
+	return norm(new(big.Int).Not(toBig(x))), nil
+}
+
+func neg(x num) (num, error) {
+	switch x := x.(type) {
+	case int64:
+		if x != math.MinInt64 {
+			return -x, nil
+		}
+		return new(big.Int).Neg(big.NewInt(x)), nil
+	case *big.Int:
+		return norm(new(big.Int).Neg(x)), nil
+	case *big.Rat:
+		return new(big.Rat).Neg(x), nil
+	default:
+		return -x.(float64), nil
+	}
+}
+
+func abs(x num) (num, error) {
+	if numSign(x) < 0 {
+		return neg(x)
+	}
+	return x, nil
+}
+
+func sign(x num) (num, error) {
+	if f, ok := x.(float64); ok {
+		if f == 0 {
+			return f, nil
+		}
+		return math.Copysign(1, f), nil
+	}
+	return int64(numSign(x)), nil
+}
+
+// bitLen returns the number of bits in the integer x, or in the
+// larger of the numerator and denominator of the rational x
+func bitLen(x num) int {
+	if r, ok := x.(*big.Rat); ok {
+		if n, d := r.Num().BitLen(), r.Denom().BitLen(); n > d {
+			return n
+		}
+		return r.Denom().BitLen()
+	}
+	return toBig(x).BitLen()
+}
+
+func minNum(x, y num) (num, error) {
+	if cmpNum(y, x) < 0 {
+		return y, nil
+	}
+	return x, nil
+}
+
+func maxNum(x, y num) (num, error) {
+	if cmpNum(y, x) > 0 {
+		return y, nil
+	}
+	return x, nil
+}
+
+// power implements ** and ^. Powers of integers and rationals to an
+// integer are exact, other than negative powers of integers, which
+// are floats for **, and an error for ^ unless the result is an
+// integer.
+func power(x, y num, caret bool) (num, error) {
+	if rank(y) > rankBig || rank(x) > rankRat {
+		if numSign(x) == 0 && numSign(y) < 0 {
+			return nil, EvaluationError{"zero_divisor"}
+		}
+		return floatOp(x, y, math.Pow)
+	}
+
+	if numSign(y) < 0 {
+		switch {
+		case numSign(x) == 0:
+			return nil, EvaluationError{"zero_divisor"}
+		case cmpNum(x, int64(1)) == 0:
+			return int64(1), nil
+		case cmpNum(x, int64(-1)) == 0:
+			if toBig(y).Bit(0) == 0 {
+				return int64(1), nil
+			}
+			return int64(-1), nil
+		case rank(x) == rankRat:
+			x = new(big.Rat).Inv(x.(*big.Rat))
+			y, _ = neg(y)
+		case caret:
+			return nil, TypeError{"float", numTerm(x)}
+		default:
+			return floatOp(x, y, math.Pow)
+		}
+	}
+
+	// only the powers of -1, 0 and 1 stay small
+	if rank(x) == rankRat || cmpNum(x, int64(-1)) < 0 || cmpNum(x, int64(1)) > 0 {
+		n, ok := y.(int64)
+		if !ok || n > maxBits || int64(bitLen(x))*n > maxBits {
+			return nil, ResourceError{"memory"}
+		}
+	}
+	if r, ok := x.(*big.Rat); ok {
+		n := new(big.Int).Exp(r.Num(), toBig(y), nil)
+		d := new(big.Int).Exp(r.Denom(), toBig(y), nil)
+		return norm(new(big.Rat).SetFrac(n, d)), nil
+	}
+	return norm(new(big.Int).Exp(toBig(x), toBig(y), nil)), nil
+}
+
+// floatInt returns the integer value of the integral float f
+func floatInt(f float64) num {
+	if f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f)
+	}
+	i, _ := big.NewFloat(f).Int(nil)
+	return norm(i)
+}
+
+// rounding returns a conversion to an integer, which rounds floats
+// with f and rationals with r, integers are left alone.
+func rounding(f func(float64) float64, r func(*big.Rat) *big.Int) func(num) (num, error) {
+	return func(x num) (num, error) {
+		switch x := x.(type) {
+		case float64:
+			return floatInt(f(x)), nil
+		case *big.Rat:
+			return norm(r(x)), nil
+		default:
+			return x, nil
+		}
+	}
+}
+
+func ratFloor(r *big.Rat) *big.Int {
+	// the denominator is positive, so euclidean division rounds down
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+func ratCeiling(r *big.Rat) *big.Int {
+	q := ratFloor(new(big.Rat).Neg(r))
+	return q.Neg(q)
+}
+
+func ratTruncate(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// ratRound rounds r to the nearest integer, and halves away from zero
+func ratRound(r *big.Rat) *big.Int {
+	half := big.NewRat(1, 2)
+	if r.Sign() < 0 {
+		q := ratFloor(new(big.Rat).Add(new(big.Rat).Neg(r), half))
+		return q.Neg(q)
+	}
+	return ratFloor(new(big.Rat).Add(r, half))
+}
+
+func gcd(x, y num) (num, error) {
+	if err := needInts(x, y); err != nil {
+		return nil, err
+	}
+	a, b := toBig(x), toBig(y)
+	return norm(new(big.Int).GCD(nil, nil, new(big.Int).Abs(a), new(big.Int).Abs(b))), nil
+}
+
+// needRationals returns a type error if any of xs is a float
+func needRationals(xs ...num) error {
+	for _, x := range xs {
+		if rank(x) == rankFloat {
+			return TypeError{"rational", numTerm(x)}
+		}
+	}
+	return nil
+}
+
+func rdiv(x, y num) (num, error) {
+	if err := needRationals(x, y); err != nil {
+		return nil, err
+	}
+	if numSign(y) == 0 {
+		return nil, EvaluationError{"zero_divisor"}
+	}
+	return norm(new(big.Rat).Quo(toRat(x), toRat(y))), nil
+}
+
+func numerator(x num) (num, error) {
+	if err := needRationals(x); err != nil {
+		return nil, err
+	}
+	return norm(new(big.Int).Set(toRat(x).Num())), nil
+}
+
+func denominator(x num) (num, error) {
+	if err := needRationals(x); err != nil {
+		return nil, err
+	}
+	return norm(new(big.Int).Set(toRat(x).Denom())), nil
+}
+
+func atan2(x, y num) (num, error) {
+	if numSign(x) == 0 && numSign(y) == 0 {
+		return nil, EvaluationError{"undefined"}
+	}
+	return floatOp(x, y, math.Atan2)
+}
+
+// arith0, arith1 and arith2 hold the evaluable atoms, and the
+// evaluable functors of one and two arguments.
+var arith0 = map[AtomID]num{
+	Intern("pi"):                 math.Pi,
+	Intern("e"):                  math.E,
+	Intern("epsilon"):            math.Nextafter(1, 2) - 1,
+	Intern("max_tagged_integer"): int64(maxInt),
+	Intern("min_tagged_integer"): int64(minInt),
+}
+
+var arith1 = map[AtomID]func(num) (num, error){
+	Intern("-"):        neg,
+	Intern("+"):        func(x num) (num, error) { return x, nil },
+	Intern("abs"):      abs,
+	Intern("sign"):     sign,
+	Intern("\\"):       bitNot,
+	Intern("float"):    floatFn(func(f float64) float64 { return f }),
+	Intern("integer"):  rounding(math.Round, ratRound),
+	Intern("truncate"): rounding(math.Trunc, ratTruncate),
+	Intern("round"):    rounding(math.Round, ratRound),
+	Intern("ceiling"):  rounding(math.Ceil, ratCeiling),
+	Intern("floor"):    rounding(math.Floor, ratFloor),
+
+	Intern("float_integer_part"):    floatFn(math.Trunc),
+	Intern("float_fractional_part"): floatFn(func(f float64) float64 { return f - math.Trunc(f) }),
+
+	Intern("sqrt"):  floatFn(math.Sqrt),
+	Intern("sin"):   floatFn(math.Sin),
+	Intern("cos"):   floatFn(math.Cos),
+	Intern("tan"):   floatFn(math.Tan),
+	Intern("asin"):  floatFn(math.Asin),
+	Intern("acos"):  floatFn(math.Acos),
+	Intern("atan"):  floatFn(math.Atan),
+	Intern("sinh"):  floatFn(math.Sinh),
+	Intern("cosh"):  floatFn(math.Cosh),
+	Intern("tanh"):  floatFn(math.Tanh),
+	Intern("asinh"): floatFn(math.Asinh),
+	Intern("acosh"): floatFn(math.Acosh),
+	Intern("atanh"): floatFn(math.Atanh),
+	Intern("exp"):   floatFn(math.Exp),
+	Intern("log"):   positive(floatFn(math.Log)),
+	Intern("log2"):  positive(floatFn(math.Log2)),
+
+	Intern("rational"):    func(x num) (num, error) { return norm(toRat(x)), nil },
+	Intern("numerator"):   numerator,
+	Intern("denominator"): denominator,
+}
+
+var arith2 = map[AtomID]func(num, num) (num, error){
+	Intern("+"):    add,
+	Intern("-"):    sub,
+	Intern("*"):    mul,
+	Intern("/"):    divide,
+	Intern("//"):   intDiv,
+	Intern("div"):  floorDiv,
+	Intern("rem"):  rem,
+	Intern("mod"):  mod,
+	Intern("rdiv"): rdiv,
+	Intern("min"):  minNum,
+	Intern("max"):  maxNum,
+	Intern("gcd"):  gcd,
+	Intern("**"):   func(x, y num) (num, error) { return power(x, y, false) },
+	Intern("^"):    func(x, y num) (num, error) { return power(x, y, true) },
+	Intern("/\\"):  bitOp(func(a, b int64) int64 { return a & b }, (*big.Int).And),
+	Intern("\\/"):  bitOp(func(a, b int64) int64 { return a | b }, (*big.Int).Or),
+	Intern("xor"):  bitOp(func(a, b int64) int64 { return a ^ b }, (*big.Int).Xor),
+	Intern("<<"):   shift,
+	Intern(">>"):   shiftRight,
+	Intern("atan"): atan2,
+
+	Intern("atan2"): atan2,
+	Intern("log"): func(x, y num) (num, error) {
+		if numSign(x) <= 0 || numSign(y) <= 0 {
+			return nil, EvaluationError{"undefined"}
+		}
+		return floatOp(y, x, func(a, b float64) float64 { return math.Log(a) / math.Log(b) })
+	},
+	Intern("copysign"): func(x, y num) (num, error) { return floatOp(x, y, math.Copysign) },
+}
+
+// eval evaluates the arithmetic expression at a
+func (m *Machine) eval(a Addr) (num, error) {
+	a = m.deref(a)
+	switch c := m.cell(a); c.Tag() {
+	case REF:
+		return nil, InstantiationError{}
+	case INT, NUM:
+		return m.cellNum(c), nil
+	case CON:
+		if x, ok := arith0[c.Atom()]; ok {
+			return x, nil
+		}
+		return nil, TypeError{"evaluable", indicator(Functor{c.Atom(), 0})}
+	case STR:
+		f := m.cell(c.Addr()).Functor()
+		switch f.Arity {
+		case 1:
+			fn, ok := arith1[f.Name]
+			if !ok {
+				break
+			}
+			x, err := m.eval(c.Addr() + 1)
+			if err != nil {
+				return nil, err
+			}
+			return fn(x)
+		case 2:
+			fn, ok := arith2[f.Name]
+			if !ok {
+				break
+			}
+			x, err := m.eval(c.Addr() + 1)
+			if err != nil {
+				return nil, err
+			}
+			y, err := m.eval(c.Addr() + 2)
+			if err != nil {
+				return nil, err
+			}
+			return fn(x, y)
+		}
+		return nil, TypeError{"evaluable", indicator(f)}
+	default:
+		return nil, TypeError{"evaluable", indicator(NewFunctor(".", 2))}
+	}
+}
+
+// is2 implements Result is Expression
+func is2(m *Machine) {
+	x, err := m.eval(m.regPtr(X(1)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	m.setReg(X(1), m.numCell(x))
+	m.unify(m.regPtr(X(0)), m.regPtr(X(1)))
+}
+
+// arithCompare returns a builtin comparing the values of two
+// expressions, it succeeds if test holds for the result of cmpNum.
+func arithCompare(test func(c int) bool) builtin {
+	return func(m *Machine) {
+		x, err := m.eval(m.regPtr(X(0)))
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		y, err := m.eval(m.regPtr(X(1)))
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		if !test(cmpNum(x, y)) {
+			m.fail()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var arithtests = []atest{
+	{q: `X is 1 + 2 * 3.`, v: "X", exp: []string{"7"}},
+	{q: `X is 7 - 10.`, v: "X", exp: []string{"-3"}},
+	{q: `X is - (4).`, v: "X", exp: []string{"-4"}},
+	{q: `X is 7 / 2.`, v: "X", exp: []string{"3.5"}},
+	{q: `X is 8 / 2.`, v: "X", exp: []string{"4"}},
+	{q: `X is 7 // 2.`, v: "X", exp: []string{"3"}},
+	{q: `X is -7 // 2.`, v: "X", exp: []string{"-3"}},
+	{q: `X is -7 div 2.`, v: "X", exp: []string{"-4"}},
+	{q: `X is -7 rem 2.`, v: "X", exp: []string{"-1"}},
+	{q: `X is -7 mod 2.`, v: "X", exp: []string{"1"}},
+	{q: `X is 7 mod -2.`, v: "X", exp: []string{"-1"}},
+	{q: `X is 2 ** 10.`, v: "X", exp: []string{"1024"}},
+	{q: `X is 2 ** (-1).`, v: "X", exp: []string{"0.5"}},
+	{q: `X is 2 ^ 100.`, v: "X", exp: []string{"1267650600228229401496703205376"}},
+	{q: `X is (-1) ^ -3.`, v: "X", exp: []string{"-1"}},
+	{q: `X is 12 /\ 10.`, v: "X", exp: []string{"8"}},
+	{q: `X is 12 \/ 10.`, v: "X", exp: []string{"14"}},
+	{q: `X is 12 xor 10.`, v: "X", exp: []string{"6"}},
+	{q: `X is \ 5.`, v: "X", exp: []string{"-6"}},
+	{q: `X is 1 << 70.`, v: "X", exp: []string{"1180591620717411303424"}},
+	{q: `X is (1 << 70) >> 68.`, v: "X", exp: []string{"4"}},
+	{q: `X is -5 >> 1.`, v: "X", exp: []string{"-3"}},
+	{q: `X is max(1, 2) + min(3, 4).`, v: "X", exp: []string{"5"}},
+	{q: `X is abs(-3) * sign(-2).`, v: "X", exp: []string{"-3"}},
+	{q: `X is sqrt(9 / 4).`, v: "X", exp: []string{"1.5"}},
+	{q: `X is truncate(-7 / 2).`, v: "X", exp: []string{"-3"}},
+	{q: `X is round(-7 / 2).`, v: "X", exp: []string{"-4"}},
+	{q: `X is ceiling(13 / 4).`, v: "X", exp: []string{"4"}},
+	{q: `X is floor(-13 / 4).`, v: "X", exp: []string{"-4"}},
+	{q: `X is gcd(12, -18).`, v: "X", exp: []string{"6"}},
+	{q: `X is 1 rdiv 3 + 1 rdiv 6.`, v: "X", exp: []string{"1r2"}},
+	{q: `X is 1 rdiv 3 * 3.`, v: "X", exp: []string{"1"}},
+	{q: `X is (2 rdiv 3) ^ 2.`, v: "X", exp: []string{"4r9"}},
+	{q: `X is floor(-7 rdiv 2).`, v: "X", exp: []string{"-4"}},
+	{q: `X is 9223372036854775807 + 1 - 1.`, v: "X", exp: []string{"9223372036854775807"}},
+	{q: `X is 4611686018427387904 * 4611686018427387904.`, v: "X", exp: []string{"21267647932558653966460912964485513216"}},
+	{q: `X is (2 ** 64) // 3.`, v: "X", exp: []string{"6148914691236517205"}},
+	{q: `X is (2 ** 64) mod 10.`, v: "X", exp: []string{"6"}},
+	{q: `X is pi.`, v: "X", exp: []string{"3.141592653589793"}},
+	{q: `X is 7 / 2.0.`, v: "X", exp: []string{"3.5"}},
+	{q: `X is 4 / 2.0.`, v: "X", exp: []string{"2.0"}},
+	{q: `X is float(3).`, v: "X", exp: []string{"3.0"}},
+	{q: `X is integer(2.5).`, v: "X", exp: []string{"3"}},
+	{q: `X is 2.0 ** 3.`, v: "X", exp: []string{"8.0"}},
+	{q: `X is 0.1 + 0.2.`, v: "X", exp: []string{"0.30000000000000004"}},
+	{q: `X is 1.0e10 * 1.0e20.`, v: "X", exp: []string{"1.0e+30"}},
+	{q: `X is -0x10 + 0'a.`, v: "X", exp: []string{"81"}},
+	{q: `X is 1r3 + 1r6.`, v: "X", exp: []string{"1r2"}},
+	{q: `X is 2 ** 100, integer(X).`, v: "X", exp: []string{"1267650600228229401496703205376"}},
+	{q: `integer(1.0), X = yes.`, v: "X", exp: []string{}},
+	{q: `float(1.0), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `float(1), X = yes.`, v: "X", exp: []string{}},
+	{q: `1 =:= 1.0, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `X = 1, X = 1.0.`, v: "X", exp: []string{}},
+	{q: `X is 1 + 2, X = 3.`, v: "X", exp: []string{"3"}},
+	{q: `3 is 1 + 2, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `4 is 1 + 2, X = yes.`, v: "X", exp: []string{}},
+	{q: `1 < 2, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `2 < 1, X = yes.`, v: "X", exp: []string{}},
+	{q: `1 + 1 =:= 2, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `1 =\= 2, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `2 =< 2, 2 >= 2, 3 > 2, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `1 rdiv 3 < 34 / 100, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `2 ** 64 > 2 ** 63, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `X is Y + 1.`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `X is foo + 1.`, v: "X", exp: []string{}, err: TypeError{"evaluable", indicator(NewFunctor("foo", 0))}},
+	{q: `X is foo(1).`, v: "X", exp: []string{}, err: TypeError{"evaluable", indicator(NewFunctor("foo", 1))}},
+	{q: `X is 1 / 0.`, v: "X", exp: []string{}, err: EvaluationError{"zero_divisor"}},
+	{q: `X is 1 mod 0.`, v: "X", exp: []string{}, err: EvaluationError{"zero_divisor"}},
+	{q: `X is 1.5 mod 2.`, v: "X", exp: []string{}, err: TypeError{"integer", numTerm(1.5)}},
+	{q: `X is 2 ^ -1.`, v: "X", exp: []string{}, err: TypeError{"float", numTerm(int64(2))}},
+	{q: `X is 1.5 rdiv 2.`, v: "X", exp: []string{}, err: TypeError{"rational", numTerm(1.5)}},
+	{q: `X is 1.0e308 * 10.`, v: "X", exp: []string{}, err: EvaluationError{"float_overflow"}},
+	{q: `X is sqrt(-1).`, v: "X", exp: []string{}, err: EvaluationError{"undefined"}},
+	{q: `X is log(0).`, v: "X", exp: []string{}, err: EvaluationError{"undefined"}},
+	{q: `X < 1.`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `catch(X is 1 // 0, error(E, _), true).`, v: "E", exp: []string{"evaluation_error(zero_divisor)"}},
+	{q: `hanoi(10, N).`, v: "N", exp: []string{"1023"}},
+}
+
+func TestArith(t *testing.T) {
+	for _, st := range arithtests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `
+X = X.
+hanoi(1, 1) :- !.
+hanoi(N, M) :- N > 1, K is N - 1, hanoi(K, M1), M is 2 * M1 + 1.
+`)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
+
+func TestArithCount(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long count in short mode")
+	}
+	m := loadProgram(t, `
+X = X.
+count(N, N) :- !.
+count(I, N) :- I1 is I + 1, count(I1, N).
+`)
+	res, err := allSolutions(t, m, "count(0, 10000000), X = done.", "X")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(res, []string{"done"}) {
+		t.Fatalf("expected [done], got %v", res)
+	}
+	if len(m.AndStack) > 2 {
+		t.Fatalf("expected constant stack, got %d environments", len(m.AndStack))
+	}
+	if len(m.Stack) > initialStack {
+		t.Fatalf("expected constant stack, got %d permanent variables", len(m.Stack))
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"sync"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// AtomID is the identifier of an interned atom. Atoms with the same
+// name always have the same ID, so atoms, and functors, can be
+// compared as integers.
+type AtomID uint32
+
+// atomTable maps atom names to IDs, and back again
+type atomTable struct {
+	sync.RWMutex
+	names []term.Atom
+	index map[term.Atom]AtomID
+}
+
+// atoms is shared by all machines, as compiled code holds the IDs of
+// the atoms it refers to.
+var atoms = &atomTable{index: map[term.Atom]AtomID{}}
+
+// atomNil is the empty list
+var atomNil = Intern("[]")
+
+// Intern returns the ID of the atom name, adding it to the atom table
+// if it has not been seen before.
+func Intern(name term.Atom) AtomID {
+	atoms.RLock()
+	id, ok := atoms.index[name]
+	atoms.RUnlock()
+	if ok {
+		return id
+	}
+
+	atoms.Lock()
+	defer atoms.Unlock()
+	if id, ok := atoms.index[name]; ok {
+		return id
+	}
+	id = AtomID(len(atoms.names))
+	atoms.names = append(atoms.names, name)
+	atoms.index[name] = id
+	return id
+}
+
+// Name returns the name of the atom
+func (a AtomID) Name() term.Atom {
+	atoms.RLock()
+	defer atoms.RUnlock()
+	return atoms.names[a]
+}
+
+func (a AtomID) String() string {
+	return string(a.Name())
+}
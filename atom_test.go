@@ -0,0 +1,32 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import "testing"
+
+func TestIntern(t *testing.T) {
+	a := Intern("likes")
+	if Intern("likes") != a {
+		t.Fatalf("interning the same name twice gave different IDs")
+	}
+	if Intern("hates") == a {
+		t.Fatalf("interning different names gave the same ID")
+	}
+	if a.Name() != "likes" {
+		t.Fatalf("expected likes, got %s", a.Name())
+	}
+	if f := NewFunctor("likes", 2); f.String() != "likes/2" {
+		t.Fatalf("expected likes/2, got %s", f)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tcolgate/golorp/context"
+	"github.com/tcolgate/golorp/parse"
+	"github.com/tcolgate/golorp/scan"
+)
+
+// benchQuery runs the query src against the program p b.N times,
+// finding the first solution each time.
+func benchQuery(b *testing.B, p, src string) {
+	m := loadProgram(b, p)
+
+	var ctx context.Context
+	s := scan.New(ctx, "bench.pl", bytes.NewBuffer([]byte(src)))
+	q, err := parse.New("bench.pl", s).NextTerm()
+	if err != nil {
+		b.Fatalf("parsing query failed, %v", err)
+	}
+	qcs, _ := compileL1Query(q)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sols := m.Query(qcs)
+		if !sols.Next() {
+			b.Fatalf("query failed, %v", sols.Err())
+		}
+		sols.Close()
+	}
+}
+
+// intList returns the Prolog text of a list of the integers 1 to n
+func intList(n int) string {
+	strs := []string{}
+	for i := 1; i <= n; i++ {
+		strs = append(strs, fmt.Sprintf("%d", i))
+	}
+	return "[" + strings.Join(strs, ",") + "]"
+}
+
+// nestedTerm returns the Prolog text of f(f(...f(a)...)) nested n deep
+func nestedTerm(n int) string {
+	return strings.Repeat("f(", n) + "a" + strings.Repeat(")", n)
+}
+
+func BenchmarkNaiveReverse30(b *testing.B) {
+	benchQuery(b, `
+app([],L,L).
+app([H|T],L,[H|R]) :- app(T,L,R).
+nrev([],[]).
+nrev([H|T],R) :- nrev(T,RT), app(RT,[H],R).
+`, "nrev("+intList(30)+",X).")
+}
+
+func BenchmarkUnifyNested(b *testing.B) {
+	t := nestedTerm(200)
+	benchQuery(b, `eq(X,X).`, "eq("+t+","+t+").")
+}
@@ -0,0 +1,318 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// builtin is a predicate implemented by the machine. It is run with
+// its arguments in the argument registers, and P set to the
+// continuation of the call. A builtin that succeeds leaves P alone,
+// one that fails backtracks, and one that calls a goal transfers
+// control to it.
+type builtin func(m *Machine)
+
+// builtins maps predicates to their implementations, calls to these
+// predicates never reach the program.
+var builtins = map[Functor]builtin{}
+
+func init() {
+	builtins[NewFunctor("call", 1)] = func(m *Machine) { m.callGoal() }
+	for n := 2; n <= 8; n++ {
+		builtins[NewFunctor("call", n)] = callN
+	}
+	builtins[NewFunctor("catch", 3)] = catch3
+	builtins[NewFunctor("throw", 1)] = throw1
+
+	builtins[NewFunctor("is", 2)] = is2
+	builtins[NewFunctor("=:=", 2)] = arithCompare(func(c int) bool { return c == 0 })
+	builtins[NewFunctor("=\\=", 2)] = arithCompare(func(c int) bool { return c != 0 })
+	builtins[NewFunctor("<", 2)] = arithCompare(func(c int) bool { return c < 0 })
+	builtins[NewFunctor(">", 2)] = arithCompare(func(c int) bool { return c > 0 })
+	builtins[NewFunctor("=<", 2)] = arithCompare(func(c int) bool { return c <= 0 })
+	builtins[NewFunctor(">=", 2)] = arithCompare(func(c int) bool { return c >= 0 })
+
+	for f, test := range typeTests {
+		builtins[f] = typeTest(test)
+	}
+
+	builtins[NewFunctor("compare", 3)] = compare3
+	builtins[NewFunctor("==", 2)] = termCompare(func(c int) bool { return c == 0 })
+	builtins[NewFunctor("\\==", 2)] = termCompare(func(c int) bool { return c != 0 })
+	builtins[NewFunctor("@<", 2)] = termCompare(func(c int) bool { return c < 0 })
+	builtins[NewFunctor("@>", 2)] = termCompare(func(c int) bool { return c > 0 })
+	builtins[NewFunctor("@=<", 2)] = termCompare(func(c int) bool { return c <= 0 })
+	builtins[NewFunctor("@>=", 2)] = termCompare(func(c int) bool { return c >= 0 })
+	builtins[NewFunctor("msort", 2)] = msort2
+	builtins[NewFunctor("sort", 2)] = sort2
+	builtins[NewFunctor("sort", 4)] = sort4
+
+	builtins[NewFunctor("assert", 1)] = assertClause(false)
+	builtins[NewFunctor("asserta", 1)] = assertClause(true)
+	builtins[NewFunctor("assertz", 1)] = assertClause(false)
+	builtins[NewFunctor("retract", 1)] = retract1
+	builtins[NewFunctor("abolish", 1)] = abolish1
+	builtins[NewFunctor("dynamic", 1)] = dynamic1
+
+	builtins[NewFunctor("functor", 3)] = functor3
+	builtins[NewFunctor("arg", 3)] = arg3
+	builtins[NewFunctor("=..", 2)] = univ
+	builtins[NewFunctor("copy_term", 2)] = copyTerm2
+	builtins[NewFunctor("term_variables", 2)] = termVariables2
+	builtins[NewFunctor("setarg", 3)] = setArg(true)
+	builtins[NewFunctor("nb_setarg", 3)] = setArg(false)
+
+	builtins[NewFunctor("atom_codes", 2)] = atomList(false)
+	builtins[NewFunctor("atom_chars", 2)] = atomList(true)
+	builtins[NewFunctor("char_code", 2)] = charCode
+	builtins[NewFunctor("atom_length", 2)] = atomLength
+	builtins[NewFunctor("atom_concat", 3)] = atomConcat
+	builtins[NewFunctor("sub_atom", 5)] = subAtom5
+	builtins[NewFunctor("number_codes", 2)] = numberCodes
+	builtins[NewFunctor("atom_number", 2)] = atomNumber
+	builtins[NewFunctor("upcase_atom", 2)] = upcaseAtom
+	builtins[NewFunctor("split_string", 4)] = splitString
+
+	builtins[NewFunctor("findall", 3)] = findall
+	builtins[NewFunctor("findall", 4)] = findall
+	builtins[NewFunctor("'$free_variable_set'", 3)] = freeVariableSet
+	builtins[NewFunctor("=@=", 2)] = variant(true)
+	builtins[NewFunctor("\\=@=", 2)] = variant(false)
+}
+
+// typeTest returns a builtin that succeeds if test holds for the
+// term in A0
+func typeTest(test typeTester) builtin {
+	return func(m *Machine) {
+		if !test(m, m.derefReg(0)) {
+			m.fail()
+		}
+	}
+}
+
+// callGoal calls the goal in A0, returning to CP. Cuts within the
+// goal are local to it. Goals built from control constructs are
+// compiled the first time a goal of the same shape is called.
+func (m *Machine) callGoal() {
+	m.callCut(m.BReg)
+}
+
+// callCut calls the goal in A0, as callGoal, but cuts within the goal
+// discard the choice points created since b.
+func (m *Machine) callCut(b int) {
+	a := m.derefReg(0)
+	c := m.cell(a)
+	if c.Tag() == STR {
+		f := m.cell(c.Addr()).Functor()
+		if !isControl(f) {
+			for i := 0; i < f.Arity; i++ {
+				m.setReg(X(i), m.cell(c.Addr()+Addr(1+i)))
+			}
+			m.callPred(f)
+			return
+		}
+	}
+	if c.Tag() == CON && !isControl(Functor{c.Atom(), 0}) {
+		m.callPred(Functor{c.Atom(), 0})
+		return
+	}
+	if c.Tag() == REF {
+		m.throw(InstantiationError{})
+		return
+	}
+
+	args := []Cell{}
+	body, err := m.goalShape(a, &args)
+	if err != nil {
+		if _, ok := err.(TypeError); ok {
+			err = TypeError{"callable", m.culprit(a)}
+		}
+		m.throw(err)
+		return
+	}
+
+	key := term.Format(body)
+	l, ok := m.dynCode[key]
+	if !ok {
+		vs := make([]term.Term, len(args))
+		for i := range vs {
+			vs[i] = term.NewVariable(fmt.Sprintf("A%d", i))
+		}
+		head := term.NewCallable("$call", vs)
+		_, cl := compileClause(term.NewCallable(":-", []term.Term{head, body}))
+		l = m.addCode(key, cl.Code)
+	}
+
+	for i, c := range args {
+		m.setReg(X(i), c)
+	}
+	m.NumArgs = len(args)
+	m.GBReg = b
+	m.PReg = l
+}
+
+// callN implements call/N, adding the arguments A1... to the goal in
+// A0 before calling it.
+func callN(m *Machine) {
+	n := m.NumArgs - 1
+	a := m.derefReg(0)
+	var f Functor
+	var args Addr
+	switch c := m.cell(a); c.Tag() {
+	case REF:
+		m.throw(InstantiationError{})
+		return
+	case CON:
+		f = Functor{c.Atom(), 0}
+	case STR:
+		f = m.cell(c.Addr()).Functor()
+		args = c.Addr() + 1
+	default:
+		m.throw(TypeError{"callable", m.culprit(a)})
+		return
+	}
+
+	if !m.reserve(1 + f.Arity + n) {
+		return
+	}
+	h := m.HReg
+	m.Heap[h] = funCell(Functor{f.Name, f.Arity + n})
+	for i := 0; i < f.Arity; i++ {
+		m.Heap[h+1+i] = m.cell(args + Addr(i))
+	}
+	for i := 0; i < n; i++ {
+		m.Heap[h+1+f.Arity+i] = m.getReg(X(1 + i))
+	}
+	m.HReg = h + 1 + f.Arity + n
+	m.setReg(X(0), strCell(heapAddr(h)))
+	m.callGoal()
+}
+
+// goalShape returns the shape of the goal at a, with the arguments of
+// each of the goals within it replaced by variables A0, A1, ... The
+// cells of the arguments are appended to args. A variable goal G is
+// called as call(G).
+func (m *Machine) goalShape(a Addr, args *[]Cell) (term.Term, error) {
+	a = m.deref(a)
+	switch c := m.cell(a); c.Tag() {
+	case REF:
+		v := term.NewVariable(fmt.Sprintf("A%d", len(*args)))
+		*args = append(*args, c)
+		return term.NewCallable("call", []term.Term{v}), nil
+	case CON:
+		return atom(c.Atom().String()), nil
+	case STR:
+		f := m.cell(c.Addr()).Functor()
+		ts := make([]term.Term, f.Arity)
+		for i := range ts {
+			at := c.Addr() + Addr(1+i)
+			if isControl(f) {
+				t, err := m.goalShape(at, args)
+				if err != nil {
+					return nil, err
+				}
+				ts[i] = t
+				continue
+			}
+			ts[i] = term.NewVariable(fmt.Sprintf("A%d", len(*args)))
+			*args = append(*args, m.cell(at))
+		}
+		return term.NewCallable(f.Name.String(), ts), nil
+	default:
+		return nil, TypeError{Type: "callable"}
+	}
+}
+
+// controlFunctors are the control constructs that are compiled
+// inline by the clause compiler
+var controlFunctors = map[Functor]bool{
+	NewFunctor(",", 2):     true,
+	NewFunctor(";", 2):     true,
+	NewFunctor("->", 2):    true,
+	NewFunctor("*->", 2):   true,
+	NewFunctor("\\+", 1):   true,
+	NewFunctor("!", 0):     true,
+	NewFunctor("true", 0):  true,
+	NewFunctor("fail", 0):  true,
+	NewFunctor("false", 0): true,
+}
+
+// isControl reports whether f is a control construct
+func isControl(f Functor) bool {
+	return controlFunctors[f]
+}
+
+// addCode appends code compiled while a query is running, returning
+// its address. The code is discarded when the query is closed.
+func (m *Machine) addCode(key string, cs CodeCells) int {
+	l := len(m.Code)
+	m.Code = append(m.Code, cs...)
+	m.dynCode[key] = l
+	return l
+}
+
+// culprit returns the term at a, to be reported in an error
+func (m *Machine) culprit(a Addr) term.Term {
+	t, err := m.decode(a, map[Addr]bool{})
+	if err != nil {
+		return atom("cyclic")
+	}
+	return t
+}
+
+// list returns the addresses of the elements of the list at a. It
+// returns an instantiation error if the list is partial, and a type
+// error if it is not a list.
+func (m *Machine) list(a Addr) ([]Addr, error) {
+	es := []Addr{}
+	for l := a; ; {
+		l = m.deref(l)
+		switch c := m.cell(l); c.Tag() {
+		case REF:
+			return nil, InstantiationError{}
+		case CON:
+			if c.Atom() == atomNil {
+				return es, nil
+			}
+		case LIS:
+			// a list longer than the heap must be cyclic
+			if len(es) <= m.HReg {
+				es = append(es, c.Addr())
+				l = c.Addr() + 1
+				continue
+			}
+		}
+		return nil, TypeError{"list", m.culprit(a)}
+	}
+}
+
+// newList builds a list of the cells cs, ending in tail, on the heap,
+// returning the cell that refers to it. If the heap is full, newList
+// returns false.
+func (m *Machine) newList(cs []Cell, tail Cell) (Cell, bool) {
+	if !m.reserve(2 * len(cs)) {
+		return 0, false
+	}
+	l := tail
+	for i := len(cs) - 1; i >= 0; i-- {
+		m.Heap[m.HReg] = cs[i]
+		m.Heap[m.HReg+1] = l
+		l = lisCell(heapAddr(m.HReg))
+		m.HReg += 2
+	}
+	return l, true
+}
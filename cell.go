@@ -0,0 +1,423 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// Cell is a single tagged word of machine storage. The low bits hold
+// the Tag, the rest hold the value of the cell: an address for REF,
+// STR and LIS cells, an atom ID for CON and FUN cells, a small integer
+// for INT cells, and an index into the machine's number table for NUM
+// cells.
+type Cell uint64
+
+// Tag identifies the type of a Cell
+type Tag uint64
+
+const (
+	REF Tag = iota // a reference, an unbound variable refers to itself
+	STR            // a structure, holds the address of its functor
+	CON            // an atom
+	INT            // a small integer
+	LIS            // a list pair, holds the address of the head
+	FUN            // the functor of a structure, its arguments follow it
+	NUM            // a number too large for an INT
+)
+
+const (
+	tagBits = 3
+	tagMask = 1<<tagBits - 1
+
+	// FUN cells hold the arity in the low bits of their value, and
+	// the atom ID of the name above it.
+	arityBits = 24
+	arityMask = 1<<arityBits - 1
+
+	// the range of integers that can be held in an INT cell
+	minInt = -1 << (63 - tagBits)
+	maxInt = 1<<(63-tagBits) - 1
+
+	// NUM cells hold the kind of the number in the low bits of their
+	// value, and its index in the number table above it.
+	numKindBits = 2
+	numKindMask = 1<<numKindBits - 1
+)
+
+// numKind is the kind of number held in a NUM cell
+type numKind uint64
+
+const (
+	numInt   numKind = iota // an integer too large for an INT cell
+	numFloat                // a float
+	numRat                  // a rational
+)
+
+func (k numKind) String() string {
+	switch k {
+	case numInt:
+		return "int"
+	case numFloat:
+		return "float"
+	default:
+		return "rational"
+	}
+}
+
+var tagNames = [...]string{"REF", "STR", "CON", "INT", "LIS", "FUN", "NUM"}
+
+func (t Tag) String() string {
+	if int(t) < len(tagNames) {
+		return tagNames[t]
+	}
+	return fmt.Sprintf("TAG%d", uint64(t))
+}
+
+// Tag returns the type of the cell
+func (c Cell) Tag() Tag {
+	return Tag(c & tagMask)
+}
+
+// Addr returns the address held in a REF, STR or LIS cell
+func (c Cell) Addr() Addr {
+	return Addr(c >> tagBits)
+}
+
+// Int returns the value of an INT cell
+func (c Cell) Int() int64 {
+	return int64(c) >> tagBits
+}
+
+// Arity returns the arity of a FUN cell
+func (c Cell) Arity() int {
+	return int(c>>tagBits) & arityMask
+}
+
+// Atom returns the atom ID held in a CON cell
+func (c Cell) Atom() AtomID {
+	return AtomID(c >> tagBits)
+}
+
+// Functor returns the name and arity of a FUN cell
+func (c Cell) Functor() Functor {
+	return Functor{AtomID(c >> (tagBits + arityBits)), c.Arity()}
+}
+
+// numKind returns the kind of number held in a NUM cell
+func (c Cell) numKind() numKind {
+	return numKind(c>>tagBits) & numKindMask
+}
+
+// numIndex returns the index in the number table of a NUM cell
+func (c Cell) numIndex() int {
+	return int(c >> (tagBits + numKindBits))
+}
+
+// isVar reports whether c is an unbound variable, c must have been
+// dereferenced
+func (c Cell) isVar() bool {
+	return c.Tag() == REF
+}
+
+// isAtom reports whether c holds an atom
+func (c Cell) isAtom() bool {
+	return c.Tag() == CON
+}
+
+// isNumber reports whether c holds a number
+func (c Cell) isNumber() bool {
+	return c.Tag() == INT || c.Tag() == NUM
+}
+
+// isAtomic reports whether c holds an atom or a number
+func (c Cell) isAtomic() bool {
+	return c.isAtom() || c.isNumber()
+}
+
+// isCompound reports whether c refers to a structure or a list pair
+func (c Cell) isCompound() bool {
+	return c.Tag() == STR || c.Tag() == LIS
+}
+
+// isCallable reports whether c holds an atom or a compound term
+func (c Cell) isCallable() bool {
+	return c.isAtom() || c.isCompound()
+}
+
+// isInteger reports whether c holds an integer
+func (c Cell) isInteger() bool {
+	switch c.Tag() {
+	case INT:
+		return true
+	case NUM:
+		return c.numKind() == numInt
+	}
+	return false
+}
+
+// isFloat reports whether c holds a float
+func (c Cell) isFloat() bool {
+	return c.Tag() == NUM && c.numKind() == numFloat
+}
+
+func (c Cell) String() string {
+	switch c.Tag() {
+	case CON:
+		return fmt.Sprintf("%s %s", c.Tag(), c.Atom())
+	case INT:
+		return fmt.Sprintf("%s %d", c.Tag(), c.Int())
+	case NUM:
+		return fmt.Sprintf("%s %s %d", c.Tag(), c.numKind(), c.numIndex())
+	case FUN:
+		return fmt.Sprintf("%s %s", c.Tag(), c.Functor())
+	default:
+		return fmt.Sprintf("%s %s", c.Tag(), c.Addr())
+	}
+}
+
+func refCell(a Addr) Cell {
+	return Cell(a)<<tagBits | Cell(REF)
+}
+
+func strCell(a Addr) Cell {
+	return Cell(a)<<tagBits | Cell(STR)
+}
+
+func lisCell(a Addr) Cell {
+	return Cell(a)<<tagBits | Cell(LIS)
+}
+
+// atomCell returns the CON cell for the atom a
+func atomCell(a AtomID) Cell {
+	return Cell(a)<<tagBits | Cell(CON)
+}
+
+// intCell returns the INT cell for i, which must be between minInt
+// and maxInt
+func intCell(i int64) Cell {
+	return Cell(uint64(i)<<tagBits) | Cell(INT)
+}
+
+// funCell returns the FUN cell for the functor f
+func funCell(f Functor) Cell {
+	if f.Arity > arityMask {
+		panic(fmt.Errorf("arity of %s is too large", f))
+	}
+	return Cell(uint64(f.Name)<<arityBits|uint64(f.Arity))<<tagBits | Cell(FUN)
+}
+
+// numIndexCell returns the NUM cell for the number of kind k at index
+// i of the number table
+func numIndexCell(k numKind, i int) Cell {
+	return Cell(uint64(i)<<numKindBits|uint64(k))<<tagBits | Cell(NUM)
+}
+
+// fixedCell returns the cell for the constant c if it is an atom or
+// a small integer, whose cells do not depend on the machine.
+func fixedCell(c term.Term) (Cell, bool) {
+	switch c := c.(type) {
+	case term.Atom:
+		return atomCell(Intern(c)), true
+	case *term.Integer:
+		if i, ok := c.Int64(); ok && i >= minInt && i <= maxInt {
+			return intCell(i), true
+		}
+	}
+	return 0, false
+}
+
+// codeConst is a constant compiled into an instruction. The cells of
+// atoms and small integers are built when the instruction is
+// compiled, other numbers are interned by the machine that runs it.
+type codeConst struct {
+	fixed Cell
+	ok    bool
+	x     num
+}
+
+func newCodeConst(c term.Term) codeConst {
+	if cell, ok := fixedCell(c); ok {
+		return codeConst{fixed: cell, ok: true}
+	}
+	return codeConst{x: constNum(c)}
+}
+
+// cell returns the cell for the constant k in m
+func (k codeConst) cell(m *Machine) Cell {
+	if k.ok {
+		return k.fixed
+	}
+	return m.nums.cell(k.x)
+}
+
+// constCell returns the cell for the constant c, which must be an
+// atom or a number. Atoms and small integers are held directly in
+// their cells, larger numbers are interned in the number table, so
+// that equal constants always have equal cells.
+func (m *Machine) constCell(c term.Term) Cell {
+	if cell, ok := fixedCell(c); ok {
+		return cell
+	}
+	switch c.(type) {
+	case *term.Integer, term.Float, *term.Rational:
+		return m.numCell(constNum(c))
+	default:
+		panic(fmt.Errorf("%s is not a constant", c))
+	}
+}
+
+// constant returns the atom or number held in a CON, INT or NUM cell
+func (m *Machine) constant(c Cell) term.Term {
+	switch c.Tag() {
+	case CON:
+		return c.Atom().Name()
+	case INT:
+		return term.NewInteger(c.Int())
+	default:
+		return numTerm(m.nums.lookup(c))
+	}
+}
+
+// numTable holds the large integers, floats and rationals referred to
+// by the NUM cells of a machine. Numbers are interned, so that equal
+// numbers have equal cells. The table is emptied when a query starts,
+// and compacted by the garbage collector, so it only holds the
+// numbers that the machine's cells still refer to.
+type numTable struct {
+	nums  []num
+	index map[interface{}]int
+}
+
+// numKey returns the key of the number x in the index of the table,
+// floats are keyed by their bits, so that -0.0 and 0.0 are distinct.
+func numKey(x num) interface{} {
+	switch x := x.(type) {
+	case float64:
+		return math.Float64bits(x)
+	case *big.Int:
+		return x.String()
+	case *big.Rat:
+		return x.RatString()
+	default:
+		return x
+	}
+}
+
+// cell returns the NUM cell for the number x, adding it to the table
+// if it has not been seen before.
+func (t *numTable) cell(x num) Cell {
+	x = norm(x)
+	k := numInt
+	switch x.(type) {
+	case float64:
+		k = numFloat
+	case *big.Rat:
+		k = numRat
+	}
+
+	key := numKey(x)
+	if i, ok := t.index[key]; ok {
+		return numIndexCell(k, i)
+	}
+	if t.index == nil {
+		t.index = map[interface{}]int{}
+	}
+	i := len(t.nums)
+	t.nums = append(t.nums, x)
+	t.index[key] = i
+	return numIndexCell(k, i)
+}
+
+// lookup returns the number held in the NUM cell c
+func (t *numTable) lookup(c Cell) num {
+	return t.nums[c.numIndex()]
+}
+
+// reset empties the table
+func (t *numTable) reset() {
+	t.nums = nil
+	t.index = nil
+}
+
+// compact discards the numbers that are not marked as live, returning
+// the new index of each number that is kept.
+func (t *numTable) compact(live []bool) []int {
+	fwd := make([]int, len(t.nums))
+	n := 0
+	for i, x := range t.nums {
+		if !live[i] {
+			delete(t.index, numKey(x))
+			continue
+		}
+		fwd[i] = n
+		t.nums[n] = x
+		t.index[numKey(x)] = n
+		n++
+	}
+	for i := n; i < len(t.nums); i++ {
+		t.nums[i] = nil
+	}
+	t.nums = t.nums[:n]
+	return fwd
+}
+
+// Addr is an address in the machine's storage. The heap, the X
+// registers, and the stack holding permanent variables share a single
+// address space, the top bits of an address select the area.
+type Addr uint64
+
+const (
+	areaShift  = 56
+	offsetMask = 1<<areaShift - 1
+
+	heapArea  Addr = 0 << areaShift
+	regArea   Addr = 1 << areaShift
+	stackArea Addr = 2 << areaShift
+)
+
+func heapAddr(i int) Addr {
+	return heapArea | Addr(i)
+}
+
+func regAddr(i int) Addr {
+	return regArea | Addr(i)
+}
+
+func stackAddr(i int) Addr {
+	return stackArea | Addr(i)
+}
+
+func (a Addr) area() Addr {
+	return a &^ offsetMask
+}
+
+func (a Addr) offset() int {
+	return int(a & offsetMask)
+}
+
+func (a Addr) String() string {
+	switch a.area() {
+	case heapArea:
+		return fmt.Sprintf("%d", a.offset())
+	case regArea:
+		return fmt.Sprintf("X%d", a.offset())
+	default:
+		return fmt.Sprintf("S%d", a.offset())
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+func number(s string) term.Term {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic(fmt.Errorf("bad integer %s", s))
+	}
+	return term.NewBigInteger(i)
+}
+
+func TestCellConstants(t *testing.T) {
+	ctests := []struct {
+		c   term.Term
+		tag Tag
+		str string
+	}{
+		{term.Atom("foo"), CON, "CON foo"},
+		{term.Atom("[]"), CON, "CON []"},
+		{number("42"), INT, "INT 42"},
+		{number("-7"), INT, "INT -7"},
+		{number("1152921504606846975"), INT, "INT 1152921504606846975"},
+		{number("1152921504606846976"), NUM, "NUM int 0"},
+		{number("100000000000000000000"), NUM, "NUM int 1"},
+		{term.NewFloat(1), NUM, "NUM float 2"},
+		{term.NewFloat(1e+25), NUM, "NUM float 3"},
+		{term.NewRational(big.NewRat(1, 3)), NUM, "NUM rational 4"},
+	}
+
+	m := NewMachine()
+	for _, st := range ctests {
+		t.Run(st.str, func(t *testing.T) {
+			c := m.constCell(st.c)
+			if c.Tag() != st.tag {
+				t.Fatalf("expected tag %s, got %s", st.tag, c.Tag())
+			}
+			if c.String() != st.str {
+				t.Fatalf("expected %q, got %q", st.str, c.String())
+			}
+			if c != m.constCell(st.c) {
+				t.Fatalf("equal constants gave different cells")
+			}
+			if term.Format(m.constant(c)) != term.Format(st.c) {
+				t.Fatalf("expected %s, got %s", term.Format(st.c), term.Format(m.constant(c)))
+			}
+		})
+	}
+}
+
+func TestCellFunctors(t *testing.T) {
+	f := funCell(NewFunctor("foo", 3))
+	if f.Tag() != FUN {
+		t.Fatalf("expected FUN cell, got %s", f.Tag())
+	}
+	if f.Functor() != NewFunctor("foo", 3) {
+		t.Fatalf("expected foo/3, got %s", f.Functor())
+	}
+	if f == funCell(NewFunctor("foo", 2)) || f == funCell(NewFunctor("bar", 3)) {
+		t.Fatalf("different functors gave equal cells")
+	}
+	if f == atomCell(Intern("foo")) {
+		t.Fatalf("functor and atom gave equal cells")
+	}
+}
+
+func TestCellAddresses(t *testing.T) {
+	atests := []struct {
+		c   Cell
+		str string
+	}{
+		{refCell(heapAddr(12)), "REF 12"},
+		{strCell(heapAddr(3)), "STR 3"},
+		{lisCell(heapAddr(7)), "LIS 7"},
+		{refCell(regAddr(2)), "REF X2"},
+		{refCell(stackAddr(5)), "REF S5"},
+	}
+
+	for _, st := range atests {
+		if st.c.String() != st.str {
+			t.Errorf("expected %q, got %q", st.str, st.c.String())
+		}
+	}
+}
@@ -6,19 +6,30 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 
+	"github.com/tcolgate/golorp"
 	"github.com/tcolgate/golorp/context"
 	"github.com/tcolgate/golorp/parse"
 	"github.com/tcolgate/golorp/scan"
+	"github.com/tcolgate/golorp/term"
 )
 
 const qprompt = "?- "
 
+var (
+	maxHeap  = flag.Int("max-heap", 0, "maximum heap cells, 0 for no limit")
+	maxStack = flag.Int("max-stack", 0, "maximum stack frames, 0 for no limit")
+	maxTrail = flag.Int("max-trail", 0, "maximum trail entries, 0 for no limit")
+	gcHeap   = flag.Int("gc-threshold", 1<<20, "heap cells before garbage collection, 0 to disable")
+)
+
 func main() {
 	flag.Parse()
 
 	// Load databse file s from the command line
-
+	prog := []term.Term{}
 	for _, fn := range flag.Args() {
 		f, err := os.Open(fn)
 		if err != nil {
@@ -40,25 +51,77 @@ func main() {
 				os.Exit(1)
 			}
 
-			fmt.Printf("Got %v\n", t)
+			prog = append(prog, t)
 		}
 	}
 
+	m := golorp.NewMachine()
+	m.MaxHeap = *maxHeap
+	m.MaxStack = *maxStack
+	m.MaxTrail = *maxTrail
+	m.GCThreshold = *gcHeap
+	m.Load(golorp.CompileProgram(prog))
+
 	// Process queries
 	var ctx context.Context
 	s := scan.New(ctx, "stdin", bufio.NewReader(os.Stdin))
 	p := parse.New("stdin", s)
 	for {
-		fmt.Printf(qprompt)
+		fmt.Print(qprompt)
 		t0, err := p.NextTerm()
 		if err == io.EOF {
-			fmt.Println(os.Stderr, "got EOF\n", err)
+			fmt.Fprintln(os.Stderr, "got EOF", err)
 			break
 		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
 			break
 		}
-		fmt.Printf("Got %v\n", t0)
+
+		runQuery(m, t0)
+	}
+}
+
+// runQuery prints the bindings for each solution to the query t
+func runQuery(m *golorp.Machine, t term.Term) {
+	qcs, vars := golorp.CompileQuery(t)
+
+	names := []string{}
+	for v := range vars {
+		if !strings.HasPrefix(string(v), "_") {
+			names = append(names, string(v))
+		}
+	}
+	sort.Strings(names)
+
+	sols := m.Query(qcs)
+	defer sols.Close()
+
+	found := false
+	for sols.Next() {
+		found = true
+		bs, err := sols.Bindings(vars)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return
+		}
+		if len(names) == 0 {
+			break
+		}
+		ss := []string{}
+		for _, n := range names {
+			ss = append(ss, fmt.Sprintf("%s = %s", n, term.Format(bs[term.Variable(n)])))
+		}
+		fmt.Printf("%s ;\n", strings.Join(ss, ",\n"))
+	}
+	if err := sols.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return
+	}
+
+	if found {
+		fmt.Println("true.")
+	} else {
+		fmt.Println("false.")
 	}
 }
@@ -0,0 +1,342 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"sort"
+	"strings"
+)
+
+// Standard order of terms
+//
+// Terms on the heap are compared in the same order as term.Compare
+// compares decoded terms, other than variables, which are ordered by
+// their address, and so by age.
+
+// The classes of terms, in the standard order
+const (
+	classVar = iota
+	classNumber
+	classAtom
+	classCompound
+)
+
+func cellClass(c Cell) int {
+	switch c.Tag() {
+	case REF:
+		return classVar
+	case INT, NUM:
+		return classNumber
+	case CON:
+		return classAtom
+	default:
+		return classCompound
+	}
+}
+
+// compound returns the functor of the structure or list pair c, and
+// the address of its first argument
+func (m *Machine) compound(c Cell) (Functor, Addr) {
+	if c.Tag() == LIS {
+		return NewFunctor(".", 2), c.Addr()
+	}
+	return m.cell(c.Addr()).Functor(), c.Addr() + 1
+}
+
+// compare compares the terms at a and b in the standard order of
+// terms, returning -1, 0 or 1.
+func (m *Machine) compare(a, b Addr) int {
+	for {
+		a, b = m.deref(a), m.deref(b)
+		ca, cb := m.cell(a), m.cell(b)
+		if ca == cb {
+			// the same variable, an equal constant, or the same
+			// structure
+			return 0
+		}
+		if c := cellClass(ca) - cellClass(cb); c != 0 {
+			return sign3(c)
+		}
+
+		switch cellClass(ca) {
+		case classVar:
+			if a < b {
+				return -1
+			}
+			return 1
+		case classNumber:
+			if c := cmpNum(m.cellNum(ca), m.cellNum(cb)); c != 0 {
+				return c
+			}
+			// a float comes before an equal integer
+			if ca.isFloat() {
+				return -1
+			}
+			return 1
+		case classAtom:
+			return strings.Compare(ca.Atom().Name().Text(), cb.Atom().Name().Text())
+		}
+
+		fa, aargs := m.compound(ca)
+		fb, bargs := m.compound(cb)
+		if c := fa.Arity - fb.Arity; c != 0 {
+			return sign3(c)
+		}
+		if c := strings.Compare(fa.Name.Name().Text(), fb.Name.Name().Text()); c != 0 {
+			return c
+		}
+		for i := 0; i < fa.Arity-1; i++ {
+			if c := m.compare(aargs+Addr(i), bargs+Addr(i)); c != 0 {
+				return c
+			}
+		}
+		// compare the last arguments iteratively, so that long
+		// lists do not recurse deeply
+		a, b = aargs+Addr(fa.Arity-1), bargs+Addr(fb.Arity-1)
+	}
+}
+
+// sign3 returns -1, 0 or 1 depending on the sign of i
+func sign3(i int) int {
+	switch {
+	case i < 0:
+		return -1
+	case i > 0:
+		return 1
+	}
+	return 0
+}
+
+// orderAtoms are the atoms naming the result of compare/3
+var orderAtoms = []Cell{
+	atomCell(Intern("<")),
+	atomCell(Intern("=")),
+	atomCell(Intern(">")),
+}
+
+// compare3 implements compare(Order, A, B)
+func compare3(m *Machine) {
+	o := m.derefReg(0)
+	switch c := m.cell(o); c.Tag() {
+	case REF:
+	case CON:
+		if c != orderAtoms[0] && c != orderAtoms[1] && c != orderAtoms[2] {
+			m.throw(DomainError{"order", m.culprit(o)})
+			return
+		}
+	default:
+		m.throw(TypeError{"atom", m.culprit(o)})
+		return
+	}
+	m.setReg(X(1), orderAtoms[m.compare(m.regPtr(X(1)), m.regPtr(X(2)))+1])
+	m.unify(o, m.regPtr(X(1)))
+}
+
+// termCompare returns a builtin that compares the terms in A0 and A1,
+// it succeeds if test holds for the result of compare.
+func termCompare(test func(c int) bool) builtin {
+	return func(m *Machine) {
+		if !test(m.compare(m.regPtr(X(0)), m.regPtr(X(1)))) {
+			m.fail()
+		}
+	}
+}
+
+// variant returns a builtin that succeeds if the terms in A0 and A1
+// are, or are not if want is false, variants of each other.
+func variant(want bool) builtin {
+	return func(m *Machine) {
+		if m.isVariant(m.regPtr(X(0)), m.regPtr(X(1))) != want {
+			m.fail()
+		}
+	}
+}
+
+// isVariant reports whether the terms at a and b are equal, up to a
+// one to one renaming of their variables.
+func (m *Machine) isVariant(a, b Addr) bool {
+	ab, ba := map[Addr]Addr{}, map[Addr]Addr{}
+	visited := map[[2]Addr]bool{}
+	todo := []Addr{a, b}
+	for len(todo) > 0 {
+		a, b := m.deref(todo[len(todo)-2]), m.deref(todo[len(todo)-1])
+		todo = todo[:len(todo)-2]
+		ca, cb := m.cell(a), m.cell(b)
+		if ca.Tag() != cb.Tag() {
+			return false
+		}
+		switch ca.Tag() {
+		case REF:
+			if x, ok := ab[a]; ok && x != b {
+				return false
+			}
+			if y, ok := ba[b]; ok && y != a {
+				return false
+			}
+			ab[a], ba[b] = b, a
+		case LIS, STR:
+			// pairs of structures are only compared once, so that
+			// cyclic terms terminate
+			pair := [2]Addr{ca.Addr(), cb.Addr()}
+			if visited[pair] {
+				continue
+			}
+			visited[pair] = true
+			as, bs, n := ca.Addr(), cb.Addr(), 2
+			if ca.Tag() == STR {
+				if m.cell(ca.Addr()) != m.cell(cb.Addr()) {
+					return false
+				}
+				as, bs, n = ca.Addr()+1, cb.Addr()+1, m.cell(ca.Addr()).Arity()
+			}
+			for i := 0; i < n; i++ {
+				todo = append(todo, as+Addr(i), bs+Addr(i))
+			}
+		default:
+			if ca != cb {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sortList sorts the elements of the list in Ai by the standard order
+// of their keys, and unifies the sorted list with Aj. If dedup is set,
+// only the first of the elements with equal keys is kept.
+func (m *Machine) sortList(ai, aj int, key func(Addr) (Addr, bool), desc, dedup bool) {
+	es, err := m.list(m.regPtr(X(ai)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	ks := make([]Addr, len(es))
+	for i, e := range es {
+		k, ok := key(e)
+		if !ok {
+			return
+		}
+		ks[i] = k
+	}
+
+	idx := make([]int, len(es))
+	for i := range idx {
+		idx[i] = i
+	}
+	cmp := func(i, j int) int {
+		c := m.compare(ks[i], ks[j])
+		if desc {
+			return -c
+		}
+		return c
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return cmp(idx[i], idx[j]) < 0 })
+
+	cs := make([]Cell, 0, len(es))
+	for n, i := range idx {
+		if dedup && n > 0 && cmp(idx[n-1], i) == 0 {
+			continue
+		}
+		cs = append(cs, m.cell(m.deref(es[i])))
+	}
+	l, ok := m.newList(cs, atomCell(atomNil))
+	if !ok {
+		return
+	}
+	m.setReg(X(ai), l)
+	m.unify(m.regPtr(X(ai)), m.regPtr(X(aj)))
+}
+
+// sortKey returns a function finding the address of the key of an
+// element of a list being sorted, which is the element itself if n is
+// 0, and its nth argument otherwise. If the element has no such
+// argument an error is thrown, and the function returns false.
+func (m *Machine) sortKey(n int) func(Addr) (Addr, bool) {
+	if n == 0 {
+		return func(a Addr) (Addr, bool) { return a, true }
+	}
+	return func(a Addr) (Addr, bool) {
+		a = m.deref(a)
+		c := m.cell(a)
+		switch c.Tag() {
+		case REF:
+			m.throw(InstantiationError{})
+			return 0, false
+		case STR, LIS:
+			f, args := m.compound(c)
+			if f.Arity >= n {
+				return args + Addr(n-1), true
+			}
+		}
+		m.throw(TypeError{"compound", m.culprit(a)})
+		return 0, false
+	}
+}
+
+// msort2 implements msort(List, Sorted)
+func msort2(m *Machine) {
+	m.sortList(0, 1, m.sortKey(0), false, false)
+}
+
+// sort2 implements sort(List, Sorted), which removes duplicates
+func sort2(m *Machine) {
+	m.sortList(0, 1, m.sortKey(0), false, true)
+}
+
+// sort4 implements sort(Key, Order, List, Sorted)
+func sort4(m *Machine) {
+	k := m.derefReg(0)
+	kc := m.cell(k)
+	switch {
+	case kc.Tag() == REF:
+		m.throw(InstantiationError{})
+		return
+	case !kc.isInteger():
+		m.throw(TypeError{"integer", m.culprit(k)})
+		return
+	case numSign(m.cellNum(kc)) < 0:
+		m.throw(DomainError{"not_less_than_zero", m.culprit(k)})
+		return
+	}
+	// no compound has more arguments than fit in a FUN cell
+	n := arityMask + 1
+	if kc.Tag() == INT && kc.Int() < int64(n) {
+		n = int(kc.Int())
+	}
+
+	o := m.derefReg(1)
+	oc := m.cell(o)
+	if oc.Tag() == REF {
+		m.throw(InstantiationError{})
+		return
+	}
+	if oc.Tag() != CON {
+		m.throw(TypeError{"atom", m.culprit(o)})
+		return
+	}
+	var desc, dedup bool
+	switch oc.Atom().String() {
+	case "@<":
+		dedup = true
+	case "@=<":
+	case "@>":
+		desc, dedup = true, true
+	case "@>=":
+		desc = true
+	default:
+		m.throw(DomainError{"order", m.culprit(o)})
+		return
+	}
+	m.sortList(2, 3, m.sortKey(n), desc, dedup)
+}
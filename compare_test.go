@@ -0,0 +1,92 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+var comparetests = []atest{
+	{q: `compare(O, 1, 2).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, b, a).`, v: "O", exp: []string{">"}},
+	{q: `compare(O, f(X), f(X)).`, v: "O", exp: []string{"="}},
+	{q: `compare(=, a, a), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `compare(<, b, a), X = yes.`, v: "X", exp: []string{}},
+	{q: `compare(O, 1.0, 1).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, 2, 1.5).`, v: "O", exp: []string{">"}},
+	{q: `compare(O, 1r2, 0.6).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, 100000000000000000000, 1.0e10).`, v: "O", exp: []string{">"}},
+	{q: `compare(O, Y, 1).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, 1, a).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, a, f(a)).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, g(a), f(a, b)).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, g(a), f(b)).`, v: "O", exp: []string{">"}},
+	{q: `compare(O, f(a, c), f(b, a)).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, [1, 2, 3], [1, 2, 4]).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, [a], f(a, b)).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, [], a).`, v: "O", exp: []string{"<"}},
+	{q: `compare(O, 'b c', a).`, v: "O", exp: []string{">"}},
+	{q: `compare(O, 'a', a).`, v: "O", exp: []string{"="}},
+	{q: `compare(O, 'b c'(1), a(1)).`, v: "O", exp: []string{">"}},
+	{q: `compare(foo, a, b).`, v: "X", exp: []string{}, err: DomainError{"order", atom("foo")}},
+	{q: `catch(compare(f(O), a, b), error(type_error(T, f(V)), _), true), var(V).`, v: "T", exp: []string{"atom"}},
+	{q: `f(X, a) == f(X, a), Y = yes.`, v: "Y", exp: []string{"yes"}},
+	{q: `f(X, a) == f(Y, a), Z = yes.`, v: "Z", exp: []string{}},
+	{q: `X \== Y, Z = yes.`, v: "Z", exp: []string{"yes"}},
+	{q: `a @< b, b @> a, a @=< a, b @>= a, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `b @< a, X = yes.`, v: "X", exp: []string{}},
+	{q: `msort([c, 1, b, f(a), 1, Y, 2.0], [V|X]), V == Y.`, v: "X", exp: []string{"[1,1,2.0,b,c,f(a)]"}},
+	{q: `msort(['b c', a, 'Z', z], X).`, v: "X", exp: []string{"['Z',a,'b c',z]"}},
+	{q: `sort([c, a, b, a, c], X).`, v: "X", exp: []string{"[a,b,c]"}},
+	{q: `sort([], X).`, v: "X", exp: []string{"[]"}},
+	{q: `sort(0, @>=, [1, 3, 2, 3], X).`, v: "X", exp: []string{"[3,3,2,1]"}},
+	{q: `sort(0, @>, [1, 3, 2, 3], X).`, v: "X", exp: []string{"[3,2,1]"}},
+	{q: `sort(1, @<, [f(2, a), f(1, b), f(2, c)], X).`, v: "X", exp: []string{"[f(1,b),f(2,a)]"}},
+	{q: `sort(1, @=<, [f(2, a), f(1, b), f(2, c)], X).`, v: "X", exp: []string{"[f(1,b),f(2,a),f(2,c)]"}},
+	{q: `sort(2, @>=, [f(2, a), f(1, b), f(2, c)], X).`, v: "X", exp: []string{"[f(2,c),f(1,b),f(2,a)]"}},
+	{q: `sort([b, a], [a, b]), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `sort([a|_], X).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `sort([a|b], X).`, v: "X", exp: []string{}, err: TypeError{"list", term.NewCallable("cons", []term.Term{atom("a"), atom("b")})}},
+	{q: `sort(1, @<, [f(1), a], X).`, v: "X", exp: []string{}, err: TypeError{"compound", atom("a")}},
+	{q: `sort(0, foo, [], X).`, v: "X", exp: []string{}, err: DomainError{"order", atom("foo")}},
+	{q: `sort(-1, @<, [], X).`, v: "X", exp: []string{}, err: DomainError{"not_less_than_zero", numTerm(int64(-1))}},
+	{q: `predsort(bynum, [3, 1, 2, 1], X).`, v: "X", exp: []string{"[1,2,3]"}},
+	{q: `predsort(bysnd, [k(a, 2), k(b, 1), k(c, 3)], X).`, v: "X", exp: []string{"[k(b,1),k(a,2),k(c,3)]"}},
+	{q: `predsort(bynum, [], X).`, v: "X", exp: []string{"[]"}},
+	{q: `call(bynum, O, 1, 2).`, v: "O", exp: []string{"<"}},
+	{q: `call(bynum(O), 2, 1).`, v: "O", exp: []string{">"}},
+}
+
+func TestCompare(t *testing.T) {
+	for _, st := range comparetests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `
+X = X.
+bynum(O, A, B) :- compare(O, A, B).
+bysnd(O, k(_, A), k(_, B)) :- compare(O, A, B).
+`)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
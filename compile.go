@@ -2,153 +2,997 @@ package golorp
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/tcolgate/golorp/term"
 )
 
 type streamToken struct {
-	fn string // functor name
-	n  int    // arity of fn
-	vn string // variable name, for named vars
-	xi int    // The register to use
+	fn   string        // functor name
+	n    int           // arity of fn
+	vn   term.Variable // variable name, for variable arguments
+	con  term.Term     // atom or number, for constant arguments
+	list bool          // the structure is a list pair
+	xi   int           // The register to use, for structures
 }
 
-// Compile a single query, and a program
-func compileL1(q term.Term, ps []term.Term) CodeCells {
-	qcode := compileL1Query(q)
-	pcode := compileL1Program(ps)
+// CompileQuery compiles a query, ready to be run on a Machine
+// with Query. The returned map gives the register holding each of
+// the named variables of the query, for use with Bindings.
+func CompileQuery(t term.Term) (CodeCells, map[term.Variable]Reg) {
+	return compileL1Query(t)
+}
 
-	return CodeCells(append(qcode, pcode...))
+// CompileProgram compiles a set of program clauses, ready to be
+// installed in a Machine with Load.
+func CompileProgram(ts []term.Term) (CodeCells, map[Functor]int) {
+	return compileL1Program(ts)
 }
 
-// Compile a single query, and a program
-func compileL1Query(t term.Term) []CodeCell {
-	code := []CodeCell{}
+// Compile a single query. The query is compiled as the body of a
+// clause, with all of its named variables held in permanent registers
+// of an environment that is left in place when the query halts. The
+// returned map gives the register for each variable.
+func compileL1Query(t term.Term) (CodeCells, map[term.Variable]Reg) {
+	cc := newClauseCompiler()
+	cc.flattenGoal(cc.freshenAnon(t), "")
 
-	seen := map[int]bool{}
-	ts := make(chan streamToken)
-	go flattenq(ts, t)
+	cc.classifyVars(nil, true)
 
-	for ft := range ts {
-		switch {
-		case ft.fn != "":
-			inst, str := PutStructure(term.Atom(ft.fn), ft.n, ft.xi)
-			seen[ft.xi] = true
-			code = append(code, CodeCell{inst, str})
-		case ft.fn == "":
-			if _, ok := seen[ft.xi]; ok {
-				inst, str := SetValue(ft.xi)
-				code = append(code, CodeCell{inst, str})
-				continue
+	cc.emit(Allocate(cc.nperm))
+	cc.compileLevel()
+	cc.compileBody(true, false)
+	cc.emit(Halt())
+
+	vars := map[term.Variable]Reg{}
+	for v, r := range cc.regs {
+		if !isAnon(v) {
+			vars[v] = r
+		}
+	}
+
+	return cc.code, vars
+}
+
+// Compile a set of l1 program clauses, returning the code, and
+// the labels for the start of each predicate. The dynamic directives
+// of the program, and the clauses of its dynamic predicates, are
+// compiled into the body of the initialisation predicate, which is
+// run when the program is loaded. Other directives are ignored.
+func compileL1Program(ts []term.Term) (CodeCells, map[Functor]int) {
+	pt := newPredTable()
+
+	dynamic := map[Functor]bool{}
+	init := []term.Term{}
+	for _, t := range ts {
+		if spec, ok := dynamicDirective(t); ok {
+			for _, f := range specFunctors(spec) {
+				dynamic[f] = true
 			}
-			seen[ft.xi] = true
-			inst, str := SetVariable(ft.xi)
-			code = append(code, CodeCell{inst, str})
+			init = append(init, term.NewCallable("dynamic", []term.Term{spec}))
+		}
+	}
+
+	for _, t := range ts {
+		if isDirective(t) {
+			continue
+		}
+		if head, _ := clauseParts(t); dynamic[headFunctor(head)] {
+			init = append(init, term.NewCallable("assertz", []term.Term{t}))
+			continue
+		}
+		f, c := compileClause(t)
+		pt.add(f, c)
+	}
+
+	if len(init) > 0 {
+		body := init[len(init)-1]
+		for i := len(init) - 2; i >= 0; i-- {
+			body = term.NewCallable(",", []term.Term{init[i], body})
+		}
+		f, c := compileClause(term.NewCallable(":-", []term.Term{atom(string(initPred)), body}))
+		pt.add(f, c)
+	}
+
+	return pt.link(0)
+}
+
+// compileClause compiles a single fact or rule, returning the
+// predicate it belongs to.
+func compileClause(t term.Term) (Functor, *Clause) {
+	cc := newClauseCompiler()
+	head, body := clauseParts(cc.freshenAnon(t))
+	fn, n := head.Functor()
+	if body != nil {
+		cc.flattenGoal(body, "")
+	}
+
+	cc.classifyVars(head, false)
+
+	// Rules with more than one call need an environment to save the
+	// continuation of the clause across the calls in the body, as do
+	// rules with a type test after a call, and rules with permanent
+	// variables, such as a saved cut level. The last goal is called
+	// after the environment is discarded, so that tail recursion runs
+	// in constant stack.
+	calls, tested := 0, false
+	for _, s := range cc.steps {
+		switch {
+		case s.op == opCall:
+			calls++
+		case s.op == opTest && calls > 0:
+			tested = true
+		}
+	}
+	env := calls > 1 || tested || cc.nperm > 0
+	if env {
+		cc.emit(Allocate(cc.nperm))
+		cc.compileLevel()
+	}
+	cc.compileHead(head)
+	cc.compileBody(env, true)
+
+	return NewFunctor(term.Atom(fn), n), &Clause{
+		Code: cc.code,
+		key:  firstArgKey(head),
+	}
+}
+
+// firstArgKey returns the index key for the first argument of head
+func firstArgKey(head *term.Callable) argKey {
+	if len(head.Args()) == 0 {
+		return argKey{Type: keyVar}
+	}
+	at := head.Args()[0]
+	if c, ok := constant(at); ok {
+		return constArgKey(c)
+	}
+	switch t := at.(type) {
+	case *term.Callable:
+		if isList(t) {
+			return argKey{Type: keyList}
+		}
+		fn, n := t.Functor()
+		return argKey{Type: keyStr, Functor: NewFunctor(term.Atom(fn), n)}
+	default:
+		return argKey{Type: keyVar}
+	}
+}
+
+// constant returns the atom or number for t, if t is a constant. The
+// parser represents atoms as structures with no arguments, and the
+// empty list as cons/0, which is the atom [].
+func constant(t term.Term) (term.Term, bool) {
+	switch t := t.(type) {
+	case term.Atom:
+		return t, true
+	case *term.Integer, term.Float, *term.Rational:
+		return t, true
+	case *term.Callable:
+		fn, n := t.Functor()
+		switch {
+		case n != 0:
+			return nil, false
+		case fn == "cons":
+			return term.Atom("[]"), true
 		default:
-			panic("unknown term m0 type")
+			return term.Atom(fn), true
 		}
+	default:
+		return nil, false
 	}
+}
 
-	return code
+// isList reports whether t is a list pair, cons/2
+func isList(t term.Term) bool {
+	c, ok := t.(*term.Callable)
+	if !ok {
+		return false
+	}
+	fn, n := c.Functor()
+	return fn == "cons" && n == 2
 }
 
-// Compile a single l0 program term
-func compileL1Program(ts []term.Term) []CodeCell {
-	code := []CodeCell{}
-	labels := map[string]int{}
+// isDirective reports whether t is a :- directive, rather than a clause
+func isDirective(t term.Term) bool {
+	c, ok := t.(*term.Callable)
+	if !ok {
+		return false
+	}
+	fn, n := c.Functor()
+	return fn == ":-" && n == 1
+}
 
-	for _, t := range ts {
-		labels[t.String()] = len(code)
+// dynamicDirective returns the predicate indicators of t, if t is a
+// dynamic directive
+func dynamicDirective(t term.Term) (term.Term, bool) {
+	if !isDirective(t) {
+		return nil, false
+	}
+	d, ok := t.(*term.Callable).Args()[0].(*term.Callable)
+	if !ok {
+		return nil, false
+	}
+	if fn, n := d.Functor(); fn != "dynamic" || n != 1 {
+		return nil, false
+	}
+	return d.Args()[0], true
+}
+
+// specFunctors returns the predicates named by the predicate
+// indicators in spec, a sequence or list of Name/Arity terms.
+// Malformed indicators are skipped, they are reported when the
+// directive is run.
+func specFunctors(spec term.Term) []Functor {
+	c, ok := spec.(*term.Callable)
+	if !ok {
+		return nil
+	}
+	fn, args := callable(c)
+	switch {
+	case (fn == "," || isList(c)) && len(args) == 2:
+		return append(specFunctors(args[0]), specFunctors(args[1])...)
+	case fn != "/" || len(args) != 2:
+		return nil
+	}
+	name, ok := constant(args[0])
+	if !ok {
+		return nil
+	}
+	n, ok := args[1].(*term.Integer)
+	if !ok {
+		return nil
+	}
+	arity, ok := n.Int64()
+	if _, isAtom := name.(term.Atom); !ok || !isAtom || arity < 0 || arity > arityMask {
+		return nil
+	}
+	return []Functor{NewFunctor(name.(term.Atom), int(arity))}
+}
+
+// headFunctor returns the predicate that a clause with the given
+// head belongs to
+func headFunctor(head *term.Callable) Functor {
+	fn, n := head.Functor()
+	return NewFunctor(term.Atom(fn), n)
+}
+
+// clauseParts splits a clause into its head, and its body, which is
+// nil for a fact
+func clauseParts(t term.Term) (*term.Callable, term.Term) {
+	c, ok := t.(*term.Callable)
+	if !ok {
+		panic(fmt.Errorf("clause must be callable, got %s", t))
+	}
+	if fn, n := c.Functor(); fn != ":-" || n != 2 {
+		return c, nil
+	}
+
+	head, ok := c.Args()[0].(*term.Callable)
+	if !ok {
+		panic(fmt.Errorf("clause head must be callable, got %s", c.Args()[0]))
+	}
+	return head, c.Args()[1]
+}
+
+// levelVar is the permanent variable that holds the cut level of a
+// clause with a deep cut
+const levelVar = term.Variable("_#level")
+
+// stepOp is an operation of a flattened clause body
+type stepOp int
+
+const (
+	opCall    stepOp = iota // call goal
+	opTest                  // run the inline type test goal
+	opCut                   // cut to the level in v, or B0 if v is empty
+	opMark                  // save the current choice point in v
+	opSoftCut               // soft cut to the choice point in v, failing at l
+	opTry                   // create a choice point whose alternative is l
+	opTrust                 // discard the current choice point
+	opJump                  // jump to l
+	opLabel                 // the position of label l
+	opFail                  // backtrack
+)
+
+// step is a single operation of a flattened clause body
+type step struct {
+	op    stepOp
+	goal  term.Term       // the goal of opCall or opTest
+	v     term.Variable   // the variable holding a cut level
+	l     int             // the label used by the operation
+	vars  []term.Variable // the variables of the construct an opTry begins
+	chunk int             // the chunk the step belongs to
+}
+
+// flattenGoal appends the steps for the goal t to the body of the
+// clause. Conjunctions are flattened, and the control constructs are
+// expanded into choice point operations. Cuts in t cut to the level
+// held in cut, or to the clause's level if cut is empty. A variable
+// goal G is called as call(G), other goals that are not callable
+// throw a type error when they are reached.
+func (cc *clauseCompiler) flattenGoal(t term.Term, cut term.Variable) {
+	c, ok := t.(*term.Callable)
+	if !ok {
+		if _, ok := t.(term.Variable); ok {
+			t = term.NewCallable("call", []term.Term{t})
+		} else {
+			ball := cc.freshenAnon(errorBall(TypeError{"callable", t}))
+			t = term.NewCallable("throw", []term.Term{ball})
+		}
+		cc.steps = append(cc.steps, step{op: opCall, goal: t})
+		return
+	}
+	fn, n := c.Functor()
+	args := c.Args()
+	switch {
+	case fn == "," && n == 2:
+		cc.flattenGoal(args[0], cut)
+		cc.flattenGoal(args[1], cut)
+	case fn == "!" && n == 0:
+		cc.steps = append(cc.steps, step{op: opCut, v: cut})
+	case fn == "true" && n == 0:
+	case (fn == "fail" || fn == "false") && n == 0:
+		cc.steps = append(cc.steps, step{op: opFail})
+	case fn == ";" && n == 2:
+		if c, ok := args[0].(*term.Callable); ok {
+			switch fn, n := c.Functor(); {
+			case fn == "->" && n == 2:
+				cc.flattenIf(t, c.Args()[0], c.Args()[1], args[1], cut, false)
+				return
+			case fn == "*->" && n == 2:
+				cc.flattenIf(t, c.Args()[0], c.Args()[1], args[1], cut, true)
+				return
+			}
+		}
+		cc.flattenOr(t, args[0], args[1], cut)
+	case fn == "->" && n == 2:
+		cc.flattenIf(t, args[0], args[1], term.NewCallable("fail", nil), cut, false)
+	case fn == "*->" && n == 2:
+		cc.flattenIf(t, args[0], args[1], term.NewCallable("fail", nil), cut, true)
+	case fn == "\\+" && n == 1:
+		cc.flattenNot(t, args[0])
+	case isTypeTest(fn, n):
+		cc.steps = append(cc.steps, step{op: opTest, goal: t})
+	default:
+		cc.steps = append(cc.steps, step{op: opCall, goal: t})
+	}
+}
+
+// flattenOr expands the disjunction t, (a ; b)
+func (cc *clauseCompiler) flattenOr(t, a, b term.Term, cut term.Variable) {
+	alt, end := cc.newLabel(), cc.newLabel()
+	cc.steps = append(cc.steps, step{op: opTry, l: alt, vars: goalVars(t)})
+	cc.flattenGoal(a, cut)
+	cc.steps = append(cc.steps,
+		step{op: opJump, l: end},
+		step{op: opLabel, l: alt},
+		step{op: opTrust})
+	cc.flattenGoal(b, cut)
+	cc.steps = append(cc.steps, step{op: opLabel, l: end})
+}
+
+// flattenIf expands the if-then-else t, (c -> then ; els), or the
+// soft-cut (c *-> then ; els). A cut in the condition is local to it.
+func (cc *clauseCompiler) flattenIf(t, c, then, els term.Term, cut term.Variable, soft bool) {
+	level := cc.newChoiceVar()
+	alt, end := cc.newLabel(), cc.newLabel()
+	cc.steps = append(cc.steps,
+		step{op: opMark, v: level},
+		step{op: opTry, l: alt, vars: goalVars(t)})
+	cc.flattenLocal(c)
+	if !soft {
+		cc.steps = append(cc.steps, step{op: opCut, v: level})
+		cc.flattenGoal(then, cut)
+		cc.steps = append(cc.steps, step{op: opJump, l: end})
+	} else {
+		fail := cc.newLabel()
+		cc.steps = append(cc.steps, step{op: opSoftCut, v: level, l: fail})
+		cc.flattenGoal(then, cut)
+		cc.steps = append(cc.steps,
+			step{op: opJump, l: end},
+			step{op: opLabel, l: fail},
+			step{op: opTrust},
+			step{op: opFail})
+	}
+	cc.steps = append(cc.steps,
+		step{op: opLabel, l: alt},
+		step{op: opTrust})
+	cc.flattenGoal(els, cut)
+	cc.steps = append(cc.steps, step{op: opLabel, l: end})
+}
+
+// flattenNot expands the negation t, \+ g
+func (cc *clauseCompiler) flattenNot(t, g term.Term) {
+	level := cc.newChoiceVar()
+	alt := cc.newLabel()
+	cc.steps = append(cc.steps,
+		step{op: opMark, v: level},
+		step{op: opTry, l: alt, vars: goalVars(t)})
+	cc.flattenLocal(g)
+	cc.steps = append(cc.steps,
+		step{op: opCut, v: level},
+		step{op: opFail},
+		step{op: opLabel, l: alt},
+		step{op: opTrust})
+}
+
+// flattenLocal expands the goal g, which has just created a choice
+// point. Cuts in g only discard the choice points created by g.
+func (cc *clauseCompiler) flattenLocal(g term.Term) {
+	if !hasCut(g) {
+		cc.flattenGoal(g, "")
+		return
+	}
+	level := cc.newChoiceVar()
+	cc.steps = append(cc.steps, step{op: opMark, v: level})
+	cc.flattenGoal(g, level)
+}
+
+// hasCut reports whether the goal t contains a cut that is not local
+// to a construct within it
+func hasCut(t term.Term) bool {
+	c, ok := t.(*term.Callable)
+	if !ok {
+		return false
+	}
+	fn, n := c.Functor()
+	switch {
+	case fn == "!" && n == 0:
+		return true
+	case (fn == "," || fn == ";") && n == 2:
+		return hasCut(c.Args()[0]) || hasCut(c.Args()[1])
+	case (fn == "->" || fn == "*->") && n == 2:
+		// a cut in the condition is local to it
+		return hasCut(c.Args()[1])
+	default:
+		return false
+	}
+}
+
+// goalVars returns the distinct variables of t, in order
+func goalVars(t term.Term) []term.Variable {
+	vs := []term.Variable{}
+	seen := map[term.Variable]bool{}
+	termVars(t, func(v term.Variable) {
+		if !seen[v] {
+			seen[v] = true
+			vs = append(vs, v)
+		}
+	})
+	return vs
+}
+
+func (cc *clauseCompiler) newLabel() int {
+	cc.labels++
+	return cc.labels
+}
+
+// newChoiceVar returns a fresh variable to hold a choice point
+func (cc *clauseCompiler) newChoiceVar() term.Variable {
+	cc.choices++
+	return term.Variable(fmt.Sprintf("_#choice%d", cc.choices))
+}
+
+// clauseCompiler holds the state for compiling a single clause
+type clauseCompiler struct {
+	code CodeCells
+
+	regs  map[term.Variable]Reg  // The register allocated to each variable
+	seen  map[term.Variable]bool // Variables that have been initialised
+	nperm int                    // The number of permanent variables
+	last  map[term.Variable]int  // The last chunk each variable occurs in
+	steps []step                 // The flattened body of the clause
+	temps int                    // The first register free for structures
+
+	anon    int // count of anonymous variables renamed
+	labels  int // count of labels used in the body
+	choices int // count of variables holding choice points
+}
+
+func newClauseCompiler() *clauseCompiler {
+	return &clauseCompiler{
+		regs: map[term.Variable]Reg{},
+		seen: map[term.Variable]bool{},
+		last: map[term.Variable]int{},
+	}
+}
+
+func (cc *clauseCompiler) emit(fn machineFunc, str string) {
+	cc.code = append(cc.code, CodeCell{fn, str})
+}
+
+// isAnon reports whether v is a renamed anonymous variable
+func isAnon(v term.Variable) bool {
+	return len(v) > 1 && v[:2] == "_#"
+}
+
+// freshenAnon gives each occurrence of the anonymous variable _
+// a distinct name, so that they are not unified with each other.
+func (cc *clauseCompiler) freshenAnon(t term.Term) term.Term {
+	switch t := t.(type) {
+	case term.Variable:
+		if t != "_" {
+			return t
+		}
+		cc.anon++
+		return term.Variable(fmt.Sprintf("_#%d", cc.anon))
+	case *term.Callable:
+		fn, _ := t.Functor()
+		args := make([]term.Term, len(t.Args()))
+		for i, at := range t.Args() {
+			args[i] = cc.freshenAnon(at)
+		}
+		return term.NewCallable(fn, args)
+	default:
+		return t
+	}
+}
 
-		seen := map[int]bool{}
-		ts := make(chan streamToken)
-		go flattenp(ts, t)
+// termVars calls f for each variable occurrence in t, in order
+func termVars(t term.Term, f func(term.Variable)) {
+	term.WalkDepthFirst(func(t term.Term) {
+		if v, ok := t.(term.Variable); ok {
+			f(v)
+		}
+	}, nil, t)
+}
 
-		for ft := range ts {
+// classifyVars allocates registers to the variables of a clause,
+// and assigns each step of the body to a chunk. A chunk is a run of
+// steps ending in a call, the head belongs to the first chunk. The
+// control constructs also start a new chunk wherever a choice point is
+// created or resumed, as the temporary registers are not saved in
+// choice points.
+//
+// A variable is permanent if it occurs in more than one chunk of the
+// clause. In a query all named variables are permanent, and live
+// until the query halts. Temporary variables are allocated
+// registers above all argument registers.
+//
+// Permanent variables are numbered so that those used by later goals
+// come first, the environment can then be trimmed as the body is run
+// by discarding the highest numbered variables.
+func (cc *clauseCompiler) classifyVars(head *term.Callable, query bool) {
+	order := []term.Variable{}
+	inChunks := map[term.Variable]int{}
+	lastChunk := map[term.Variable]int{}
+	maxArity := 0
+	chunk := 0
+	note := func(v term.Variable) {
+		last, ok := lastChunk[v]
+		switch {
+		case !ok:
+			order = append(order, v)
+			inChunks[v] = 1
+		case last != chunk:
+			inChunks[v]++
+		}
+		lastChunk[v] = chunk
+	}
+	goal := func(t term.Term) {
+		if c, ok := t.(*term.Callable); ok {
+			if _, n := c.Functor(); n > maxArity {
+				maxArity = n
+			}
+		}
+		termVars(t, note)
+	}
+
+	if head != nil {
+		goal(head)
+	}
+	// A cut after a call needs the cut level saved on entry, until the
+	// last such cut. Cuts before the first call can use the cut level
+	// from B0 directly.
+	called := false
+	deep := -1
+	for i := range cc.steps {
+		s := &cc.steps[i]
+		s.chunk = chunk
+		switch s.op {
+		case opCall:
+			goal(s.goal)
+			called = true
+			chunk++
+		case opTest:
+			goal(s.goal)
+		case opCut:
 			switch {
-			case ft.fn != "":
-				inst, str := GetStructure(term.Atom(ft.fn), ft.n, ft.xi)
-				seen[ft.xi] = true
-				code = append(code, CodeCell{inst, str})
-			case ft.fn == "":
-				if _, ok := seen[ft.xi]; ok {
-					inst, str := UnifyValue(ft.xi)
-					code = append(code, CodeCell{inst, str})
-					continue
+			case s.v != "":
+				note(s.v)
+			case called:
+				s.v = levelVar
+				deep = chunk
+			}
+		case opMark, opSoftCut:
+			note(s.v)
+		case opTry, opTrust, opLabel:
+			chunk++
+		}
+	}
+	if deep != -1 {
+		order = append(order, levelVar)
+		inChunks[levelVar] = 2
+		lastChunk[levelVar] = deep
+	}
+
+	perms := []term.Variable{}
+	ntemp := 0
+	for _, v := range order {
+		if query && !isAnon(v) {
+			lastChunk[v] = chunk
+			perms = append(perms, v)
+			continue
+		}
+		if inChunks[v] > 1 {
+			perms = append(perms, v)
+			continue
+		}
+		cc.regs[v] = X(maxArity + ntemp)
+		ntemp++
+	}
+	cc.temps = maxArity + ntemp
+
+	sort.SliceStable(perms, func(i, j int) bool {
+		return lastChunk[perms[i]] > lastChunk[perms[j]]
+	})
+	for _, v := range perms {
+		cc.regs[v] = Y(cc.nperm)
+		cc.last[v] = lastChunk[v]
+		cc.nperm++
+	}
+}
+
+// compileHead emits the code to unify the arguments of the clause
+// head with the argument registers.
+func (cc *clauseCompiler) compileHead(head *term.Callable) {
+	for ai, at := range head.Args() {
+		if c, ok := constant(at); ok {
+			cc.emit(GetConstant(c, ai))
+			continue
+		}
+		switch t := at.(type) {
+		case term.Variable:
+			if cc.seen[t] {
+				cc.emit(GetValue(cc.regs[t], ai))
+				continue
+			}
+			cc.seen[t] = true
+			cc.emit(GetVariable(cc.regs[t], ai))
+		case *term.Callable:
+			ts := make(chan streamToken)
+			ctx := newTokeningCtx(ts, cc.temps)
+			ctx.setReg(t, ai)
+			go flattenp(ctx, t)
+
+			for ft := range ts {
+				switch {
+				case ft.list:
+					cc.emit(GetList(ft.xi))
+				case ft.fn != "":
+					cc.emit(GetStructure(term.Atom(ft.fn), ft.n, ft.xi))
+				case ft.vn != "":
+					if cc.seen[ft.vn] {
+						cc.emit(UnifyValue(cc.regs[ft.vn]))
+						continue
+					}
+					cc.seen[ft.vn] = true
+					cc.emit(UnifyVariable(cc.regs[ft.vn]))
+				case ft.con != nil:
+					cc.emit(UnifyConstant(ft.con))
+				default:
+					cc.emit(UnifyVariable(X(ft.xi)))
 				}
-				seen[ft.xi] = true
-				inst, str := UnifyVariable(ft.xi)
-				code = append(code, CodeCell{inst, str})
+			}
+		default:
+			panic(fmt.Errorf("unsupported head argument %s", at))
+		}
+	}
+}
+
+// compileLevel saves the cut level for a deep cut, if there is one
+func (cc *clauseCompiler) compileLevel() {
+	if r, ok := cc.regs[levelVar]; ok {
+		cc.emit(GetLevel(r))
+	}
+}
+
+// compileBody emits the code for the steps of the body. If tail is
+// set, the body ends the clause: goals that leave the clause are
+// called as last calls, and the environment, if there is one, is
+// discarded before the clause returns.
+func (cc *clauseCompiler) compileBody(env, tail bool) {
+	steps := cc.steps
+	at := map[int]int{}       // the step of each label
+	labels := map[int]int{}   // the code offset of each label
+	reached := map[int]bool{} // labels that control is passed to
+	fixups := map[int]step{}  // instructions waiting for the offset of a label
+	for i, s := range steps {
+		if s.op == opLabel {
+			at[s.l] = i
+		}
+	}
+
+	// ends reports whether the clause ends once the steps from i on
+	// have been run, without any more code being run
+	ends := func(i int) bool {
+		for i < len(steps) {
+			switch steps[i].op {
+			case opLabel:
+				i++
+			case opJump:
+				i = at[steps[i].l]
 			default:
-				panic("unknown term m0 type")
+				return false
 			}
 		}
+		return true
+	}
+	leave := func() {
+		if env {
+			cc.emit(Deallocate())
+		}
+		cc.emit(Proceeed())
 	}
 
-	fmt.Printf("LABELS: %v\n", labels)
-	return code
+	// done is set once control has left the code being emitted, the
+	// code that follows is only run if a label is reached
+	done := false
+	for i, s := range steps {
+		if s.op == opLabel {
+			labels[s.l] = len(cc.code)
+			done = done && !reached[s.l]
+			continue
+		}
+		if done {
+			continue
+		}
+		switch s.op {
+		case opCall:
+			if tail && ends(i+1) {
+				cc.compileLastGoal(s.goal, env)
+				done = true
+				continue
+			}
+			cc.compileGoal(s.goal, cc.live(s.chunk))
+		case opTest:
+			cc.compileTest(s.goal)
+			if tail && ends(i+1) {
+				leave()
+				done = true
+			}
+		case opCut:
+			if s.v == "" {
+				cc.emit(NeckCut())
+			} else {
+				cc.emit(Cut(cc.regs[s.v]))
+			}
+			if tail && ends(i+1) {
+				leave()
+				done = true
+			}
+		case opMark:
+			cc.emit(GetChoice(cc.regs[s.v]))
+		case opSoftCut:
+			fixups[len(cc.code)] = s
+			cc.emit(nil, "")
+			reached[s.l] = true
+		case opTry:
+			// Variables first used within the construct are created
+			// before the choice point, so that every branch finds
+			// them initialised.
+			for _, v := range s.vars {
+				if r := cc.regs[v]; r.Type == YReg && !cc.seen[v] {
+					cc.seen[v] = true
+					cc.emit(SetVariable(r))
+				}
+			}
+			fixups[len(cc.code)] = s
+			cc.emit(nil, "")
+			reached[s.l] = true
+		case opTrust:
+			cc.emit(TrustMe())
+		case opJump:
+			if tail && ends(i) {
+				leave()
+			} else {
+				fixups[len(cc.code)] = s
+				cc.emit(nil, "")
+				reached[s.l] = true
+			}
+			done = true
+		case opFail:
+			cc.emit(Fail())
+			done = true
+		}
+	}
+	if tail && !done {
+		leave()
+	}
+
+	for pc, s := range fixups {
+		off := labels[s.l] - pc
+		var fn machineFunc
+		var str string
+		switch s.op {
+		case opTry:
+			fn, str = TryElse(off)
+		case opSoftCut:
+			fn, str = SoftCut(cc.regs[s.v], off)
+		default:
+			fn, str = Jump(off)
+		}
+		cc.code[pc] = CodeCell{fn, str}
+	}
+}
+
+// live returns the number of permanent variables that are still
+// needed after the call ending chunk c.
+func (cc *clauseCompiler) live(c int) int {
+	n := 0
+	for _, l := range cc.last {
+		if l > c {
+			n++
+		}
+	}
+	return n
+}
+
+// compileGoal emits the code to call the goal, k permanent variables
+// are still needed once the call returns.
+func (cc *clauseCompiler) compileGoal(g term.Term, k int) {
+	fn, n := cc.putArgs(g)
+	cc.emit(Call(term.Atom(fn), n, k))
 }
 
+// compileTest emits the code for the inline type test g. A variable
+// that has already been initialised is tested in its own register,
+// other arguments are first loaded into A0.
+func (cc *clauseCompiler) compileTest(g term.Term) {
+	c := g.(*term.Callable)
+	fn, _ := c.Functor()
+	if v, ok := c.Args()[0].(term.Variable); ok && cc.seen[v] {
+		cc.emit(TypeTest(term.Atom(fn), cc.regs[v]))
+		return
+	}
+	cc.putArgs(g)
+	cc.emit(TypeTest(term.Atom(fn), X(0)))
+}
+
+// compileLastGoal emits the code to call the last goal of a rule.
+// The environment, if there is one, is discarded before control is
+// passed to the goal, which returns directly to the rule's caller.
+func (cc *clauseCompiler) compileLastGoal(g term.Term, env bool) {
+	fn, n := cc.putArgs(g)
+	if env {
+		cc.emit(Deallocate())
+	}
+	cc.emit(Execute(term.Atom(fn), n))
+}
+
+// putArgs emits the code to load the argument registers for the
+// goal, returning its functor.
+func (cc *clauseCompiler) putArgs(g term.Term) (string, int) {
+	c, ok := g.(*term.Callable)
+	if !ok {
+		panic(fmt.Errorf("goal must be callable, got %s", g))
+	}
+
+	for ai, at := range c.Args() {
+		if c, ok := constant(at); ok {
+			cc.emit(PutConstant(c, ai))
+			continue
+		}
+		switch t := at.(type) {
+		case term.Variable:
+			if cc.seen[t] {
+				cc.emit(PutValue(cc.regs[t], ai))
+				continue
+			}
+			cc.seen[t] = true
+			cc.emit(PutVariable(cc.regs[t], ai))
+		case *term.Callable:
+			ts := make(chan streamToken)
+			ctx := newTokeningCtx(ts, cc.temps)
+			ctx.setReg(t, ai)
+			go flattenq(ctx, t)
+
+			for ft := range ts {
+				switch {
+				case ft.list:
+					cc.emit(PutList(ft.xi))
+				case ft.fn != "":
+					cc.emit(PutStructure(term.Atom(ft.fn), ft.n, ft.xi))
+				case ft.vn != "":
+					if cc.seen[ft.vn] {
+						cc.emit(SetValue(cc.regs[ft.vn]))
+						continue
+					}
+					cc.seen[ft.vn] = true
+					cc.emit(SetVariable(cc.regs[ft.vn]))
+				case ft.con != nil:
+					cc.emit(SetConstant(ft.con))
+				default:
+					cc.emit(SetValue(X(ft.xi)))
+				}
+			}
+		default:
+			panic(fmt.Errorf("unsupported goal argument %s", at))
+		}
+	}
+
+	return c.Functor()
+}
+
+// tokeningCtx assigns registers to the sub-structures of a term,
+// and streams the term as a series of tokens
 type tokeningCtx struct {
 	regs    map[int]term.Term
 	invregs map[term.Term]int
-	vars    map[term.Variable]int
+	next    int // The next free register
 	ts      chan<- streamToken
 }
 
-func newTokeningCtx(ts chan<- streamToken) *tokeningCtx {
+func newTokeningCtx(ts chan<- streamToken, next int) *tokeningCtx {
 	return &tokeningCtx{
 		regs:    map[int]term.Term{},
 		invregs: map[term.Term]int{},
-		vars:    map[term.Variable]int{},
+		next:    next,
 		ts:      ts,
 	}
 }
 
 func (ctx *tokeningCtx) assignReg(t term.Term) int {
-	next := len(ctx.regs)
-	ctx.regs[next] = t
-	ctx.invregs[t] = next
+	next := ctx.next
+	ctx.next++
+	ctx.setReg(t, next)
 
 	return next
 }
 
-func flattenq(ts chan<- streamToken, t term.Term) {
-	defer close(ts)
+// setReg assigns the specific register xi to t
+func (ctx *tokeningCtx) setReg(t term.Term, xi int) {
+	ctx.regs[xi] = t
+	ctx.invregs[t] = xi
+}
 
-	ctx := newTokeningCtx(ts)
+// flattenq streams t so that sub-structures are built before
+// the structures that contain them. The register for t itself must
+// have already been assigned.
+func flattenq(ctx *tokeningCtx, t term.Term) {
+	defer close(ctx.ts)
 
-	ctx.assignReg(t)
 	term.WalkDepthFirst(ctx.assign, ctx.tokenize, t)
 }
 
-func flattenp(ts chan<- streamToken, t term.Term) {
-	defer close(ts)
-
-	ctx := newTokeningCtx(ts)
+// flattenp streams t so that structures are matched before the
+// sub-structures they contain. The register for t itself must have
+// already been assigned.
+func flattenp(ctx *tokeningCtx, t term.Term) {
+	defer close(ctx.ts)
 
-	ctx.assignReg(t)
 	term.WalkDepthFirst(ctx.assign, nil, t)
 
 	term.WalkDepthFirst(ctx.tokenize, nil, t)
 }
 
 func (ctx *tokeningCtx) assign(p term.Term) {
+	if _, ok := constant(p); ok {
+		return
+	}
 	switch t := p.(type) {
 	case *term.Callable:
 		for _, at := range t.Args() {
-			switch t := at.(type) {
+			if _, ok := constant(at); ok {
+				continue
+			}
+			switch at.(type) {
 			case term.Variable:
-				if xi, ok := ctx.vars[t]; !ok {
-					xi := ctx.assignReg(at)
-					ctx.vars[t] = xi
-					continue
-				} else {
-					ctx.invregs[at] = xi
-				}
 			case *term.Callable:
 				ctx.assignReg(at)
 			default:
+				panic(fmt.Errorf("unsupported term %s", at))
 			}
 		}
 	case term.Variable:
@@ -158,19 +1002,41 @@ func (ctx *tokeningCtx) assign(p term.Term) {
 }
 
 func (ctx *tokeningCtx) tokenize(p term.Term) {
-	xi, ok := ctx.invregs[p]
-	if !ok {
-		panic("unknown term")
+	if _, ok := constant(p); ok {
+		return
 	}
 	switch t := p.(type) {
 	case *term.Callable:
+		xi, ok := ctx.invregs[p]
+		if !ok {
+			panic("unknown term")
+		}
 		fn, argc := t.Functor()
-		ctx.ts <- streamToken{
-			fn: fn,
-			n:  argc,
-			xi: xi,
+		if isList(t) {
+			ctx.ts <- streamToken{
+				list: true,
+				xi:   xi,
+			}
+		} else {
+			ctx.ts <- streamToken{
+				fn: fn,
+				n:  argc,
+				xi: xi,
+			}
 		}
 		for _, at := range t.Args() {
+			if c, ok := constant(at); ok {
+				ctx.ts <- streamToken{
+					con: c,
+				}
+				continue
+			}
+			if v, ok := at.(term.Variable); ok {
+				ctx.ts <- streamToken{
+					vn: v,
+				}
+				continue
+			}
 			xi, ok := ctx.invregs[at]
 			if !ok {
 				panic("unknown term")
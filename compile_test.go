@@ -15,6 +15,7 @@ package golorp
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 
 	"github.com/tcolgate/golorp/context"
@@ -27,38 +28,316 @@ type testL0 struct {
 	name string
 	q    string
 	p    string
-	res  string
+	qres string
+	pres string
 }
 
 var testsL0 = []testL0{
 	{"query0",
 		`p(Z,h(Z,W),f(W)).`,
 		`p(f(X),h(Y,f(a)),Y).`,
-		`put_structure (atom h)/2 X2
-set_variable X1
+		`allocate 2
+put_variable Y0, A0
+put_structure (atom h)/2 X1
+set_value Y0
+set_variable Y1
+put_structure (atom f)/1 X2
+set_value Y1
+call (atom p)/3, 2
+halt
+`,
+		`get_structure (atom f)/1 X0
+unify_variable X3
+get_structure (atom h)/2 X1
+unify_variable X4
+unify_variable X5
+get_structure (atom f)/1 X5
+unify_constant (atom a)
+get_value X4, A2
+proceed
+`,
+	},
+	{"rule0",
+		`p(U,V), q(V,U).`,
+		`p(X,Y) :- q(X,Z), r(Z,Y).`,
+		`allocate 2
+put_variable Y0, A0
+put_variable Y1, A1
+call (atom p)/2, 2
+put_value Y1, A0
+put_value Y0, A1
+call (atom q)/2, 2
+halt
+`,
+		`allocate 2
+get_variable X2, A0
+get_variable Y0, A1
+put_value X2, A0
+put_variable Y1, A1
+call (atom q)/2, 2
+put_value Y1, A0
+put_value Y0, A1
+deallocate
+execute (atom r)/2
+`,
+	},
+	{"rule1",
+		`p(_,_).`,
+		`p(f(X,_),g(_)) :- q(X), r(f(X,Y),Y).`,
+		`allocate 0
+put_variable X2, A0
+put_variable X3, A1
+call (atom p)/2, 0
+halt
+`,
+		`allocate 1
+get_structure (atom f)/2 X0
+unify_variable Y0
+unify_variable X2
+get_structure (atom g)/1 X1
+unify_variable X3
+put_value Y0, A0
+call (atom q)/1, 1
+put_structure (atom f)/2 X0
+set_value Y0
 set_variable X4
-put_structure (atom f)/1 X3
-set_value X4
-put_structure (atom p)/3 X0
-set_value X1
+put_value X4, A1
+deallocate
+execute (atom r)/2
+`,
+	},
+}
+
+type testProgram struct {
+	name   string
+	p      string
+	res    string
+	labels map[Functor]int
+}
+
+var testsProgram = []testProgram{
+	{"discontiguous",
+		`a(x). b(y). a(y). a(z).`,
+		`switch_on_term 1, 10, -1, -1
+try_me_else 4
+get_constant (atom x), A0
+proceed
+retry_me_else 7
+get_constant (atom y), A0
+proceed
+trust_me
+get_constant (atom z), A0
+proceed
+switch_on_constant {x: 2, y: 5, z: 8}, -1
+get_constant (atom y), A0
+proceed
+`,
+		map[Functor]int{NewFunctor("a", 1): 0, NewFunctor("b", 1): 11},
+	},
+	{"indexed",
+		`p(a,one). p(X,two). p(b,three). p(a,four).`,
+		`switch_on_term 1, 17, 6, 6
+try_me_else 5
+get_constant (atom a), A0
+get_constant (atom one), A1
+proceed
+retry_me_else 9
+get_variable X2, A0
+get_constant (atom two), A1
+proceed
+retry_me_else 13
+get_constant (atom b), A0
+get_constant (atom three), A1
+proceed
+trust_me
+get_constant (atom a), A0
+get_constant (atom four), A1
+proceed
+switch_on_constant {a: 18, b: 21}, 6
+try 2
+retry 6
+trust 14
+try 6
+trust 10
+`,
+		map[Functor]int{NewFunctor("p", 2): 0},
+	},
+	{"unindexed",
+		`p(X,one). p(Y,two).`,
+		`try_me_else 4
+get_variable X2, A0
+get_constant (atom one), A1
+proceed
+trust_me
+get_variable X2, A0
+get_constant (atom two), A1
+proceed
+`,
+		map[Functor]int{NewFunctor("p", 2): 0},
+	},
+	{"trimming",
+		`p(X,Y,Z) :- a(X), b(Y), c(X,Z), d(Y). q(X) :- r(X).`,
+		`allocate 3
+get_variable Y1, A0
+get_variable Y0, A1
+get_variable Y2, A2
+put_value Y1, A0
+call (atom a)/1, 3
+put_value Y0, A0
+call (atom b)/1, 3
+put_value Y1, A0
+put_value Y2, A1
+call (atom c)/2, 1
+put_value Y0, A0
+deallocate
+execute (atom d)/1
+get_variable X1, A0
+put_value X1, A0
+execute (atom r)/1
+`,
+		map[Functor]int{NewFunctor("p", 3): 0, NewFunctor("q", 1): 14},
+	},
+	{"cut",
+		`p(X) :- a(X), !, b. q :- !. r(X) :- !, a(X).`,
+		`allocate 1
+get_level Y0
+get_variable X1, A0
+put_value X1, A0
+call (atom a)/1, 1
+cut Y0
+deallocate
+execute (atom b)/0
+neck_cut
+proceed
+get_variable X1, A0
+neck_cut
+put_value X1, A0
+execute (atom a)/1
+`,
+		map[Functor]int{NewFunctor("p", 1): 0, NewFunctor("q", 0): 8, NewFunctor("r", 1): 10},
+	},
+	{"control",
+		`p(X,Y) :- (q(X) -> r(Y) ; s(Y)). n(X) :- \+ q(X).`,
+		`allocate 3
+get_variable Y2, A0
+get_variable Y0, A1
+get_choice Y1
+try_else +7
+put_value Y2, A0
+call (atom q)/1, 2
+cut Y1
+put_value Y0, A0
+deallocate
+execute (atom r)/1
+trust_me
+put_value Y0, A0
+deallocate
+execute (atom s)/1
+allocate 2
+get_variable Y1, A0
+get_choice Y0
+try_else +5
+put_value Y1, A0
+call (atom q)/1, 1
+cut Y0
+fail
+trust_me
+deallocate
+proceed
+`,
+		map[Functor]int{NewFunctor("p", 2): 0, NewFunctor("n", 1): 15},
+	},
+	{"typetests",
+		`p(X) :- atom(X), q(X). r(X) :- q(X), integer(X). s(X, Y) :- nonvar(f(X)), var(Y).`,
+		`get_variable X1, A0
+type_test (atom atom), X1
+put_value X1, A0
+execute (atom q)/1
+allocate 1
+get_variable Y0, A0
+put_value Y0, A0
+call (atom q)/1, 1
+type_test (atom integer), Y0
+deallocate
+proceed
+get_variable X2, A0
+get_variable X3, A1
+put_structure (atom f)/1 X0
 set_value X2
-set_value X3
-get_structure (atom p)/3 X0
-unify_variable X1
-unify_variable X2
+type_test (atom nonvar), X0
+type_test (atom var), X3
+proceed
+`,
+		map[Functor]int{NewFunctor("p", 1): 0, NewFunctor("r", 1): 4, NewFunctor("s", 2): 11},
+	},
+	{"lists",
+		`app([],L,L). app([H|T],L,[H|R]) :- app(T,L,R). n(1,one). n(2,two). n(f(1),three).`,
+		`switch_on_term 1, 18, 7, -1
+try_me_else 6
+get_constant (atom []), A0
+get_variable X3, A1
+get_value X3, A2
+proceed
+trust_me
+get_list X0
 unify_variable X3
-get_structure (atom f)/1 X1
 unify_variable X4
-get_structure (atom h)/2 X2
+get_variable X5, A1
+get_list X2
 unify_value X3
-unify_variable X5
-get_structure (atom f)/1 X5
 unify_variable X6
-get_structure (atom a)/0 X6
+put_value X4, A0
+put_value X5, A1
+put_value X6, A2
+execute (atom app)/3
+switch_on_constant {[]: 2}, -1
+switch_on_term 20, 33, -1, 34
+try_me_else 24
+get_constant (integer 1), A0
+get_constant (atom one), A1
+proceed
+retry_me_else 28
+get_constant (integer 2), A0
+get_constant (atom two), A1
+proceed
+trust_me
+get_structure (atom f)/1 X0
+unify_constant (integer 1)
+get_constant (atom three), A1
+proceed
+switch_on_constant {1: 21, 2: 25}, -1
+switch_on_structure {f/1: 29}, -1
 `,
+		map[Functor]int{NewFunctor("app", 3): 0, NewFunctor("n", 2): 19},
 	},
 }
 
+func TestCompileProgram(t *testing.T) {
+	var ctx context.Context
+	for _, st := range testsProgram {
+		t.Run(st.name, func(t *testing.T) {
+			s := scan.New(ctx, "file.pl", bytes.NewBuffer([]byte(st.p)))
+			p := parse.New("file.pl", s)
+			ts := []term.Term{}
+			for {
+				t, err := p.NextTerm()
+				if err != nil {
+					break
+				}
+				ts = append(ts, t)
+			}
+
+			cs, labels := compileL1Program(ts)
+			if cs.String() != st.res {
+				t.Fatalf("expected: %s, got: %s", st.res, cs)
+			}
+			if !reflect.DeepEqual(labels, st.labels) {
+				t.Fatalf("expected labels: %v, got: %v", st.labels, labels)
+			}
+		})
+	}
+}
+
 func TestCompileL0(t *testing.T) {
 	var ctx context.Context
 	for _, st := range testsL0 {
@@ -72,9 +351,14 @@ func TestCompileL0(t *testing.T) {
 			q, _ := qt.NextTerm()
 			p, _ := pt.NextTerm()
 
-			cs := compileL1(q, []term.Term{p})
-			if cs.String() != st.res {
-				t.Fatalf("expected: %s, got: %s", st.res, cs)
+			qcs, _ := compileL1Query(q)
+			if qcs.String() != st.qres {
+				t.Fatalf("expected: %s, got: %s", st.qres, qcs)
+			}
+
+			pcs, _ := compileL1Program([]term.Term{p})
+			if pcs.String() != st.pres {
+				t.Fatalf("expected: %s, got: %s", st.pres, pcs)
 			}
 		})
 	}
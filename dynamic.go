@@ -0,0 +1,466 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import "github.com/tcolgate/golorp/term"
+
+// Dynamic predicates
+//
+// The clauses of dynamic predicates are held by the machine as terms,
+// so that they can be added and removed while a query runs. A call to
+// a dynamic predicate tries the clauses that were defined when the
+// call was made, the logical update view, so adding or removing
+// clauses does not change the alternatives of calls in progress. The
+// slice of clauses of a predicate is never modified in place, a call
+// keeps the slice it started with in its choice point.
+//
+// Each clause is built on the heap when it is tried, its head is
+// unified with the arguments of the call, and its body is called as
+// by call/1, other than that a cut in the body discards the remaining
+// clauses of the call.
+//
+// Predicates declared dynamic in a program have their clauses added
+// by the program's initialisation, which is run by Load.
+
+// initPred is the predicate compiled from a program's dynamic
+// directives, and the clauses of its dynamic predicates
+const initPred = term.Atom("$init")
+
+// dynClause is a clause of a dynamic predicate
+type dynClause struct {
+	pred   *dynPred
+	head   *term.Callable
+	body   term.Term // nil for a fact
+	key    argKey
+	erased bool // the clause has been retracted
+}
+
+// dynPred holds the clauses of a dynamic predicate, in order
+type dynPred struct {
+	clauses []*dynClause
+}
+
+// erase removes the clause c from p
+func (p *dynPred) erase(c *dynClause) {
+	cs := make([]*dynClause, 0, len(p.clauses))
+	for _, o := range p.clauses {
+		if o != c {
+			cs = append(cs, o)
+		}
+	}
+	p.clauses = cs
+	c.erased = true
+}
+
+// isStatic reports whether f is a control construct, a builtin, a
+// library predicate, or a predicate defined by the loaded program,
+// none of which can be modified.
+func (m *Machine) isStatic(f Functor) bool {
+	if isControl(f) {
+		return true
+	}
+	if _, ok := builtins[f]; ok {
+		return true
+	}
+	if _, ok := library.preds[f]; ok {
+		return true
+	}
+	_, ok := m.Labels[f]
+	return ok
+}
+
+// dynamic returns the dynamic predicate f, creating it if needed.
+// Static predicates cannot be made dynamic.
+func (m *Machine) dynamic(f Functor) (*dynPred, error) {
+	if m.isStatic(f) {
+		return nil, PermissionError{"modify", "static_procedure", indicator(f)}
+	}
+	if m.db == nil {
+		m.db = map[Functor]*dynPred{}
+	}
+	p, ok := m.db[f]
+	if !ok {
+		p = &dynPred{}
+		m.db[f] = p
+	}
+	return p, nil
+}
+
+// callDynamic calls the dynamic predicate p, with its arguments in
+// the argument registers
+func (m *Machine) callDynamic(p *dynPred) {
+	k := argKey{Type: keyVar}
+	if m.NumArgs > 0 {
+		k = m.cellKey(m.cell(m.derefReg(0)))
+	}
+	cs := candidates(p.clauses, k)
+	if len(cs) == 0 {
+		m.fail()
+		return
+	}
+	if len(cs) > 1 {
+		if !m.reserveFrame() {
+			return
+		}
+		retry, _ := m.dynamicCode()
+		m.pushChoicePoint(retry, m.NumArgs)
+		m.OrStack[m.BReg].Clauses = cs[1:]
+	}
+	m.tryClause(cs[0])
+}
+
+// candidates returns the clauses in cs whose first argument could
+// match a first argument with the index key k
+func candidates(cs []*dynClause, k argKey) []*dynClause {
+	if k.Type == keyVar {
+		return cs
+	}
+	match := []*dynClause{}
+	for _, c := range cs {
+		if c.key.Type == keyVar || c.key == k {
+			match = append(match, c)
+		}
+	}
+	return match
+}
+
+// nextClause restores the state saved in the current choice point,
+// and takes the next of its clauses. The choice point is discarded
+// once its last clause has been taken.
+func (m *Machine) nextClause() *dynClause {
+	b := m.OrStack[m.BReg]
+	c := b.Clauses[0]
+	if len(b.Clauses) == 1 {
+		m.popChoicePoint()
+		return c
+	}
+	m.restoreChoicePoint(b)
+	b.Clauses = b.Clauses[1:]
+	return c
+}
+
+// tryClause unifies the head of c with the arguments of the call,
+// and runs its body. A cut in the body cuts to the cut level of the
+// call.
+func (m *Machine) tryClause(c *dynClause) {
+	vars := map[term.Variable]Cell{}
+	h, ok := m.encode(c.head, vars)
+	if !ok {
+		return
+	}
+	for i := range c.head.Args() {
+		if !m.unifies(h.Addr()+Addr(1+i), m.regPtr(X(i))) {
+			m.fail()
+			return
+		}
+	}
+	if c.body == nil {
+		m.PReg = m.CPReg
+		return
+	}
+	g, ok := m.encode(c.body, vars)
+	if !ok {
+		return
+	}
+	m.setReg(X(0), g)
+	m.callCut(m.GBReg)
+}
+
+// RetryClause tries the next clause of the call to a dynamic
+// predicate whose choice point is the most recent.
+func RetryClause() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.tryClause(m.nextClause())
+		return nil, ""
+	}, "retry_clause"
+}
+
+// RetryRetract tries to retract the next clause for the call to
+// retract/1 whose choice point is the most recent.
+func RetryRetract() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.retractClause(m.nextClause())
+		return nil, ""
+	}, "retry_retract"
+}
+
+// dynamicCode returns the addresses of the code that resumes calls
+// to dynamic predicates, and calls to retract/1, on backtracking.
+func (m *Machine) dynamicCode() (int, int) {
+	l, ok := m.dynCode["$dynamic"]
+	if !ok {
+		l = m.addCode("$dynamic", CodeCells{
+			cc(RetryClause()),
+			cc(RetryRetract()),
+		})
+	}
+	return l, l + 1
+}
+
+// newClause checks that t can be added to the database as a clause,
+// returning the predicate it belongs to, and the clause.
+func newClause(t term.Term) (Functor, *dynClause, error) {
+	head, body := t, term.Term(nil)
+	if fn, args := callable(t); fn == ":-" && len(args) == 2 {
+		head, body = args[0], args[1]
+	}
+
+	var h *term.Callable
+	switch ht := head.(type) {
+	case term.Variable:
+		return Functor{}, nil, InstantiationError{}
+	case *term.Callable:
+		if isList(ht) {
+			return Functor{}, nil, TypeError{"callable", head}
+		}
+		h = ht
+	default:
+		return Functor{}, nil, TypeError{"callable", head}
+	}
+
+	if body != nil {
+		if !isBody(body) {
+			return Functor{}, nil, TypeError{"callable", body}
+		}
+		if fn, args := callable(body); fn == "true" && len(args) == 0 {
+			body = nil
+		}
+	}
+
+	fn, n := h.Functor()
+	return NewFunctor(term.Atom(fn), n), &dynClause{
+		head: h,
+		body: body,
+		key:  firstArgKey(h),
+	}, nil
+}
+
+// isBody reports whether t can be called as the body of a clause,
+// variables are called as by call/1.
+func isBody(t term.Term) bool {
+	switch t := t.(type) {
+	case term.Variable:
+		return true
+	case *term.Callable:
+		fn, n := t.Functor()
+		if n == 2 && (fn == "," || fn == ";" || fn == "->") {
+			return isBody(t.Args()[0]) && isBody(t.Args()[1])
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// assertClause returns a builtin that adds the clause in A0 to its
+// dynamic predicate, before the existing clauses if first is set, or
+// after them otherwise.
+func assertClause(first bool) builtin {
+	return func(m *Machine) {
+		t, err := m.decode(m.derefReg(0), map[Addr]bool{})
+		if err != nil {
+			m.stop(err)
+			return
+		}
+		f, c, err := newClause(t)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		p, err := m.dynamic(f)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		c.pred = p
+		if first {
+			p.clauses = append([]*dynClause{c}, p.clauses...)
+			return
+		}
+		p.clauses = append(p.clauses[:len(p.clauses):len(p.clauses)], c)
+	}
+}
+
+// retract1 implements retract(Clause), removing the first clause that
+// unifies with Clause. On backtracking the following clauses that
+// unify are removed.
+func retract1(m *Machine) {
+	a := m.derefReg(0)
+	head, body := a, Addr(0)
+	hasBody := false
+	if c := m.cell(a); c.Tag() == STR && m.cell(c.Addr()).Functor() == NewFunctor(":-", 2) {
+		head, body = m.deref(c.Addr()+1), c.Addr()+2
+		hasBody = true
+	}
+
+	var f Functor
+	k := argKey{Type: keyVar}
+	switch c := m.cell(head); c.Tag() {
+	case REF:
+		m.throw(InstantiationError{})
+		return
+	case CON:
+		f = Functor{c.Atom(), 0}
+	case STR:
+		f = m.cell(c.Addr()).Functor()
+		if f.Arity > 0 {
+			k = m.cellKey(m.cell(m.deref(c.Addr() + 1)))
+		}
+	default:
+		m.throw(TypeError{"callable", m.culprit(head)})
+		return
+	}
+	if m.isStatic(f) {
+		m.throw(PermissionError{"modify", "static_procedure", indicator(f)})
+		return
+	}
+	p, ok := m.db[f]
+	if !ok {
+		m.fail()
+		return
+	}
+
+	m.setReg(X(0), m.cell(head))
+	m.setReg(X(1), atomCell(Intern("true")))
+	if hasBody {
+		m.setReg(X(1), m.cell(body))
+	}
+	cs := candidates(p.clauses, k)
+	if len(cs) == 0 {
+		m.fail()
+		return
+	}
+	if len(cs) > 1 {
+		if !m.reserveFrame() {
+			return
+		}
+		_, retry := m.dynamicCode()
+		m.pushChoicePoint(retry, 2)
+		m.OrStack[m.BReg].Clauses = cs[1:]
+	}
+	m.retractClause(cs[0])
+}
+
+// retractClause removes the clause c if it unifies with the head in
+// A0 and the body in A1, and has not already been removed.
+func (m *Machine) retractClause(c *dynClause) {
+	if c.erased {
+		m.fail()
+		return
+	}
+	vars := map[term.Variable]Cell{}
+	h, ok := m.encode(c.head, vars)
+	if !ok {
+		return
+	}
+	b := atomCell(Intern("true"))
+	if c.body != nil {
+		if b, ok = m.encode(c.body, vars); !ok {
+			return
+		}
+	}
+	m.setReg(X(2), h)
+	m.setReg(X(3), b)
+	if !m.unifies(m.regPtr(X(0)), m.regPtr(X(2))) || !m.unifies(m.regPtr(X(1)), m.regPtr(X(3))) {
+		m.fail()
+		return
+	}
+	c.pred.erase(c)
+	m.PReg = m.CPReg
+}
+
+// abolish1 implements abolish(Name/Arity), removing the dynamic
+// predicate and all of its clauses.
+func abolish1(m *Machine) {
+	f, err := m.predIndicator(m.regPtr(X(0)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	if m.isStatic(f) {
+		m.throw(PermissionError{"modify", "static_procedure", indicator(f)})
+		return
+	}
+	p, ok := m.db[f]
+	if !ok {
+		return
+	}
+	for _, c := range p.clauses {
+		c.erased = true
+	}
+	delete(m.db, f)
+}
+
+// dynamic1 implements dynamic(Spec), declaring the predicates in
+// Spec to be dynamic. Spec is a predicate indicator, or a sequence or
+// list of them.
+func dynamic1(m *Machine) {
+	if err := m.declareDynamic(m.regPtr(X(0))); err != nil {
+		m.throw(err)
+	}
+}
+
+// declareDynamic declares the predicates in the Spec at a dynamic
+func (m *Machine) declareDynamic(a Addr) error {
+	a = m.deref(a)
+	c := m.cell(a)
+	switch {
+	case c.Tag() == LIS:
+		if err := m.declareDynamic(c.Addr()); err != nil {
+			return err
+		}
+		return m.declareDynamic(c.Addr() + 1)
+	case c.Tag() == CON && c.Atom() == atomNil:
+		return nil
+	case c.Tag() == STR && m.cell(c.Addr()).Functor() == NewFunctor(",", 2):
+		if err := m.declareDynamic(c.Addr() + 1); err != nil {
+			return err
+		}
+		return m.declareDynamic(c.Addr() + 2)
+	}
+	f, err := m.predIndicator(a)
+	if err != nil {
+		return err
+	}
+	_, err = m.dynamic(f)
+	return err
+}
+
+// predIndicator returns the predicate named by the predicate
+// indicator at a, Name/Arity.
+func (m *Machine) predIndicator(a Addr) (Functor, error) {
+	a = m.deref(a)
+	c := m.cell(a)
+	if c.Tag() == REF {
+		return Functor{}, InstantiationError{}
+	}
+	if c.Tag() != STR || m.cell(c.Addr()).Functor() != NewFunctor("/", 2) {
+		return Functor{}, TypeError{"predicate_indicator", m.culprit(a)}
+	}
+	na, aa := m.deref(c.Addr()+1), m.deref(c.Addr()+2)
+	name, arity := m.cell(na), m.cell(aa)
+	switch {
+	case name.Tag() == REF || arity.Tag() == REF:
+		return Functor{}, InstantiationError{}
+	case name.Tag() != CON:
+		return Functor{}, TypeError{"atom", m.culprit(na)}
+	case !arity.isInteger():
+		return Functor{}, TypeError{"integer", m.culprit(aa)}
+	case numSign(m.cellNum(arity)) < 0:
+		return Functor{}, DomainError{"not_less_than_zero", m.culprit(aa)}
+	case arity.Tag() != INT || arity.Int() > arityMask:
+		return Functor{}, RepresentationError{"max_arity"}
+	}
+	return Functor{name.Atom(), int(arity.Int())}, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var dynamictests = []atest{
+	{q: `assertz(f(1)), assertz(f(2)), f(X).`, v: "X", exp: []string{"1", "2"}},
+	{q: `asserta(f(1)), asserta(f(2)), f(X).`, v: "X", exp: []string{"2", "1"}},
+	{q: `assert(f(1)), assert(f(2)), f(X).`, v: "X", exp: []string{"1", "2"}},
+	{q: `assertz((g(X) :- f(Y), X is Y * 10)), assertz(f(1)), assertz(f(2)), g(X).`, v: "X", exp: []string{"10", "20"}},
+	{q: `assertz(f(a, 1)), assertz(f(b, 2)), assertz(f(_, 3)), f(b, X).`, v: "X", exp: []string{"2", "3"}},
+	{
+		p:   `:- dynamic counter/1. counter(0).`,
+		q:   `retract(counter(N)), N1 is N + 1, assertz(counter(N1)), counter(X).`,
+		v:   "X",
+		exp: []string{"1"},
+	},
+	{
+		p:   `:- dynamic((p/1, q/0)).`,
+		q:   `\+ p(_), \+ q, X = yes.`,
+		v:   "X",
+		exp: []string{"yes"},
+	},
+	{
+		p:   `:- dynamic [p/1].`,
+		q:   `\+ p(_), X = yes.`,
+		v:   "X",
+		exp: []string{"yes"},
+	},
+	{
+		p:   `:- dynamic p/1. p(1). p(2).`,
+		q:   `p(X), assertz(p(3)).`,
+		v:   "X",
+		exp: []string{"1", "2"},
+	},
+	{
+		p:   `:- dynamic p/1. p(1). p(2). p(3).`,
+		q:   `p(X), retract(p(2)).`,
+		v:   "X",
+		exp: []string{"1"},
+	},
+	{
+		p:   `:- dynamic p/1. p(1). p(2). p(3).`,
+		q:   `retract(p(_)), p(X).`,
+		v:   "X",
+		exp: []string{"2", "3", "3"},
+	},
+	{
+		p:   `:- dynamic p/1. p(1). p(2). p(3).`,
+		q:   `retract(p(X)).`,
+		v:   "X",
+		exp: []string{"1", "2", "3"},
+	},
+	{
+		p:   `:- dynamic r/1. r(1). r(X) :- X = 2.`,
+		q:   `retract((r(X) :- B)), X == 1.`,
+		v:   "B",
+		exp: []string{"true"},
+	},
+	{
+		p:   `:- dynamic r/1. r(1). r(X) :- X = 2.`,
+		q:   `retract((r(_) :- X = Y)).`,
+		v:   "Y",
+		exp: []string{"2"},
+	},
+	{
+		p:   `:- dynamic s/2. s(X, pos) :- X > 0, !. s(_, other).`,
+		q:   `s(1, X).`,
+		v:   "X",
+		exp: []string{"pos"},
+	},
+	{
+		p:   `:- dynamic s/2. s(X, pos) :- X > 0, !. s(_, other).`,
+		q:   `s(-1, X).`,
+		v:   "X",
+		exp: []string{"other"},
+	},
+	{
+		p:   `:- dynamic s/1. s(X) :- (X = 1 ; X = 2). s(3).`,
+		q:   `s(X).`,
+		v:   "X",
+		exp: []string{"1", "2", "3"},
+	},
+	{
+		p:   `:- dynamic p/1. p(1).`,
+		q:   `abolish(p/1), p(X).`,
+		v:   "X",
+		exp: []string{},
+		err: ExistenceError{NewFunctor("p", 1)},
+	},
+	{
+		p:   `:- dynamic p/1. p(1). p(2).`,
+		q:   `p(X), abolish(p/1).`,
+		v:   "X",
+		exp: []string{"1", "2"},
+	},
+	{
+		p:   `s(1).`,
+		q:   `assertz(s(2)).`,
+		v:   "X",
+		exp: []string{},
+		err: PermissionError{"modify", "static_procedure", indicator(NewFunctor("s", 1))},
+	},
+	{
+		p:   `s(1).`,
+		q:   `retract(s(1)).`,
+		v:   "X",
+		exp: []string{},
+		err: PermissionError{"modify", "static_procedure", indicator(NewFunctor("s", 1))},
+	},
+	{
+		q:   `abolish(is/2).`,
+		v:   "X",
+		exp: []string{},
+		err: PermissionError{"modify", "static_procedure", indicator(NewFunctor("is", 2))},
+	},
+	{
+		q:   `assertz(bagof(_, _, _)).`,
+		v:   "X",
+		exp: []string{},
+		err: PermissionError{"modify", "static_procedure", indicator(NewFunctor("bagof", 3))},
+	},
+	{
+		q:   `abolish(aggregate_all/3).`,
+		v:   "X",
+		exp: []string{},
+		err: PermissionError{"modify", "static_procedure", indicator(NewFunctor("aggregate_all", 3))},
+	},
+	{
+		q:   `asserta((a, b)).`,
+		v:   "X",
+		exp: []string{},
+		err: PermissionError{"modify", "static_procedure", indicator(NewFunctor(",", 2))},
+	},
+	{q: `assertz(X).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `assertz((X :- true)).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `assertz(1).`, v: "X", exp: []string{}, err: TypeError{"callable", numTerm(int64(1))}},
+	{q: `assertz((f :- 1)).`, v: "X", exp: []string{}, err: TypeError{"callable", numTerm(int64(1))}},
+	{q: `retract(X).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `retract(nope(1)), X = yes.`, v: "X", exp: []string{}},
+	{q: `abolish(X).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `abolish(foo).`, v: "X", exp: []string{}, err: TypeError{"predicate_indicator", atom("foo")}},
+	{q: `abolish(foo / a).`, v: "X", exp: []string{}, err: TypeError{"integer", atom("a")}},
+	{q: `abolish(1/1).`, v: "X", exp: []string{}, err: TypeError{"atom", numTerm(int64(1))}},
+	{q: `abolish(foo / (-1)).`, v: "X", exp: []string{}, err: DomainError{"not_less_than_zero", numTerm(int64(-1))}},
+	{q: `dynamic(foo / _).`, v: "X", exp: []string{}, err: InstantiationError{}},
+}
+
+func TestDynamic(t *testing.T) {
+	for _, st := range dynamictests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, "X = X.\n"+st.p)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
+
+func TestDynamicAcrossQueries(t *testing.T) {
+	m := loadProgram(t, `
+X = X.
+:- dynamic seen/1.
+seen(a).
+remember(X) :- assertz(seen(X)).
+`)
+	steps := []struct {
+		q   string
+		exp []string
+	}{
+		{`seen(X).`, []string{"a"}},
+		{`remember(b), remember(f(Y)), X = ok.`, []string{"ok"}},
+		{`seen(S), (S = f(V), var(V) -> X = f(var) ; X = S).`, []string{"a", "b", "f(var)"}},
+		{`retract(seen(b)), X = ok.`, []string{"ok"}},
+		{`seen(S), (S = f(V), var(V) -> X = f(var) ; X = S).`, []string{"a", "f(var)"}},
+	}
+	for _, st := range steps {
+		res, err := allSolutions(t, m, st.q, "X")
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", st.q, err)
+		}
+		if !reflect.DeepEqual(res, st.exp) {
+			t.Fatalf("%s: expected %v, got %v", st.q, st.exp, res)
+		}
+	}
+
+	// Loading a program discards the clauses added to the last
+	m.Load(compileL1Program(parseProgram(t, `X = X. :- dynamic seen/1.`)))
+	res, err := allSolutions(t, m, `seen(X).`, "X")
+	if err != nil || len(res) != 0 {
+		t.Fatalf("expected no solutions, got %v, %v", res, err)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// Errors raised by the machine are thrown as ISO error terms,
+// error(Formal, Context), which can be caught by catch/3. An error
+// that is not caught stops the query, and is returned to the caller
+// as one of the error types below, or as an Exception if the ball is
+// not an ISO error term.
+
+// isoError is an error that has an ISO formal error term
+type isoError interface {
+	error
+	Formal() term.Term
+}
+
+// InstantiationError is raised when an argument is unbound, but
+// must be bound.
+type InstantiationError struct{}
+
+func (err InstantiationError) Error() string {
+	return "instantiation_error"
+}
+
+// Formal returns the ISO error term for err
+func (err InstantiationError) Formal() term.Term {
+	return atom("instantiation_error")
+}
+
+// TypeError is raised when an argument has the wrong type, Culprit
+// is the offending argument.
+type TypeError struct {
+	Type    string
+	Culprit term.Term
+}
+
+func (err TypeError) Error() string {
+	return fmt.Sprintf("type_error(%s, %s)", err.Type, term.Format(err.Culprit))
+}
+
+// Formal returns the ISO error term for err
+func (err TypeError) Formal() term.Term {
+	return term.NewCallable("type_error", []term.Term{atom(err.Type), err.Culprit})
+}
+
+// DomainError is raised when an argument has the right type, but a
+// value outside of the domain of the predicate.
+type DomainError struct {
+	Domain  string
+	Culprit term.Term
+}
+
+func (err DomainError) Error() string {
+	return fmt.Sprintf("domain_error(%s, %s)", err.Domain, term.Format(err.Culprit))
+}
+
+// Formal returns the ISO error term for err
+func (err DomainError) Formal() term.Term {
+	return term.NewCallable("domain_error", []term.Term{atom(err.Domain), err.Culprit})
+}
+
+// ExistenceError is raised when calling a procedure that has
+// not been defined.
+type ExistenceError struct {
+	Procedure Functor
+}
+
+func (err ExistenceError) Error() string {
+	return fmt.Sprintf("existence_error(procedure, %s)", err.Procedure)
+}
+
+// Formal returns the ISO error term for err
+func (err ExistenceError) Formal() term.Term {
+	return term.NewCallable("existence_error", []term.Term{
+		atom("procedure"),
+		indicator(err.Procedure),
+	})
+}
+
+// EvaluationError is raised when an arithmetic function has no
+// value for its arguments, such as on division by zero.
+type EvaluationError struct {
+	Cause string
+}
+
+func (err EvaluationError) Error() string {
+	return fmt.Sprintf("evaluation_error(%s)", err.Cause)
+}
+
+// Formal returns the ISO error term for err
+func (err EvaluationError) Formal() term.Term {
+	return term.NewCallable("evaluation_error", []term.Term{atom(err.Cause)})
+}
+
+// ResourceError is raised when a query exceeds one of the machine's
+// configured limits.
+type ResourceError struct {
+	Resource string
+}
+
+func (err ResourceError) Error() string {
+	return fmt.Sprintf("resource_error(%s)", err.Resource)
+}
+
+// Formal returns the ISO error term for err
+func (err ResourceError) Formal() term.Term {
+	return term.NewCallable("resource_error", []term.Term{atom(err.Resource)})
+}
+
+// PermissionError is raised when an operation is not permitted on
+// the Culprit, such as adding clauses to a static procedure.
+type PermissionError struct {
+	Action  string
+	Type    string
+	Culprit term.Term
+}
+
+func (err PermissionError) Error() string {
+	return fmt.Sprintf("permission_error(%s, %s, %s)", err.Action, err.Type, term.Format(err.Culprit))
+}
+
+// Formal returns the ISO error term for err
+func (err PermissionError) Formal() term.Term {
+	return term.NewCallable("permission_error", []term.Term{atom(err.Action), atom(err.Type), err.Culprit})
+}
+
+// RepresentationError is raised when a value exceeds an
+// implementation defined limit, such as the maximum arity.
+type RepresentationError struct {
+	Flag string
+}
+
+func (err RepresentationError) Error() string {
+	return fmt.Sprintf("representation_error(%s)", err.Flag)
+}
+
+// Formal returns the ISO error term for err
+func (err RepresentationError) Formal() term.Term {
+	return term.NewCallable("representation_error", []term.Term{atom(err.Flag)})
+}
+
+// SyntaxError is raised when text cannot be read, such as text that
+// is not a number given to number_codes/2.
+type SyntaxError struct {
+	Cause string
+}
+
+func (err SyntaxError) Error() string {
+	return fmt.Sprintf("syntax_error(%s)", err.Cause)
+}
+
+// Formal returns the ISO error term for err
+func (err SyntaxError) Formal() term.Term {
+	return term.NewCallable("syntax_error", []term.Term{atom(err.Cause)})
+}
+
+// Exception is an uncaught ball that is not an ISO error term
+type Exception struct {
+	Ball term.Term
+}
+
+func (err Exception) Error() string {
+	return fmt.Sprintf("unhandled exception, %s", term.Format(err.Ball))
+}
+
+// atom returns the term for the atom name, as built by the parser
+func atom(name string) term.Term {
+	return term.NewCallable(name, nil)
+}
+
+// indicator returns the predicate indicator for f, Name/Arity
+func indicator(f Functor) term.Term {
+	return term.NewCallable("/", []term.Term{
+		atom(f.Name.String()),
+		term.NewInteger(int64(f.Arity)),
+	})
+}
+
+// errorBall returns the ball thrown for err, error(Formal, _)
+func errorBall(err error) term.Term {
+	f := term.Term(atom("system_error"))
+	if ie, ok := err.(isoError); ok {
+		f = ie.Formal()
+	}
+	return term.NewCallable("error", []term.Term{f, term.NewVariable("_")})
+}
+
+// ballError returns the error returned to the caller of a query
+// stopped by an uncaught ball.
+func ballError(ball term.Term) error {
+	fn, args := callable(ball)
+	if fn != "error" || len(args) != 2 {
+		return Exception{ball}
+	}
+	fn, fargs := callable(args[0])
+	name := func(i int) string {
+		n, as := callable(fargs[i])
+		if len(as) != 0 {
+			return term.Format(fargs[i])
+		}
+		return n
+	}
+	switch {
+	case fn == "instantiation_error" && len(fargs) == 0:
+		return InstantiationError{}
+	case fn == "type_error" && len(fargs) == 2:
+		return TypeError{name(0), fargs[1]}
+	case fn == "domain_error" && len(fargs) == 2:
+		return DomainError{name(0), fargs[1]}
+	case fn == "evaluation_error" && len(fargs) == 1:
+		return EvaluationError{name(0)}
+	case fn == "resource_error" && len(fargs) == 1:
+		return ResourceError{name(0)}
+	case fn == "representation_error" && len(fargs) == 1:
+		return RepresentationError{name(0)}
+	case fn == "syntax_error" && len(fargs) == 1:
+		return SyntaxError{name(0)}
+	case fn == "permission_error" && len(fargs) == 3:
+		return PermissionError{name(0), name(1), fargs[2]}
+	case fn == "existence_error" && len(fargs) == 2 && name(0) == "procedure":
+		pn, pargs := callable(fargs[1])
+		if pn != "/" || len(pargs) != 2 {
+			break
+		}
+		a, as := callable(pargs[0])
+		if a == "" || len(as) != 0 {
+			break
+		}
+		n, ok := pargs[1].(*term.Integer)
+		if !ok {
+			break
+		}
+		arity, ok := n.Int64()
+		if !ok {
+			break
+		}
+		return ExistenceError{NewFunctor(term.Atom(a), int(arity))}
+	}
+	return Exception{ball}
+}
+
+// callable returns the name and arguments of t, or an empty name if t
+// is not callable
+func callable(t term.Term) (string, []term.Term) {
+	switch t := t.(type) {
+	case term.Atom:
+		return string(t), nil
+	case *term.Callable:
+		fn, _ := t.Functor()
+		return fn, t.Args()
+	default:
+		return "", nil
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import "github.com/tcolgate/golorp/term"
+
+// Exceptions
+//
+// catch/3 pushes an environment, holding the continuation of the
+// call, and a choice point that marks the catch as active, before
+// calling its goal. The goal returns through catch_exit, which
+// discards the catch's choice point if the goal left no others. On
+// backtracking the choice point is simply discarded.
+//
+// When a ball is thrown, the most recent active catch is found, the
+// machine is restored to the state saved in its choice point, and the
+// ball is unified with the catcher. A catch is active while its
+// environment is part of the current continuation, that is, while its
+// goal is running.
+
+// catch3 implements catch(Goal, Catcher, Recovery)
+func catch3(m *Machine) {
+	exit, fail := m.catchCode()
+	if !m.allocate(0) || !m.reserveFrame() {
+		return
+	}
+	m.pushChoicePoint(fail, 3)
+	m.OrStack[m.BReg].Catch = true
+	m.CPReg = exit
+	m.GBReg = m.BReg
+	m.callGoal()
+}
+
+// throw1 implements throw(Ball). The ball is copied, as the heap it
+// was built on is discarded as the machine unwinds to the catch.
+func throw1(m *Machine) {
+	a := m.derefReg(0)
+	if m.cell(a).Tag() == REF {
+		m.throw(InstantiationError{})
+		return
+	}
+	ball, err := m.decode(a, map[Addr]bool{})
+	if err != nil {
+		m.stop(err)
+		return
+	}
+	m.throwBall(ball)
+}
+
+// throwBall raises the exception ball. The ball is thrown once the
+// current instruction completes, only the first ball raised by an
+// instruction is thrown.
+func (m *Machine) throwBall(ball term.Term) {
+	if m.ball == nil {
+		m.ball = ball
+	}
+}
+
+// stop stops the machine with the error err, which cannot be caught
+func (m *Machine) stop(err error) {
+	m.Err = err
+	m.Failed = true
+	m.Finished = true
+}
+
+// handle throws the pending ball to the most recent active catch
+// whose catcher unifies with it, and runs its recovery goal. If there
+// is no such catch the query is stopped.
+func (m *Machine) handle() {
+	ball := m.ball
+	m.ball = nil
+	for b := m.activeCatch(m.BReg); b != -1; b = m.activeCatch(m.BReg) {
+		m.BReg = b
+		m.popChoicePoint()
+
+		c, ok := m.encode(ball, map[term.Variable]Cell{})
+		if !ok {
+			// there is no room for the ball, throw the resource
+			// error to the next catch instead.
+			ball = m.ball
+			m.ball = nil
+			continue
+		}
+		m.setReg(X(3), c)
+		if !m.unifies(m.regPtr(X(3)), m.regPtr(X(1))) {
+			continue
+		}
+
+		exit, _ := m.catchCode()
+		m.setReg(X(0), m.getReg(X(2)))
+		m.CPReg = exit
+		m.GBReg = m.BReg
+		m.callGoal()
+		return
+	}
+	m.stop(ballError(ball))
+}
+
+// activeCatch returns the most recent choice point, at or below b,
+// created by a catch that is still active, or -1 if there is none.
+func (m *Machine) activeCatch(b int) int {
+	for ; b >= 0; b-- {
+		if !m.OrStack[b].Catch {
+			continue
+		}
+		for e := m.EReg; e >= 0; e = m.AndStack[e].CE {
+			if e == m.OrStack[b].E {
+				return b
+			}
+		}
+	}
+	return -1
+}
+
+// catchCode returns the addresses of the code that catch/3 returns
+// through, and that discards its choice point on backtracking.
+func (m *Machine) catchCode() (int, int) {
+	l, ok := m.dynCode["$catch"]
+	if !ok {
+		l = m.addCode("$catch", CodeCells{
+			cc(CatchExit()),
+			cc(Deallocate()),
+			cc(Proceeed()),
+			cc(TrustMe()),
+			cc(Fail()),
+		})
+	}
+	return l, l + 3
+}
+
+// CatchExit discards the choice point of the catch/3 whose goal has
+// just succeeded, if the goal left no choice points of its own.
+func CatchExit() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		if m.BReg == -1 {
+			return nil, ""
+		}
+		if b := m.OrStack[m.BReg]; b.Catch && b.E == m.EReg {
+			m.cutTo(b.B)
+		}
+		return nil, ""
+	}, "catch_exit"
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+var extests = []atest{
+	{
+		q:   `catch(throw(oops), E, true).`,
+		v:   "E",
+		exp: []string{"oops"},
+	},
+	{
+		q:   `catch(throw(f(X, Y, X)), f(a, B, C), true).`,
+		v:   "C",
+		exp: []string{"a"},
+	},
+	{
+		q:   `catch(throw(oops), E, R = recovered).`,
+		v:   "R",
+		exp: []string{"recovered"},
+	},
+	{
+		q:   `catch(undefined(X), error(existence_error(procedure, PI), _), true).`,
+		v:   "PI",
+		exp: []string{"/(undefined,1)"},
+	},
+	{
+		q:   `catch(catch(throw(inner), outer, X = wrong), E, X = right).`,
+		v:   "X",
+		exp: []string{"right"},
+	},
+	{
+		q:   `catch((X = bound, throw(oops)), _, true), X = free.`,
+		v:   "X",
+		exp: []string{"free"},
+	},
+	{
+		q:   `catch(p(X), _, true).`,
+		v:   "X",
+		exp: []string{"a", "b", "c"},
+	},
+	{
+		q:   `catch(p(X), _, true), X = b.`,
+		v:   "X",
+		exp: []string{"b"},
+	},
+	{
+		q:   `catch(fails, _, true) ; X = other.`,
+		v:   "X",
+		exp: []string{"other"},
+	},
+	{
+		q:   `catch(p(X), _, true), throw(late).`,
+		v:   "X",
+		exp: []string{},
+		err: Exception{atom("late")},
+	},
+	{
+		q:   `throw(oops).`,
+		v:   "X",
+		exp: []string{},
+		err: Exception{atom("oops")},
+	},
+	{
+		q:   `catch(throw(oops), nomatch, true).`,
+		v:   "X",
+		exp: []string{},
+		err: Exception{atom("oops")},
+	},
+	{
+		q:   `catch(throw(_), error(E, _), true).`,
+		v:   "E",
+		exp: []string{"instantiation_error"},
+	},
+	{
+		q:   `catch(p(X), _, true), (X = a -> throw(found) ; true).`,
+		v:   "X",
+		exp: []string{},
+		err: Exception{atom("found")},
+	},
+	{
+		q:   `call((p(X) ; X = d)).`,
+		v:   "X",
+		exp: []string{"a", "b", "c", "d"},
+	},
+	{
+		q:   `G = p(X), call(G).`,
+		v:   "X",
+		exp: []string{"a", "b", "c"},
+	},
+	{
+		q:   `call((p(X), !)) ; X = d.`,
+		v:   "X",
+		exp: []string{"a", "d"},
+	},
+	{
+		q:   `call(X).`,
+		v:   "X",
+		exp: []string{},
+		err: InstantiationError{},
+	},
+	{
+		q:   `catch(call((fails, 1)), error(E, _), true).`,
+		v:   "E",
+		exp: []string{"type_error(callable,,(fails,1))"},
+	},
+	{
+		q:   `catch(call(X), error(E, _), true).`,
+		v:   "E",
+		exp: []string{"instantiation_error"},
+	},
+	{
+		q:   `callit(p(X)).`,
+		v:   "X",
+		exp: []string{"a", "b", "c"},
+	},
+	{
+		q:   `G = p(X), G.`,
+		v:   "X",
+		exp: []string{"a", "b", "c"},
+	},
+	{
+		q:   `call((G = p(X), G)).`,
+		v:   "X",
+		exp: []string{"a", "b", "c"},
+	},
+	{
+		q:   `call((fail, _)).`,
+		v:   "X",
+		exp: []string{},
+	},
+	{
+		q:   `catch(callit(_), error(E, _), true).`,
+		v:   "E",
+		exp: []string{"instantiation_error"},
+	},
+	{
+		q:   `catch(notcallable, error(E, _), true).`,
+		v:   "E",
+		exp: []string{"type_error(callable,1)"},
+	},
+	{
+		q:   `catch(loop, error(resource_error(R), _), true).`,
+		v:   "R",
+		exp: []string{"stack"},
+	},
+}
+
+func TestExceptions(t *testing.T) {
+	for _, st := range extests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `p(a). p(b). p(c). X = X. fails :- fail. loop :- loop, p(_). callit(G) :- G. notcallable :- fails ; 1.`)
+			m.MaxStack = 1000
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
+
+func TestExceptionTypes(t *testing.T) {
+	m := loadProgram(t, `p(a).`)
+	_, err := allSolutions(t, m, `call(1).`, "X")
+
+	var te TypeError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected a type error, got %v", err)
+	}
+	if te.Type != "callable" || term.Format(te.Culprit) != "1" {
+		t.Fatalf("expected type_error(callable, 1), got %v", te)
+	}
+}
+
+func TestExceptionUncaughtExistence(t *testing.T) {
+	m := loadProgram(t, `p(a).`)
+	_, exp := allSolutions(t, m, `'foo bar'(1).`, "X")
+	_, err := allSolutions(t, m, `catch('foo bar'(1), E, throw(E)).`, "X")
+
+	if _, ok := exp.(ExistenceError); !ok {
+		t.Fatalf("expected an existence error, got %v", exp)
+	}
+	if err != exp {
+		t.Fatalf("expected %v, got %v", exp, err)
+	}
+
+	// only an atom names a procedure
+	_, err = allSolutions(t, m, `throw(error(existence_error(procedure, f(x)/1), _)).`, "X")
+	if _, ok := err.(Exception); !ok {
+		t.Fatalf("expected an exception, got %v", err)
+	}
+}
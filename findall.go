@@ -0,0 +1,231 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// All solutions
+//
+// findall/3 pushes an environment, holding the continuation of the
+// call, and a choice point whose alternative completes the findall,
+// before calling its goal. The goal returns through findall_collect,
+// which copies the template off the heap into the choice point, and
+// then fails into the goal's next solution. Once the goal has no more
+// solutions, the machine backtracks to the findall's choice point,
+// which builds the list of the copies, and returns to the
+// continuation.
+//
+// bagof/3, setof/3 and aggregate_all/3 are written in Prolog, in the
+// library, on top of findall/3.
+
+// findall implements findall(Template, Goal, Bag), and
+// findall(Template, Goal, Bag, Tail)
+func findall(m *Machine) {
+	if !m.isPartialList(m.regPtr(X(2))) {
+		m.throw(TypeError{"list", m.culprit(m.regPtr(X(2)))})
+		return
+	}
+	collect, exit := m.findallCode()
+	n := m.NumArgs
+	if !m.allocate(0) || !m.reserveFrame() {
+		return
+	}
+	m.pushChoicePoint(exit, n)
+	m.OrStack[m.BReg].Findall = true
+	m.CPReg = collect
+	m.setReg(X(0), m.getReg(X(1)))
+	m.callGoal()
+}
+
+// isPartialList reports whether the term at a is a list, or a list
+// whose tail is unbound.
+func (m *Machine) isPartialList(a Addr) bool {
+	for n := 0; n <= m.HReg; n++ {
+		a = m.deref(a)
+		switch c := m.cell(a); c.Tag() {
+		case REF:
+			return true
+		case CON:
+			return c.Atom() == atomNil
+		case LIS:
+			a = c.Addr() + 1
+		default:
+			return false
+		}
+	}
+	// a list longer than the heap must be cyclic
+	return false
+}
+
+// FindallCollect copies the template of the active findall/3 into
+// its choice point, and backtracks for the next solution.
+func FindallCollect() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		b := m.activeFindall()
+		m.setReg(X(0), b.Args[0])
+		t, err := m.decode(m.regPtr(X(0)), map[Addr]bool{})
+		if err != nil {
+			m.stop(err)
+			return nil, ""
+		}
+		b.Found = append(b.Found, t)
+		m.fail()
+		return nil, ""
+	}, "findall_collect"
+}
+
+// FindallExit discards the choice point of the findall/3 whose goal
+// has no more solutions, and unifies its bag with the solutions
+// collected.
+func FindallExit() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		b := m.OrStack[m.BReg]
+		m.popChoicePoint()
+
+		cs := make([]Cell, len(b.Found))
+		for i, t := range b.Found {
+			c, ok := m.encode(t, map[term.Variable]Cell{})
+			if !ok {
+				return nil, ""
+			}
+			cs[i] = c
+		}
+		tail := atomCell(atomNil)
+		if len(b.Args) == 4 {
+			tail = b.Args[3]
+		}
+		l, ok := m.newList(cs, tail)
+		if !ok {
+			return nil, ""
+		}
+		m.setReg(X(3), l)
+		m.unify(m.regPtr(X(2)), m.regPtr(X(3)))
+		return nil, ""
+	}, "findall_exit"
+}
+
+// activeFindall returns the choice point of the findall/3 whose goal
+// has just succeeded, the findall's environment is current.
+func (m *Machine) activeFindall() *ChoicePoint {
+	for b := m.BReg; b >= 0; b-- {
+		if cp := m.OrStack[b]; cp.Findall && cp.E == m.EReg {
+			return cp
+		}
+	}
+	panic(fmt.Errorf("findall_collect without a findall"))
+}
+
+// findallCode returns the addresses of the code that findall/3
+// returns through, and that completes it on backtracking.
+func (m *Machine) findallCode() (int, int) {
+	l, ok := m.dynCode["$findall"]
+	if !ok {
+		l = m.addCode("$findall", CodeCells{
+			cc(FindallCollect()),
+			cc(FindallExit()),
+			cc(Deallocate()),
+			cc(Proceeed()),
+		})
+	}
+	return l, l + 1
+}
+
+// freeVariableSet implements '$free_variable_set'(Template^Goal,
+// Goal1, Witness), as used by bagof/3. Goal1 is Goal without its
+// existential quantifiers, V^G, and Witness is v(V1, ...) holding the
+// variables of Goal1 that occur in neither Template nor a quantifier,
+// or v if there are none.
+func freeVariableSet(m *Machine) {
+	caret := NewFunctor("^", 2)
+	a := m.derefReg(0)
+	c := m.cell(a)
+	if c.Tag() != STR || m.cell(c.Addr()).Functor() != caret {
+		m.throw(TypeError{"callable", m.culprit(a)})
+		return
+	}
+
+	bound := map[Addr]bool{}
+	m.termVars(c.Addr()+1, bound)
+	g := m.deref(c.Addr() + 2)
+	for gc := m.cell(g); gc.Tag() == STR && m.cell(gc.Addr()).Functor() == caret; gc = m.cell(g) {
+		m.termVars(gc.Addr()+1, bound)
+		g = m.deref(gc.Addr() + 2)
+	}
+
+	free := []Addr{}
+	for _, v := range m.termVars(g, map[Addr]bool{}) {
+		if !bound[v] {
+			free = append(free, v)
+		}
+	}
+
+	w := atomCell(Intern("v"))
+	if len(free) > 0 {
+		if !m.reserve(1 + len(free)) {
+			return
+		}
+		h := m.HReg
+		m.Heap[h] = funCell(NewFunctor("v", len(free)))
+		for i, v := range free {
+			m.Heap[h+1+i] = refCell(v)
+		}
+		m.HReg = h + 1 + len(free)
+		w = strCell(heapAddr(h))
+	}
+
+	m.setReg(X(3), m.cell(g))
+	m.setReg(X(4), w)
+	if !m.unifies(m.regPtr(X(1)), m.regPtr(X(3))) || !m.unifies(m.regPtr(X(2)), m.regPtr(X(4))) {
+		m.fail()
+	}
+}
+
+// termVars returns the variables of the term at a, in depth-first,
+// left to right order, that are not already in seen, and adds them to
+// seen.
+func (m *Machine) termVars(a Addr, seen map[Addr]bool) []Addr {
+	vs := []Addr{}
+	visited := map[Addr]bool{}
+	todo := []Addr{a}
+	for len(todo) > 0 {
+		a := m.deref(todo[len(todo)-1])
+		todo = todo[:len(todo)-1]
+		switch c := m.cell(a); c.Tag() {
+		case REF:
+			if !seen[a] {
+				seen[a] = true
+				vs = append(vs, a)
+			}
+		case LIS, STR:
+			// structures are only visited once, so that cyclic
+			// terms terminate
+			if visited[c.Addr()] {
+				continue
+			}
+			visited[c.Addr()] = true
+			args, n := c.Addr(), 2
+			if c.Tag() == STR {
+				args, n = c.Addr()+1, m.cell(c.Addr()).Arity()
+			}
+			for i := n - 1; i >= 0; i-- {
+				todo = append(todo, args+Addr(i))
+			}
+		}
+	}
+	return vs
+}
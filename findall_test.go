@@ -0,0 +1,103 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+var findalltests = []atest{
+	{q: `findall(X, p(X), L).`, v: "L", exp: []string{"[1,2,3]"}},
+	{q: `findall(X-Y, (p(X), Y is X * 2), L).`, v: "L", exp: []string{"[-(1,2),-(2,4),-(3,6)]"}},
+	{q: `findall(X, fail, L).`, v: "L", exp: []string{"[]"}},
+	{q: `findall(X, p(X), L, [end]).`, v: "L", exp: []string{"[1,2,3,end]"}},
+	{q: `findall(X, p(X), L, T), var(T), T = [end].`, v: "L", exp: []string{"[1,2,3,end]"}},
+	{q: `findall(X, p(X), [1, Y, 3]).`, v: "Y", exp: []string{"2"}},
+	{q: `findall(X, p(X), [1, 2]), Y = yes.`, v: "Y", exp: []string{}},
+	{q: `findall(X, (p(X), !), L).`, v: "L", exp: []string{"[1]"}},
+	{q: `findall(X, (p(X) ; X = 4), L).`, v: "L", exp: []string{"[1,2,3,4]"}},
+	{q: `findall(f(Y), p(_), [f(A), f(B), f(C)]), A \== B, B \== C, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `findall(f(Y, Y), p(_), [f(A, B)|_]), A == B, X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `findall(L, (p(X), findall(Y, (p(Y), Y =< X), L)), Ls).`, v: "Ls", exp: []string{"[[1],[1,2],[1,2,3]]"}},
+	{q: `p(X), findall(Y, (p(Y), Y > X), L).`, v: "L", exp: []string{"[2,3]", "[3]", "[]"}},
+	{q: `catch(findall(X, (p(X), X > 1, throw(oops)), L), oops, L = caught).`, v: "L", exp: []string{"caught"}},
+	{q: `findall(X, G, L).`, v: "L", exp: []string{}, err: InstantiationError{}},
+	{q: `findall(X, 1, L).`, v: "L", exp: []string{}, err: TypeError{"callable", numTerm(int64(1))}},
+	{q: `findall(X, p(X), foo).`, v: "L", exp: []string{}, err: TypeError{"list", atom("foo")}},
+	{q: `findall(X, p(X), [a|b]).`, v: "L", exp: []string{}, err: TypeError{"list", term.NewCallable("cons", []term.Term{atom("a"), atom("b")})}},
+
+	{q: `bagof(N, age(N, A), L), R = A-L.`, v: "R", exp: []string{"-(5,[tom])", "-(7,[peter])", "-(8,[pat])", "-(11,[ann,mike])"}},
+	{q: `bagof(N, A^age(N, A), L).`, v: "L", exp: []string{"[peter,ann,pat,tom,mike]"}},
+	{q: `bagof(N-C, A^B^ (age(N, A), class(N, B, C)), L).`, v: "L", exp: []string{"[-(peter,c1),-(ann,c2)]"}},
+	{q: `bagof(N, X^fail, L).`, v: "L", exp: []string{}},
+	{q: `bagof(X, member2(X, [A, B, A]), L), L == [A, B, A], A \== B, R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `bagof(X, X = Y, L), Y = 1.`, v: "L", exp: []string{"[1]"}},
+	{q: `bagof(K, pair(K, V), L), (var(V) -> R = free-L ; R = V-L).`, v: "R", exp: []string{"-(free,[a,c])", "-(1,[b])"}},
+	{q: `bagof(X, G, L).`, v: "L", exp: []string{}, err: InstantiationError{}},
+	{q: `setof(N, A^age(N, A), L).`, v: "L", exp: []string{"[ann,mike,pat,peter,tom]"}},
+	{q: `setof(A-N, age(N, A), L).`, v: "L", exp: []string{"[-(5,tom),-(7,peter),-(8,pat),-(11,ann),-(11,mike)]"}},
+	{q: `setof(N, age(N, A), L), R = A-L.`, v: "R", exp: []string{"-(5,[tom])", "-(7,[peter])", "-(8,[pat])", "-(11,[ann,mike])"}},
+	{q: `setof(A, N^age(N, A), L).`, v: "L", exp: []string{"[5,7,8,11]"}},
+	{q: `setof(X, fail, L).`, v: "L", exp: []string{}},
+	{q: `_ ^ p(1), X = yes.`, v: "X", exp: []string{"yes"}},
+
+	{q: `f(A, B) =@= f(C, D), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `f(A, A) =@= f(C, D), X = yes.`, v: "X", exp: []string{}},
+	{q: `f(A, B) =@= f(C, C), X = yes.`, v: "X", exp: []string{}},
+	{q: `f(A, b) \=@= f(C, c), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `[A, 1.0] =@= [B, 1], X = yes.`, v: "X", exp: []string{}},
+
+	{q: `aggregate_all(count, age(_, _), C).`, v: "C", exp: []string{"5"}},
+	{q: `aggregate_all(count, fail, C).`, v: "C", exp: []string{"0"}},
+	{q: `aggregate_all(sum(A), age(_, A), S).`, v: "S", exp: []string{"42"}},
+	{q: `aggregate_all(sum(A * 2), age(_, A), S).`, v: "S", exp: []string{"84"}},
+	{q: `aggregate_all(sum(A), fail, S).`, v: "S", exp: []string{"0"}},
+	{q: `aggregate_all(max(A), age(_, A), M).`, v: "M", exp: []string{"11"}},
+	{q: `aggregate_all(min(A), age(_, A), M).`, v: "M", exp: []string{"5"}},
+	{q: `aggregate_all(max(A), fail, M).`, v: "M", exp: []string{}},
+	{q: `aggregate_all(max(N), age(N, _), M).`, v: "M", exp: []string{"tom"}},
+	{q: `aggregate_all(min(N), age(N, _), M).`, v: "M", exp: []string{"ann"}},
+	{q: `aggregate_all(max(X), member2(X, [1, 2.5, 2]), M).`, v: "M", exp: []string{"2.5"}},
+	{q: `aggregate_all(bag(N), age(N, 11), L).`, v: "L", exp: []string{"[ann,mike]"}},
+	{q: `aggregate_all(set(A), age(_, A), L).`, v: "L", exp: []string{"[5,7,8,11]"}},
+	{q: `aggregate_all(count, age(_, _), 5), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `aggregate_all(S, true, C).`, v: "C", exp: []string{}, err: InstantiationError{}},
+	{q: `aggregate_all(foo, true, C).`, v: "C", exp: []string{}, err: DomainError{"aggregate_spec", atom("foo")}},
+}
+
+func TestFindall(t *testing.T) {
+	for _, st := range findalltests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `
+p(1). p(2). p(3).
+age(peter, 7). age(ann, 11). age(pat, 8). age(tom, 5). age(mike, 11).
+class(peter, x, c1). class(ann, y, c2).
+pair(a, _). pair(b, 1). pair(c, _).
+member2(X, [X|_]).
+member2(X, [_|T]) :- member2(X, T).
+`)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
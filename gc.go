@@ -0,0 +1,229 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+// The heap is garbage collected by a sliding mark-compact collector.
+// Live cells are marked by tracing from the roots: the argument
+// registers of the call being made, the permanent variables of the
+// environments, the arguments saved in choice points, and the trail,
+// both the cells it refers to and the values it will restore.
+// Live cells are then slid down to the bottom of the heap, and the
+// number table is compacted to the numbers that are still referred
+// to. Sliding keeps cells in the order they were created, so the
+// saved heap tops of choice points, and HB, can be moved with the
+// cells below them, and the age ordering used when binding and
+// trailing variables still holds after a collection.
+//
+// Collections only happen when a call is made, at which point the
+// only live registers are the arguments of the call.
+
+// maybeCollect runs the collector if the heap has grown past the
+// collection threshold, n is the number of argument registers that
+// are live.
+func (m *Machine) maybeCollect(n int) {
+	if m.GCThreshold <= 0 || m.HReg <= m.GCThreshold || m.HReg <= m.gcNext {
+		return
+	}
+	m.collect(n)
+	// Avoid collecting repeatedly when most of the heap is live, but
+	// leave room to collect again before MaxHeap is reached.
+	m.gcNext = 2 * m.HReg
+	if m.MaxHeap > 0 && m.gcNext > (m.MaxHeap+m.HReg)/2 {
+		m.gcNext = (m.MaxHeap + m.HReg) / 2
+	}
+}
+
+// collect compacts the heap, discarding any cells that are not
+// reachable from the roots, n is the number of argument registers
+// that are live.
+func (m *Machine) collect(n int) {
+	h := m.HReg
+	marked := m.mark(n)
+
+	// fwd[i] is the new address of the cell at i, which is the number
+	// of live cells below it. fwd[h] is the new top of the heap.
+	fwd := make([]int, h+1)
+	live := 0
+	for i := 0; i < h; i++ {
+		fwd[i] = live
+		if marked[i] {
+			live++
+		}
+	}
+	fwd[h] = live
+	nfwd := m.nums.compact(m.liveNumbers(marked))
+
+	reloc := func(c Cell) Cell {
+		switch c.Tag() {
+		case REF, STR, LIS:
+			a := c.Addr()
+			if a.area() != heapArea || a.offset() >= h {
+				return c
+			}
+			return Cell(heapAddr(fwd[a.offset()]))<<tagBits | Cell(c.Tag())
+		case NUM:
+			if c.numIndex() >= len(nfwd) {
+				return c
+			}
+			return numIndexCell(c.numKind(), nfwd[c.numIndex()])
+		default:
+			return c
+		}
+	}
+
+	for i := 0; i < h; i++ {
+		if marked[i] {
+			m.Heap[fwd[i]] = reloc(m.Heap[i])
+		}
+	}
+	for i := range m.XRegisters {
+		m.XRegisters[i] = reloc(m.XRegisters[i])
+	}
+	for i := range m.Stack {
+		m.Stack[i] = reloc(m.Stack[i])
+	}
+	for i := 0; i <= m.BReg; i++ {
+		b := m.OrStack[i]
+		for j := range b.Args {
+			b.Args[j] = reloc(b.Args[j])
+		}
+		b.H = fwd[b.H]
+	}
+	for i := 0; i < m.TRReg; i++ {
+		e := &m.Trail[i]
+		e.Addr = heapAddr(fwd[e.Addr.offset()])
+		e.Old = reloc(e.Old)
+	}
+
+	nb := m.nbArgs[:0]
+	for _, e := range m.nbArgs {
+		if a := e.Addr.offset(); a < h && marked[a] {
+			nb = append(nb, nbArg{heapAddr(fwd[a]), e.Value})
+		}
+	}
+	m.nbArgs = nb
+
+	m.HBReg = fwd[m.HBReg]
+	m.HReg = live
+	m.GCCount++
+}
+
+// mark returns the set of heap cells reachable from the roots
+func (m *Machine) mark(n int) []bool {
+	h := m.HReg
+	marked := make([]bool, h)
+	todo := []Addr{}
+
+	// follow queues the cell that c refers to, if any
+	follow := func(c Cell) {
+		switch c.Tag() {
+		case REF, STR:
+			todo = append(todo, c.Addr())
+		case LIS:
+			todo = append(todo, c.Addr(), c.Addr()+1)
+		}
+	}
+
+	for i := 0; i < n && i < len(m.XRegisters); i++ {
+		follow(m.XRegisters[i])
+	}
+	for _, e := range m.liveEnvironments() {
+		for _, c := range m.Stack[e.Y : e.Y+e.N] {
+			follow(c)
+		}
+	}
+	for i := 0; i <= m.BReg; i++ {
+		for _, c := range m.OrStack[i].Args {
+			follow(c)
+		}
+	}
+	for _, e := range m.Trail[:m.TRReg] {
+		todo = append(todo, e.Addr)
+		follow(e.Old)
+	}
+
+	for len(todo) > 0 {
+		a := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if a.area() != heapArea || a.offset() >= h || marked[a.offset()] {
+			continue
+		}
+		marked[a.offset()] = true
+
+		c := m.Heap[a.offset()]
+		if c.Tag() == FUN {
+			for i := 1; i <= c.Arity(); i++ {
+				todo = append(todo, a+Addr(i))
+			}
+			continue
+		}
+		follow(c)
+	}
+	return marked
+}
+
+// liveNumbers returns the set of entries in the number table that are
+// referred to by the marked heap cells, or by any of the cells that
+// are relocated by a collection. The registers and the stack may
+// hold stale cells from earlier queries, whose numbers are no longer
+// in the table.
+func (m *Machine) liveNumbers(marked []bool) []bool {
+	live := make([]bool, len(m.nums.nums))
+	see := func(c Cell) {
+		if c.Tag() == NUM && c.numIndex() < len(live) {
+			live[c.numIndex()] = true
+		}
+	}
+
+	for i, ok := range marked {
+		if ok {
+			see(m.Heap[i])
+		}
+	}
+	for _, c := range m.XRegisters {
+		see(c)
+	}
+	for _, c := range m.Stack {
+		see(c)
+	}
+	for i := 0; i <= m.BReg; i++ {
+		for _, c := range m.OrStack[i].Args {
+			see(c)
+		}
+	}
+	for _, e := range m.Trail[:m.TRReg] {
+		see(e.Old)
+	}
+	return live
+}
+
+// liveEnvironments returns the environments reachable from the
+// current environment, or from the environments saved in choice
+// points.
+func (m *Machine) liveEnvironments() []*Environment {
+	seen := map[int]bool{}
+	es := []*Environment{}
+	walk := func(e int) {
+		for ; e >= 0 && !seen[e]; e = m.AndStack[e].CE {
+			seen[e] = true
+			es = append(es, m.AndStack[e])
+		}
+	}
+
+	walk(m.EReg)
+	for i := 0; i <= m.BReg; i++ {
+		walk(m.OrStack[i].E)
+	}
+	return es
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// nat returns the Prolog text of the successor number n
+func nat(n int) string {
+	return strings.Repeat("s(", n) + "z" + strings.Repeat(")", n)
+}
+
+const gcProgram = `
+junk(X, X).
+pick(a).
+pick(b).
+copy(z, z).
+copy(s(N), s(M)) :- junk(f(N,N,N), _), copy(N, M).
+walk(z, done).
+walk(s(N), R) :- junk(f(N,N,N), _), walk(N, R).
+twice(N, X) :- pick(X), walk(N, _).
+`
+
+func TestGC(t *testing.T) {
+	gtests := []struct {
+		q   string
+		v   term.Variable
+		exp []string
+	}{
+		{"walk(" + nat(2000) + ",R).", "R", []string{"done"}},
+		{"copy(" + nat(500) + ",R).", "R", []string{nat(500)}},
+		{"twice(" + nat(2000) + ",X).", "X", []string{"a", "b"}},
+	}
+
+	for _, st := range gtests {
+		t.Run(st.q[:10], func(t *testing.T) {
+			m := loadProgram(t, gcProgram)
+			m.GCThreshold = 200
+			m.MaxHeap = 7000
+
+			res, err := allSolutions(t, m, st.q, st.v)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+			if m.GCCount == 0 {
+				t.Fatalf("expected the collector to run")
+			}
+		})
+	}
+}
+
+func TestGCDisabled(t *testing.T) {
+	m := loadProgram(t, gcProgram)
+	m.GCThreshold = 0
+	m.MaxHeap = 7000
+
+	_, err := allSolutions(t, m, "walk("+nat(2000)+",R).", "R")
+	if err != (ResourceError{"heap"}) {
+		t.Fatalf("expected a heap resource error, got %v", err)
+	}
+}
+
+func TestGCNumbers(t *testing.T) {
+	m := loadProgram(t, `
+count(N, N, X, X) :- !.
+count(I, N, X0, X) :- X1 is X0 + 0.5, I1 is I + 1, count(I1, N, X1, X).
+sub(A, B, A-B).
+`)
+	m.GCThreshold = 200
+
+	res, err := allSolutions(t, m, `B is 1 << 100, count(0, 20000, 0.0, X), sub(B, X, R).`, "R")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if exp := []string{"-(1267650600228229401496703205376,10000.0)"}; !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v, got %v", exp, res)
+	}
+	if m.GCCount == 0 {
+		t.Fatalf("expected the collector to run")
+	}
+	if n := len(m.nums.nums); n > 1000 {
+		t.Fatalf("expected unused numbers to be collected, %d remain", n)
+	}
+}
@@ -1 +1,3 @@
 module github.com/tcolgate/golorp
+
+go 1.21
@@ -0,0 +1,189 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/tcolgate/golorp/context"
+	"github.com/tcolgate/golorp/parse"
+	"github.com/tcolgate/golorp/scan"
+)
+
+// The library holds predicates that are written in Prolog. They are
+// compiled once, and linked into the code of a query the first time
+// one of them is called. Predicates defined by the program take
+// precedence over those in the library.
+
+var librarySource = `
+X = X.
+
+predsort(P, L, Sorted) :- '$predsort'(P, L, Sorted).
+
+'$predsort'(_, [], []) :- !.
+'$predsort'(_, [X], [X]) :- !.
+'$predsort'(P, L, Sorted) :-
+	'$halve'(L, L1, L2),
+	'$predsort'(P, L1, S1),
+	'$predsort'(P, L2, S2),
+	'$predmerge'(P, S1, S2, Sorted).
+
+'$halve'([], [], []).
+'$halve'([X|Xs], [X|Ys], Zs) :- '$halve'(Xs, Zs, Ys).
+
+'$predmerge'(_, [], L, L) :- !.
+'$predmerge'(_, L, [], L) :- !.
+'$predmerge'(P, [H1|T1], [H2|T2], Merged) :-
+	call(P, Delta, H1, H2),
+	'$predmerge'(Delta, P, H1, H2, T1, T2, Merged).
+
+'$predmerge'(<, P, H1, H2, T1, T2, [H1|Merged]) :-
+	'$predmerge'(P, T1, [H2|T2], Merged).
+'$predmerge'(=, P, H1, _, T1, T2, [H1|Merged]) :-
+	'$predmerge'(P, T1, T2, Merged).
+'$predmerge'(>, P, H1, H2, T1, T2, [H2|Merged]) :-
+	'$predmerge'(P, [H1|T1], T2, Merged).
+
+_ ^ Goal :- call(Goal).
+
+bagof(Template, Goal, Bag) :-
+	'$free_variable_set'(Template^Goal, Goal1, Witness),
+	(   Witness == v
+	->  findall(Template, Goal1, Bag),
+	    Bag \== []
+	;   findall(Witness-Template, Goal1, Pairs),
+	    Pairs \== [],
+	    sort(1, @=<, Pairs, Sorted),
+	    '$bagof_pick'(Sorted, Witness, Bag)
+	).
+
+% '$bagof_pick' takes the solutions whose witnesses are variants of the
+% first, unifying their witnesses, then backtracks over the rest.
+'$bagof_pick'([W0-T0|Pairs], Witness, Bag) :-
+	'$bagof_partition'(Pairs, W0, Ts, Rest),
+	(   Witness = W0,
+	    Bag = [T0|Ts]
+	;   Rest \== [],
+	    '$bagof_pick'(Rest, Witness, Bag)
+	).
+
+'$bagof_partition'([], _, [], []).
+'$bagof_partition'([W-T|Pairs], W0, [T|Ts], Rest) :-
+	W =@= W0, !,
+	W = W0,
+	'$bagof_partition'(Pairs, W0, Ts, Rest).
+'$bagof_partition'([Pair|Pairs], W0, Ts, [Pair|Rest]) :-
+	'$bagof_partition'(Pairs, W0, Ts, Rest).
+
+setof(Template, Goal, Set) :-
+	bagof(Template, Goal, Bag),
+	sort(Bag, Set).
+
+aggregate_all(Spec, _, _) :-
+	var(Spec), !,
+	throw(error(instantiation_error, _)).
+aggregate_all(count, Goal, Count) :- !,
+	findall(x, Goal, Xs),
+	'$aggregate_count'(Xs, 0, Count).
+aggregate_all(sum(E), Goal, Sum) :- !,
+	findall(E, Goal, Es),
+	'$aggregate_sum'(Es, 0, Sum).
+aggregate_all(max(E), Goal, Max) :- !,
+	findall(E, Goal, [E0|Es]),
+	'$aggregate_max'(Es, E0, Max).
+aggregate_all(min(E), Goal, Min) :- !,
+	findall(E, Goal, [E0|Es]),
+	'$aggregate_min'(Es, E0, Min).
+aggregate_all(bag(T), Goal, Bag) :- !,
+	findall(T, Goal, Bag).
+aggregate_all(set(T), Goal, Set) :- !,
+	findall(T, Goal, Bag),
+	sort(Bag, Set).
+aggregate_all(Spec, _, _) :-
+	throw(error(domain_error(aggregate_spec, Spec), _)).
+
+'$aggregate_count'([], N, N).
+'$aggregate_count'([_|Xs], N0, N) :-
+	N1 is N0 + 1,
+	'$aggregate_count'(Xs, N1, N).
+
+'$aggregate_sum'([], S, S).
+'$aggregate_sum'([E|Es], S0, S) :-
+	S1 is S0 + E,
+	'$aggregate_sum'(Es, S1, S).
+
+% Numbers are compared by value, other terms in the standard order.
+'$aggregate_max'([], M, M).
+'$aggregate_max'([E|Es], M0, M) :-
+	(   number(M0), number(E)
+	->  M1 is max(M0, E)
+	;   E @> M0
+	->  M1 = E
+	;   M1 = M0
+	),
+	'$aggregate_max'(Es, M1, M).
+
+'$aggregate_min'([], M, M).
+'$aggregate_min'([E|Es], M0, M) :-
+	(   number(M0), number(E)
+	->  M1 is min(M0, E)
+	;   E @< M0
+	->  M1 = E
+	;   M1 = M0
+	),
+	'$aggregate_min'(Es, M1, M).
+`
+
+// library is compiled by init, as the code it holds refers back to it
+var library *predTable
+
+func init() {
+	library = compileLibrary(librarySource)
+}
+
+// compileLibrary compiles the clauses in src
+func compileLibrary(src string) *predTable {
+	var ctx context.Context
+	p := parse.New("library", scan.New(ctx, "library", bytes.NewBufferString(src)))
+	pt := newPredTable()
+	for {
+		t, err := p.NextTerm()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(fmt.Errorf("could not parse library, %s", err))
+		}
+		f, c := compileClause(t)
+		pt.add(f, c)
+	}
+	return pt
+}
+
+// libraryLabel returns the address of the library predicate f, the
+// library is linked into the code of the query if it has not been
+// already.
+func (m *Machine) libraryLabel(f Functor) (int, bool) {
+	if _, ok := library.preds[f]; !ok {
+		return 0, false
+	}
+	if m.libLabels == nil {
+		code, labels := library.link(len(m.Code))
+		m.Code = append(m.Code, code...)
+		m.libLabels = labels
+	}
+	return m.libLabels[f], true
+}
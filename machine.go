@@ -15,80 +15,12 @@ package golorp
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/tcolgate/golorp/term"
 )
 
-// Cell implements an interface for items that can be stored on the heap
-type Cell interface {
-	IsCell()
-	fmt.Stringer
-}
-
-type CellPtr struct {
-	Store  *[]Cell
-	Offset int
-}
-
-func (c CellPtr) Cell() Cell {
-	return (*c.Store)[c.Offset]
-}
-
-func (c CellPtr) IsSelf() bool {
-	if r, ok := c.Cell().(RefCell); ok {
-		return r.Ptr.Store == c.Store && r.Ptr.Offset == c.Offset
-	}
-	return false
-}
-
-func (cp CellPtr) String() string {
-	return fmt.Sprintf("PTR %v:%d", cp.Store, cp.Offset)
-}
-
-func (cp CellPtr) Deref() Cell {
-	return (*cp.Store)[cp.Offset]
-}
-
-// RefCell is a a heap cell containing a reference to another cell
-type RefCell struct {
-	Ptr CellPtr
-}
-
-// IsCell marks RefCell as a valid heap Cell
-func (RefCell) IsCell() {
-}
-
-func (c RefCell) String() string {
-	return fmt.Sprintf("REF %p:%d", c.Ptr.Store, c.Ptr.Offset)
-}
-
-// StrCell is a structure header cell
-type StrCell struct {
-	Ptr CellPtr
-}
-
-// IsCell marks StrCell as a valid heap Cell
-func (StrCell) IsCell() {
-}
-
-func (c StrCell) String() string {
-	return fmt.Sprintf("STR %p:%d", c.Ptr.Store, c.Ptr.Offset)
-}
-
-// FuncCell is not tagged in WAM-Book, but we need a type
-type FuncCell struct {
-	Atom term.Atom
-	n    int
-}
-
-// IsCell marks FuncCell as a valid heap Cell
-func (FuncCell) IsCell() {
-}
-
-func (c FuncCell) String() string {
-	return fmt.Sprintf("%s/%d", c.Atom, c.n)
-}
-
 // HeapCells is a utility type to format a slice of
 // cells as a heap
 type HeapCells []Cell
@@ -114,7 +46,7 @@ func (cs RegCells) String() string {
 }
 
 type PDL struct {
-	cells []CellPtr
+	cells []Addr
 }
 
 func (p *PDL) isEmpty() bool {
@@ -124,11 +56,11 @@ func (p *PDL) isEmpty() bool {
 	return true
 }
 
-func (p *PDL) push(a CellPtr) {
+func (p *PDL) push(a Addr) {
 	p.cells = append(p.cells, a)
 }
 
-func (p *PDL) pop() CellPtr {
+func (p *PDL) pop() Addr {
 	a := p.cells[len(p.cells)-1]
 	p.cells = p.cells[:len(p.cells)-1]
 	return a
@@ -144,6 +76,11 @@ type Machine struct {
 	// We use to stop on failure
 	Finished bool
 	Failed   bool
+	// Err is set if the query was stopped by an error
+	Err error
+	// ball is the exception raised by the current instruction, it
+	// is thrown once the instruction completes
+	ball term.Term
 	// M0
 	Heap       []Cell
 	XRegisters []Cell
@@ -153,31 +90,80 @@ type Machine struct {
 	PDL        PDL
 
 	// M1
-	Code   []Cell
-	Labels map[string]int
+	Code   CodeCells
+	Labels map[Functor]int
 
 	PReg int
 
+	// Debug causes each instruction to be printed as it is executed
+	Debug bool
+
 	// M2
-	AndStack []Environment
+	AndStack []*Environment
+	Stack    []Cell // the permanent variables of the environments
 	EReg     int
 	CPReg    int
+	LiveReg  int // the permanent variables of E still in use
 
 	// M3 - Prolog
-	OrStack []ChoicePoint
-	Trail   []Cell
+	OrStack []*ChoicePoint
+	Trail   []TrailEntry
 	BReg    int
 	TRReg   int
 	GBReg   int
+	HBReg   int
+	NumArgs int // arity of the most recent call
+
+	// code compiled while a query runs, such as the bodies of goals
+	// passed to call/1, by key
+	dynCode map[string]int
+	// the labels of the library, once it has been linked into the
+	// code of the query
+	libLabels map[Functor]int
+	// the dynamic predicates, whose clauses are kept across queries
+	db map[Functor]*dynPred
+	// the numbers referred to by NUM cells
+	nums numTable
+	// the arguments changed by nb_setarg/3, whose values survive
+	// backtracking
+	nbArgs []nbArg
+
+	// Limits on the size of the machine's storage, zero means the
+	// storage grows without bound. A query that exceeds a limit is
+	// stopped with a ResourceError.
+	MaxHeap  int // cells on the heap
+	MaxStack int // environments and choice points
+	MaxTrail int // entries on the trail
+
+	// GCThreshold is the size the heap must reach before it is
+	// garbage collected, zero disables the collector.
+	GCThreshold int
+	GCCount     int // the number of collections run
+	gcNext      int // the heap size at which to collect next
 
 	// Optimisations
 }
 
+// initial sizes of the heap, register file and stack, all grow as
+// needed
+const (
+	initialHeap  = 1024
+	initialRegs  = 32
+	initialStack = 256
+
+	defaultGCThreshold = 1 << 20
+)
+
 func NewMachine() *Machine {
 	return &Machine{
-		Heap:       make([]Cell, 30),
-		XRegisters: make([]Cell, 10),
-		PDL:        PDL{[]CellPtr{}},
+		Heap:       make([]Cell, initialHeap),
+		XRegisters: make([]Cell, initialRegs),
+		Stack:      make([]Cell, initialStack),
+		PDL:        PDL{[]Addr{}},
+		EReg:       -1,
+		BReg:       -1,
+
+		GCThreshold: defaultGCThreshold,
 	}
 }
 
@@ -188,12 +174,107 @@ func (m *Machine) String() string {
 	str += "X Registers:\n"
 	str += fmt.Sprintf("%s\n", RegCells(m.XRegisters))
 	str += "Heap:\n"
-	str += fmt.Sprintf("%s\n", HeapCells(m.Heap))
+	str += fmt.Sprintf("%s\n", HeapCells(m.Heap[:m.HReg]))
+	str += fmt.Sprintf("E: %d CP: %d Live: %d\n", m.EReg, m.CPReg, m.LiveReg)
+	str += "Environments:\n"
+	for i := m.EReg; i >= 0; i = m.AndStack[i].CE {
+		e := m.AndStack[i]
+		str += fmt.Sprintf("%d %s", i, e)
+		for j := 0; j < e.N; j++ {
+			str += fmt.Sprintf(" Y%d = %s", j, m.Stack[e.Y+j])
+		}
+		str += "\n"
+	}
+	str += fmt.Sprintf("B: %d HB: %d TR: %d\n", m.BReg, m.HBReg, m.TRReg)
+	str += "Choice Points:\n"
+	for i := m.BReg; i >= 0; i = m.OrStack[i].B {
+		str += fmt.Sprintf("%d %s\n", i, m.OrStack[i])
+	}
 	return str
 }
 
-type Environment Cell
-type ChoicePoint Cell
+// Environment is a frame on the AND stack, it holds the continuation
+// of the clause that allocated it, and its permanent variables.
+type Environment struct {
+	CE    int // the continuation environment
+	CP    int // the continuation point
+	CLive int // the permanent variables of CE still in use at CP
+	Y     int // the offset of the permanent variables on the stack
+	N     int // the number of permanent variables
+}
+
+func (e *Environment) String() string {
+	return fmt.Sprintf("CE: %d CP: %d CLive: %d Y: %d N: %d", e.CE, e.CP, e.CLive, e.Y, e.N)
+}
+
+// ChoicePoint is a frame on the OR stack, it holds the machine
+// state needed to resume execution at the next alternative clause.
+type ChoicePoint struct {
+	Args []Cell // the saved argument registers
+	E    int    // the environment at the time of the call
+	CP   int    // the continuation point of the call
+	Live int    // the permanent variables of E still in use
+	B    int    // the previous choice point
+	BP   int    // the next alternative clause
+	TR   int    // the top of the trail
+	H    int    // the top of the heap
+	ETop int    // the top of the environment stack
+	YTop int    // the top of the permanent variable stack
+	B0   int    // the cut level of the call
+
+	// the remaining clauses of a call to, or retract from, a dynamic
+	// predicate
+	Clauses []*dynClause
+
+	// the remaining sub atoms of a call to sub_atom/5 or atom_concat/3
+	Subs *subAtoms
+
+	Catch bool // the choice point was created by catch/3
+
+	// the solutions collected by the findall/3 that created the
+	// choice point
+	Findall bool
+	Found   []term.Term
+}
+
+func (b *ChoicePoint) String() string {
+	str := fmt.Sprintf("E: %d CP: %d B: %d BP: %d TR: %d H: %d", b.E, b.CP, b.B, b.BP, b.TR, b.H)
+	for i, c := range b.Args {
+		str += fmt.Sprintf(" A%d = %s", i, c)
+	}
+	return str
+}
+
+// RegType distinguishes temporary and permanent registers
+type RegType int
+
+const (
+	XReg RegType = iota // temporary, stored in the register file
+	YReg                // permanent, stored in the current environment
+)
+
+// Reg identifies a temporary (X) or permanent (Y) variable register
+type Reg struct {
+	Type RegType
+	N    int
+}
+
+// X returns a reference to the temporary register Xn
+func X(n int) Reg {
+	return Reg{XReg, n}
+}
+
+// Y returns a reference to the permanent register Yn
+func Y(n int) Reg {
+	return Reg{YReg, n}
+}
+
+func (r Reg) String() string {
+	if r.Type == YReg {
+		return fmt.Sprintf("Y%d", r.N)
+	}
+	return fmt.Sprintf("X%d", r.N)
+}
 
 type Instruction int
 type InstructionMode int
@@ -220,276 +301,956 @@ func (cs CodeCells) String() string {
 	return str
 }
 
-func (m *Machine) run(cs []CodeCell) {
-	for _, c := range cs {
-		fmt.Printf("%s\n", c.string)
+// Load installs a compiled program, and its labels, into the
+// machine. Any previously loaded program, and any dynamic clauses,
+// are discarded. The clauses of the program's dynamic predicates are
+// added by running its initialisation.
+func (m *Machine) Load(cs CodeCells, labels map[Functor]int) {
+	m.Code = cs
+	m.Labels = labels
+	m.db = map[Functor]*dynPred{}
+	if _, ok := labels[NewFunctor(initPred, 0)]; ok {
+		m.run(CodeCells{cc(Call(initPred, 0, 0)), cc(Halt())})
+	}
+}
+
+// run executes the query code cs against the loaded program,
+// stopping at the first solution, or when the query fails.
+func (m *Machine) run(cs CodeCells) {
+	sols := m.Query(cs)
+	sols.Next()
+	sols.Close()
+}
+
+// execute runs instructions from P until the machine halts or fails.
+func (m *Machine) execute() {
+	for !m.Finished {
+		if m.PReg < 0 || m.PReg >= len(m.Code) {
+			panic(fmt.Errorf("program counter out of range, %d", m.PReg))
+		}
+		c := m.Code[m.PReg]
+		if m.Debug {
+			fmt.Printf("%d: %s\n", m.PReg, c.string)
+		}
+		// Every instruction advances P, instructions that transfer
+		// control overwrite it.
+		m.PReg++
 		c.fn(m)
-		if m.Finished {
-			return
+		if m.ball != nil {
+			m.handle()
+		}
+	}
+}
+
+// store returns the storage area holding the address a
+func (m *Machine) store(a Addr) []Cell {
+	switch a.area() {
+	case heapArea:
+		return m.Heap
+	case regArea:
+		return m.XRegisters
+	default:
+		return m.Stack
+	}
+}
+
+// cell returns the contents of the cell at a
+func (m *Machine) cell(a Addr) Cell {
+	return m.store(a)[a.offset()]
+}
+
+// setCell stores c at the address a
+func (m *Machine) setCell(a Addr, c Cell) {
+	m.store(a)[a.offset()] = c
+}
+
+// regPtr returns the address of the storage for register r, the
+// X registers are grown to hold r if needed.
+func (m *Machine) regPtr(r Reg) Addr {
+	if r.Type == YReg {
+		return stackAddr(m.AndStack[m.EReg].Y + r.N)
+	}
+	if r.N >= len(m.XRegisters) {
+		m.XRegisters = append(m.XRegisters, make([]Cell, r.N+1)...)
+	}
+	return regAddr(r.N)
+}
+
+// reserve ensures there is room for n more cells at the top of the
+// heap. Cells refer to the heap by offset, so growing the slice
+// leaves them valid. If the heap would exceed MaxHeap the query is
+// stopped and reserve returns false.
+func (m *Machine) reserve(n int) bool {
+	need := m.HReg + n
+	if m.MaxHeap > 0 && need > m.MaxHeap {
+		m.throw(ResourceError{"heap"})
+		return false
+	}
+	if need > len(m.Heap) {
+		m.Heap = append(m.Heap, make([]Cell, need+len(m.Heap))...)
+	}
+	return true
+}
+
+// reserveFrame checks that another environment or choice point may
+// be pushed without exceeding MaxStack.
+func (m *Machine) reserveFrame() bool {
+	if m.MaxStack > 0 && m.envTop()+m.BReg+1 >= m.MaxStack {
+		m.throw(ResourceError{"stack"})
+		return false
+	}
+	return true
+}
+
+func (m *Machine) getReg(r Reg) Cell {
+	return m.cell(m.regPtr(r))
+}
+
+func (m *Machine) setReg(r Reg, c Cell) {
+	m.setCell(m.regPtr(r), c)
+}
+
+// fail backtracks to the most recent choice point, if there are
+// no choice points left the query has failed.
+func (m *Machine) fail() {
+	if m.BReg == -1 {
+		m.Failed = true
+		m.Finished = true
+		return
+	}
+	m.PReg = m.OrStack[m.BReg].BP
+}
+
+// throw raises err as a Prolog exception, see throwBall
+func (m *Machine) throw(err error) {
+	m.throwBall(errorBall(err))
+}
+
+// envTop returns the index of the first free slot on the AND stack,
+// environments below this are either live, or protected by a choice
+// point.
+func (m *Machine) envTop() int {
+	top := m.EReg + 1
+	if m.BReg != -1 && m.OrStack[m.BReg].ETop > top {
+		top = m.OrStack[m.BReg].ETop
+	}
+	return top
+}
+
+// stackTop returns the offset of the first free cell on the stack of
+// permanent variables. Only the live variables of the current
+// environment are protected, unless a choice point protects more.
+func (m *Machine) stackTop() int {
+	top := 0
+	if m.EReg != -1 {
+		top = m.AndStack[m.EReg].Y + m.LiveReg
+	}
+	if m.BReg != -1 && m.OrStack[m.BReg].YTop > top {
+		top = m.OrStack[m.BReg].YTop
+	}
+	return top
+}
+
+// TrailEntry records the value a heap cell held before it was
+// changed, so that it can be restored on backtracking.
+type TrailEntry struct {
+	Addr Addr
+	Old  Cell
+}
+
+// trail records a binding that must be undone on backtracking. Only
+// variables older than the most recent choice point need trailing.
+// If the trail is full, trail returns false, and the binding must not
+// be made.
+func (m *Machine) trail(a Addr) bool {
+	return m.trailCell(a, refCell(a))
+}
+
+// trailCell records that the cell at a held old before it is changed,
+// as trail does for bindings.
+func (m *Machine) trailCell(a Addr, old Cell) bool {
+	if a.area() == heapArea && a.offset() < m.HBReg {
+		if m.MaxTrail > 0 && m.TRReg >= m.MaxTrail {
+			m.throw(ResourceError{"trail"})
+			return false
 		}
+		m.Trail = append(m.Trail[:m.TRReg], TrailEntry{a, old})
+		m.TRReg = m.TRReg + 1
+	}
+	return true
+}
+
+// unwindTrail restores all cells changed since the trail was at tr
+func (m *Machine) unwindTrail(tr int) {
+	for i := m.TRReg - 1; i >= tr; i-- {
+		e := m.Trail[i]
+		m.setCell(e.Addr, e.Old)
 	}
-	m.Finished = true
+	m.TRReg = tr
+}
+
+// restoreChoicePoint resets the machine state to that saved in b
+func (m *Machine) restoreChoicePoint(b *ChoicePoint) {
+	copy(m.XRegisters, b.Args)
+	m.EReg = b.E
+	m.CPReg = b.CP
+	m.LiveReg = b.Live
+	m.GBReg = b.B0
+	m.unwindTrail(b.TR)
+	m.HReg = b.H
+	m.HBReg = m.HReg
+	m.restoreArgs()
 }
 
 // I0 - M0 insutrctions for L0
 
 func PutStructure(fn term.Atom, n, xi int) (machineFunc, string) {
+	f := funCell(NewFunctor(fn, n))
 	return func(m *Machine) (machineFunc, string) {
-		m.Heap[m.HReg] = StrCell{CellPtr{&m.Heap, m.HReg + 1}}
-		m.Heap[m.HReg+1] = FuncCell{fn, n}
-		m.XRegisters[xi] = m.Heap[m.HReg]
+		if !m.reserve(2) {
+			return nil, ""
+		}
+		m.Heap[m.HReg] = strCell(heapAddr(m.HReg + 1))
+		m.Heap[m.HReg+1] = f
+		m.setReg(X(xi), m.Heap[m.HReg])
 		m.HReg = m.HReg + 2
 		return nil, ""
 	}, fmt.Sprintf("put_structure %s/%d X%d", fn, n, xi)
 }
 
-func SetVariable(xi int) (machineFunc, string) {
+func SetVariable(vn Reg) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
-		m.Heap[m.HReg] = RefCell{CellPtr{&m.Heap, m.HReg}}
-		m.XRegisters[xi] = m.Heap[m.HReg]
+		if !m.reserve(1) {
+			return nil, ""
+		}
+		m.Heap[m.HReg] = refCell(heapAddr(m.HReg))
+		m.setReg(vn, m.Heap[m.HReg])
 		m.HReg = m.HReg + 1
 		return nil, ""
-	}, fmt.Sprintf("set_variable X%d", xi)
+	}, fmt.Sprintf("set_variable %s", vn)
 }
 
-func SetValue(xi int) (machineFunc, string) {
+func SetValue(vn Reg) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
-		m.Heap[m.HReg] = m.XRegisters[xi]
+		if !m.reserve(1) {
+			return nil, ""
+		}
+		m.Heap[m.HReg] = m.getReg(vn)
 		m.HReg = m.HReg + 1
 		return nil, ""
-	}, fmt.Sprintf("set_value X%d", xi)
+	}, fmt.Sprintf("set_value %s", vn)
 }
 
 func GetStructure(fn term.Atom, n, xi int) (machineFunc, string) {
+	f := funCell(NewFunctor(fn, n))
 	return func(m *Machine) (machineFunc, string) {
-		cp := m.derefReg(xi)
-		cc := cp.Deref()
+		a := m.derefReg(xi)
+		c := m.cell(a)
 
-		switch c := cc.(type) {
-		case RefCell:
-			m.Heap[m.HReg] = StrCell{CellPtr{&m.Heap, m.HReg + 1}}
-			m.Heap[m.HReg+1] = FuncCell{fn, n}
-			m.XRegisters[xi] = m.Heap[m.HReg]
-			m.bind(cp, CellPtr{&m.Heap, m.HReg})
+		switch c.Tag() {
+		case REF:
+			if !m.reserve(2) {
+				return nil, ""
+			}
+			m.Heap[m.HReg] = strCell(heapAddr(m.HReg + 1))
+			m.Heap[m.HReg+1] = f
+			m.setReg(X(xi), m.Heap[m.HReg])
+			m.bind(a, heapAddr(m.HReg))
 			m.HReg = m.HReg + 2
 			m.Mode = Write
-			fmt.Printf("IN HERE 0 %#v\n", cp.Deref())
-		case StrCell:
-			if tc, ok := m.Heap[c.Ptr.Offset].(FuncCell); ok && tc.Atom == fn && tc.n == n {
-				fmt.Printf("IN HERE 1 %v %v %v\n", ok, tc, fn)
-				m.SReg = c.Ptr.Offset + 1
+		case STR:
+			if m.cell(c.Addr()) == f {
+				m.SReg = c.Addr().offset() + 1
 				m.Mode = Read
 			} else {
-				fmt.Printf("IN HERE 2 %v %v %v\n", ok, tc, fn)
-				m.Finished = true
-				m.Failed = true
+				m.fail()
 			}
 		default:
-			fmt.Printf("IN HERE 3 %#v\n", c)
-			m.Finished = true
-			m.Failed = true
+			m.fail()
 		}
 		return nil, ""
 	}, fmt.Sprintf("get_structure %s/%d X%d", fn, n, xi)
 }
 
-func UnifyVariable(xi int) (machineFunc, string) {
+func UnifyVariable(vn Reg) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
 		switch m.Mode {
 		case Read:
-			m.XRegisters[xi] = m.Heap[m.SReg]
+			m.setReg(vn, m.Heap[m.SReg])
 		case Write:
-			m.Heap[m.HReg] = RefCell{CellPtr{&m.Heap, m.HReg}}
-			m.XRegisters[xi] = m.Heap[m.HReg]
+			if !m.reserve(1) {
+				return nil, ""
+			}
+			m.Heap[m.HReg] = refCell(heapAddr(m.HReg))
+			m.setReg(vn, m.Heap[m.HReg])
 			m.HReg = m.HReg + 1
 		default:
 			panic(fmt.Errorf("invalid read/write mode %v", m.Mode))
 		}
 		m.SReg = m.SReg + 1
 		return nil, ""
-	}, fmt.Sprintf("unify_variable X%d", xi)
+	}, fmt.Sprintf("unify_variable %s", vn)
 }
 
-func UnifyValue(xi int) (machineFunc, string) {
+func UnifyValue(vn Reg) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
 		switch m.Mode {
 		case Read:
-			m.unify(CellPtr{&m.XRegisters, xi}, CellPtr{&m.Heap, m.SReg})
+			m.unify(m.regPtr(vn), heapAddr(m.SReg))
 		case Write:
-			m.Heap[m.HReg] = m.XRegisters[xi]
+			if !m.reserve(1) {
+				return nil, ""
+			}
+			m.Heap[m.HReg] = m.getReg(vn)
 			m.HReg = m.HReg + 1
 		default:
 			panic(fmt.Errorf("invalid read/write mode %v", m.Mode))
 		}
 		m.SReg = m.SReg + 1
 		return nil, ""
-	}, fmt.Sprintf("unify_value X%d", xi)
+	}, fmt.Sprintf("unify_value %s", vn)
 }
 
-func (m *Machine) derefReg(xi int) CellPtr {
-	switch c := m.XRegisters[xi].(type) {
-	case RefCell:
-		return m.deref(c.Ptr)
-	default:
-		return CellPtr{&m.XRegisters, xi}
-	}
+func (m *Machine) derefReg(xi int) Addr {
+	return m.deref(m.regPtr(X(xi)))
 }
 
-func (m *Machine) deref(p CellPtr) CellPtr {
+func (m *Machine) deref(a Addr) Addr {
 	for {
-		switch c := (*p.Store)[p.Offset].(type) {
-		case RefCell:
-			if c.Ptr == p { // Ref Cell points to itself, unbound
-				return p
-			}
-			p = c.Ptr
-		default:
-			return p
+		c := m.cell(a)
+		if c.Tag() != REF || c.Addr() == a { // unbound, or not a reference
+			return a
 		}
+		a = c.Addr()
 	}
 }
 
-func (m *Machine) bind(a, b CellPtr) {
-	fmt.Printf("HEAP: %p\n", &m.Heap)
-	fmt.Printf("XReg: %p\n", &m.XRegisters)
-	fmt.Printf("PDL: %p\n", &m.PDL)
-	fmt.Printf("BIND: %#v %#v\n", a, b)
-	_, ok1 := (*a.Store)[a.Offset].(RefCell)
-	_, ok2 := (*b.Store)[b.Offset].(RefCell)
-	fmt.Printf("C1: %#v\n", (*a.Store)[a.Offset])
-	fmt.Printf("C2: %#v\n", (*b.Store)[b.Offset])
+func (m *Machine) bind(a, b Addr) {
+	c1 := m.cell(a)
+	c2 := m.cell(b)
 
 	switch {
-	case ok1 && ok2:
-		fmt.Print("arbitrarily bind a to b\n")
-		(*a.Store)[a.Offset] = (*b.Store)[b.Offset]
-	case ok1:
-		fmt.Print("bind a to b\n")
-		(*a.Store)[a.Offset] = (*b.Store)[b.Offset]
-	case ok2:
-		fmt.Print("bind b to a\n")
-		(*b.Store)[b.Offset] = (*a.Store)[a.Offset]
+	case c1.Tag() == REF && c2.Tag() == REF && a < b:
+		// bind the younger variable to the older one
+		m.bindCell(b, c1)
+	case c1.Tag() == REF:
+		m.bindCell(a, c2)
+	case c2.Tag() == REF:
+		m.bindCell(b, c1)
 	default:
 		panic("didn't manage to fix-up bind")
 	}
 }
 
-func (m *Machine) unify(a1, a2 CellPtr) {
+// bindCell binds the unbound variable at a to the value c
+func (m *Machine) bindCell(a Addr, c Cell) {
+	if m.trail(a) {
+		m.setCell(a, c)
+	}
+}
+
+// unify unifies the terms at a1 and a2, backtracking if they do not
+// unify.
+func (m *Machine) unify(a1, a2 Addr) {
+	if !m.unifies(a1, a2) {
+		m.fail()
+	}
+}
+
+// unifies unifies the terms at a1 and a2, reporting whether they
+// unified. Bindings made before a failure are left to be undone by
+// backtracking.
+func (m *Machine) unifies(a1, a2 Addr) bool {
 	m.PDL.push(a1)
 	m.PDL.push(a2)
-	for !(m.PDL.isEmpty() || m.Failed) {
+	for !m.PDL.isEmpty() {
 		p1 := m.deref(m.PDL.pop())
-		d1 := (*p1.Store)[p1.Offset]
+		d1 := m.cell(p1)
 		p2 := m.deref(m.PDL.pop())
-		d2 := (*p2.Store)[p2.Offset]
-		if d1 != d2 {
-			_, ok1 := d1.(RefCell)
-			_, ok2 := d2.(RefCell)
-			if ok1 || ok2 {
-				m.bind(p1, p2)
-			} else {
-				v1, ok1 := d1.(StrCell)
-				v2, ok2 := d2.(StrCell)
-				if !(ok1 && ok2) {
-					panic("Wrong cell type")
-				}
-				f1, ok1 := v1.Ptr.Cell().(FuncCell)
-				f2, ok2 := v2.Ptr.Cell().(FuncCell)
-				if !(ok1 && ok2) {
-					panic("Wrong cell type")
+		d2 := m.cell(p2)
+		if d1 == d2 {
+			continue
+		}
+
+		if d1.Tag() == REF || d2.Tag() == REF {
+			m.bind(p1, p2)
+			continue
+		}
+
+		ok := false
+		switch d1.Tag() {
+		case CON, INT, NUM:
+			// constants are interned, equal constants have
+			// equal cells
+		case LIS:
+			if ok = d2.Tag() == LIS; ok {
+				for i := 0; i < 2; i++ {
+					m.PDL.push(d1.Addr() + Addr(i))
+					m.PDL.push(d2.Addr() + Addr(i))
 				}
-				if f1.Atom == f2.Atom && f1.n == f2.n {
-					for i := 0; i < f1.n; i++ {
-						m.PDL.push(CellPtr{v1.Ptr.Store, v1.Ptr.Offset + i})
-						m.PDL.push(CellPtr{v2.Ptr.Store, v1.Ptr.Offset + i})
-					}
-				} else {
-					m.Failed = true
+			}
+		case STR:
+			if d2.Tag() == STR {
+				f1 := m.cell(d1.Addr())
+				f2 := m.cell(d2.Addr())
+				ok = f1 == f2
+				for i := 1; ok && i <= f1.Arity(); i++ {
+					m.PDL.push(d1.Addr() + Addr(i))
+					m.PDL.push(d2.Addr() + Addr(i))
 				}
 			}
+		default:
+			panic(fmt.Errorf("cannot unify cell %s", d1))
+		}
+
+		if !ok {
+			m.PDL.cells = m.PDL.cells[:0]
+			return false
 		}
 	}
+	return true
 }
 
-func Call(fn term.Atom) (machineFunc, string) {
+// Constants and lists
+
+// PutConstant loads the constant c into Ai
+func PutConstant(c term.Term, ai int) (machineFunc, string) {
+	k := newCodeConst(c)
 	return func(m *Machine) (machineFunc, string) {
-		loc, ok := m.Labels[fn.String()]
-		if !ok {
-			panic(fmt.Errorf("call to unknown label, %s", fn.String()))
+		m.setReg(X(ai), k.cell(m))
+		return nil, ""
+	}, fmt.Sprintf("put_constant %s, A%d", c, ai)
+}
+
+// GetConstant unifies Ai with the constant c
+func GetConstant(c term.Term, ai int) (machineFunc, string) {
+	k := newCodeConst(c)
+	return func(m *Machine) (machineFunc, string) {
+		m.unifyConstant(m.derefReg(ai), k.cell(m))
+		return nil, ""
+	}, fmt.Sprintf("get_constant %s, A%d", c, ai)
+}
+
+// SetConstant pushes the constant c onto the heap
+func SetConstant(c term.Term) (machineFunc, string) {
+	k := newCodeConst(c)
+	return func(m *Machine) (machineFunc, string) {
+		cell := k.cell(m)
+		if !m.reserve(1) {
+			return nil, ""
+		}
+		m.Heap[m.HReg] = cell
+		m.HReg = m.HReg + 1
+		return nil, ""
+	}, fmt.Sprintf("set_constant %s", c)
+}
+
+// UnifyConstant unifies the next argument of the structure being
+// matched with the constant c, or builds it in write mode.
+func UnifyConstant(c term.Term) (machineFunc, string) {
+	k := newCodeConst(c)
+	return func(m *Machine) (machineFunc, string) {
+		cell := k.cell(m)
+		switch m.Mode {
+		case Read:
+			m.unifyConstant(m.deref(heapAddr(m.SReg)), cell)
+		case Write:
+			if !m.reserve(1) {
+				return nil, ""
+			}
+			m.Heap[m.HReg] = cell
+			m.HReg = m.HReg + 1
+		default:
+			panic(fmt.Errorf("invalid read/write mode %v", m.Mode))
+		}
+		m.SReg = m.SReg + 1
+		return nil, ""
+	}, fmt.Sprintf("unify_constant %s", c)
+}
+
+// unifyConstant unifies the dereferenced cell at a with the
+// constant c
+func (m *Machine) unifyConstant(a Addr, c Cell) {
+	switch d := m.cell(a); {
+	case d.Tag() == REF:
+		m.bindCell(a, c)
+	case d != c:
+		m.fail()
+	}
+}
+
+// PutList starts building a list pair on the heap, with Ai pointing
+// to it
+func PutList(ai int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.setReg(X(ai), lisCell(heapAddr(m.HReg)))
+		m.Mode = Write
+		return nil, ""
+	}, fmt.Sprintf("put_list X%d", ai)
+}
+
+// GetList matches Ai against a list pair, building a new one if
+// Ai is unbound.
+func GetList(ai int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		a := m.derefReg(ai)
+
+		switch c := m.cell(a); c.Tag() {
+		case REF:
+			if !m.reserve(1) {
+				return nil, ""
+			}
+			m.Heap[m.HReg] = lisCell(heapAddr(m.HReg + 1))
+			m.bind(a, heapAddr(m.HReg))
+			m.HReg = m.HReg + 1
+			m.Mode = Write
+		case LIS:
+			m.SReg = c.Addr().offset()
+			m.Mode = Read
+		default:
+			m.fail()
 		}
+		return nil, ""
+	}, fmt.Sprintf("get_list X%d", ai)
+}
+
+// Call calls the predicate fn/n, which returns to the following
+// instruction. Only the first k permanent variables of the current
+// environment are needed after the call, the rest are trimmed. The
+// number that are live is held in a register, rather than in the
+// environment, so that it is saved with the continuation, and
+// restored on backtracking.
+func Call(fn term.Atom, n, k int) (machineFunc, string) {
+	f := NewFunctor(fn, n)
+	return func(m *Machine) (machineFunc, string) {
+		m.LiveReg = k
+		m.maybeCollect(n)
+		m.CPReg = m.PReg
+		m.callPred(f)
+		return nil, ""
+	}, fmt.Sprintf("call %s/%d, %d", fn, n, k)
+}
 
-		m.PReg = loc
+// Execute jumps to the predicate fn/n, which returns to the current
+// continuation. It is used for the last goal of a rule, once its
+// environment has been discarded.
+func Execute(fn term.Atom, n int) (machineFunc, string) {
+	f := NewFunctor(fn, n)
+	return func(m *Machine) (machineFunc, string) {
+		m.maybeCollect(n)
+		m.callPred(f)
 		return nil, ""
-	}, fmt.Sprintf("call")
+	}, fmt.Sprintf("execute %s/%d", fn, n)
+}
+
+// callPred passes control to the predicate f, with its arguments in
+// the argument registers, returning to the continuation in CP.
+// Built-in predicates are run directly.
+func (m *Machine) callPred(f Functor) {
+	m.NumArgs = f.Arity
+	m.GBReg = m.BReg
+	if b, ok := builtins[f]; ok {
+		m.PReg = m.CPReg
+		b(m)
+		return
+	}
+	if p, ok := m.db[f]; ok {
+		m.callDynamic(p)
+		return
+	}
+	loc, ok := m.Labels[f]
+	if !ok {
+		loc, ok = m.libraryLabel(f)
+	}
+	if !ok {
+		m.throw(ExistenceError{f})
+		return
+	}
+	m.PReg = loc
 }
 
 func Proceeed() (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
+		m.PReg = m.CPReg
 		return nil, ""
 	}, fmt.Sprintf("proceed")
 }
 
-func PutVariable(xn, ai int) (machineFunc, string) {
+// Halt stops the machine, it is placed at the end of query code
+// so that the query finishes once its final call has proceeded.
+func Halt() (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
-		m.Heap[m.HReg] = RefCell{CellPtr{&m.Heap, m.HReg}}
-		m.XRegisters[xn] = m.Heap[m.HReg]
-		m.XRegisters[ai] = m.Heap[m.HReg]
+		m.Finished = true
+		return nil, ""
+	}, "halt"
+}
+
+// PutVariable creates a new unbound variable on the heap and
+// stores it in both vn and Ai. Permanent variables are also created
+// on the heap, so that the stack never holds an unbound variable.
+func PutVariable(vn Reg, ai int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		if !m.reserve(1) {
+			return nil, ""
+		}
+		m.Heap[m.HReg] = refCell(heapAddr(m.HReg))
+		m.setReg(vn, m.Heap[m.HReg])
+		m.setReg(X(ai), m.Heap[m.HReg])
 		m.HReg = m.HReg + 1
 		return nil, ""
-	}, fmt.Sprintf("put_variable X%d, A%d", xn, ai)
+	}, fmt.Sprintf("put_variable %s, A%d", vn, ai)
 }
 
-func PutValue(xn, ai int) (machineFunc, string) {
+func PutValue(vn Reg, ai int) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
-		m.XRegisters[ai] = m.XRegisters[xn]
+		m.setReg(X(ai), m.getReg(vn))
 		return nil, ""
-	}, fmt.Sprintf("put_value X%d, A%d", xn, ai)
+	}, fmt.Sprintf("put_value %s, A%d", vn, ai)
 }
 
-func GetVariable(xn, ai int) (machineFunc, string) {
+func GetVariable(vn Reg, ai int) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
-		m.XRegisters[xn] = m.XRegisters[ai]
+		m.setReg(vn, m.getReg(X(ai)))
 		return nil, ""
-	}, fmt.Sprintf("get_variable X%d, A%d", xn, ai)
+	}, fmt.Sprintf("get_variable %s, A%d", vn, ai)
 }
 
-func GetValue(xn, ai int) (machineFunc, string) {
+func GetValue(vn Reg, ai int) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
-		m.unify(CellPtr{&m.XRegisters, xn}, CellPtr{&m.XRegisters, ai})
+		m.unify(m.regPtr(vn), m.regPtr(X(ai)))
 		return nil, ""
-	}, fmt.Sprintf("get_value X%d, A%d", xn, ai)
+	}, fmt.Sprintf("get_value %s, A%d", vn, ai)
 }
 
 // L2
-func Allocate() (machineFunc, string) {
+
+// Allocate pushes a new environment with room for n permanent
+// variables, saving the current environment and continuation.
+func Allocate(n int) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
+		m.allocate(n)
 		return nil, ""
-	}, fmt.Sprintf("allocate")
+	}, fmt.Sprintf("allocate %d", n)
 }
 
+// allocate pushes a new environment with room for n permanent
+// variables, it returns false if the stack is full.
+func (m *Machine) allocate(n int) bool {
+	if !m.reserveFrame() {
+		return false
+	}
+	top := m.envTop()
+	y := m.stackTop()
+	if y+n > len(m.Stack) {
+		m.Stack = append(m.Stack, make([]Cell, y+n)...)
+	}
+	e := &Environment{
+		CE:    m.EReg,
+		CP:    m.CPReg,
+		CLive: m.LiveReg,
+		Y:     y,
+		N:     n,
+	}
+	m.EReg = top
+	m.LiveReg = n
+	m.AndStack = append(m.AndStack[:m.EReg], e)
+	return true
+}
+
+// Deallocate pops the current environment, restoring the
+// continuation it saved.
 func Deallocate() (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
+		e := m.AndStack[m.EReg]
+		m.CPReg = e.CP
+		m.LiveReg = e.CLive
+		m.EReg = e.CE
 		return nil, ""
 	}, fmt.Sprintf("deallocate")
 }
 
 // L3 - Prolog
-func TryMeElse() (machineFunc, string) {
+
+// pushChoicePoint creates a choice point whose alternative is the
+// code at l, saving the first n argument registers.
+func (m *Machine) pushChoicePoint(l, n int) {
+	b := &ChoicePoint{
+		Args: append([]Cell{}, m.XRegisters[:n]...),
+		E:    m.EReg,
+		CP:   m.CPReg,
+		Live: m.LiveReg,
+		B:    m.BReg,
+		BP:   l,
+		TR:   m.TRReg,
+		H:    m.HReg,
+		ETop: m.envTop(),
+		YTop: m.stackTop(),
+		B0:   m.GBReg,
+	}
+	m.BReg = m.BReg + 1
+	m.OrStack = append(m.OrStack[:m.BReg], b)
+	m.HBReg = m.HReg
+}
+
+// popChoicePoint restores the state saved in the current choice
+// point and discards it.
+func (m *Machine) popChoicePoint() {
+	b := m.OrStack[m.BReg]
+	m.restoreChoicePoint(b)
+	m.BReg = b.B
+	if m.BReg != -1 {
+		m.HBReg = m.OrStack[m.BReg].H
+	} else {
+		m.HBReg = 0
+	}
+}
+
+// TryMeElse creates a choice point for the current call, whose
+// alternative is the clause at l.
+func TryMeElse(l int) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
+		if !m.reserveFrame() {
+			return nil, ""
+		}
+		m.pushChoicePoint(l, m.NumArgs)
 		return nil, ""
-	}, fmt.Sprintf("try_me_else")
+	}, fmt.Sprintf("try_me_else %d", l)
 }
 
-func RetryMeElse() (machineFunc, string) {
+// RetryMeElse restores the state saved in the current choice point
+// and updates it so the next alternative is the clause at l.
+func RetryMeElse(l int) (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
+		b := m.OrStack[m.BReg]
+		m.restoreChoicePoint(b)
+		b.BP = l
 		return nil, ""
-	}, fmt.Sprintf("retry_me_else")
+	}, fmt.Sprintf("retry_me_else %d", l)
 }
 
+// TrustMe restores the state saved in the current choice point and
+// discards it, as this is the last alternative.
 func TrustMe() (machineFunc, string) {
 	return func(m *Machine) (machineFunc, string) {
+		m.popChoicePoint()
 		return nil, ""
 	}, fmt.Sprintf("trust_me")
 }
 
+// Indexing
+
+// jump transfers control to l, a label of -1 indicates that there
+// is no code to run, and the machine backtracks.
+func (m *Machine) jump(l int) {
+	if l == -1 {
+		m.fail()
+		return
+	}
+	m.PReg = l
+}
+
+// SwitchOnTerm jumps to one of the labels, depending on the type of
+// the dereferenced first argument.
+func SwitchOnTerm(lv, lc, ll, ls int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		switch m.cell(m.derefReg(0)).Tag() {
+		case REF:
+			m.jump(lv)
+		case CON, INT, NUM:
+			m.jump(lc)
+		case LIS:
+			m.jump(ll)
+		case STR:
+			m.jump(ls)
+		default:
+			m.fail()
+		}
+		return nil, ""
+	}, fmt.Sprintf("switch_on_term %d, %d, %d, %d", lv, lc, ll, ls)
+}
+
+// SwitchOnConstant jumps to the label for the constant in the first
+// argument, or to def if the constant is not in the table.
+func SwitchOnConstant(table map[argKey]int, def int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		l, ok := table[m.cellKey(m.cell(m.derefReg(0)))]
+		if !ok {
+			l = def
+		}
+		m.jump(l)
+		return nil, ""
+	}, fmt.Sprintf("switch_on_constant %s, %d", formatTable(table), def)
+}
+
+// SwitchOnStructure jumps to the label for the functor of the
+// structure in the first argument, or to def if the functor is not
+// in the table.
+func SwitchOnStructure(table map[argKey]int, def int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		l, ok := table[m.cellKey(m.cell(m.derefReg(0)))]
+		if !ok {
+			l = def
+		}
+		m.jump(l)
+		return nil, ""
+	}, fmt.Sprintf("switch_on_structure %s, %d", formatTable(table), def)
+}
+
+// formatTable renders an index table, in a stable order
+func formatTable(table map[argKey]int) string {
+	ks := []argKey{}
+	for k := range table {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].String() < ks[j].String()
+	})
+	strs := []string{}
+	for _, k := range ks {
+		strs = append(strs, fmt.Sprintf("%s: %d", k, table[k]))
+	}
+	return "{" + strings.Join(strs, ", ") + "}"
+}
+
+// Try creates a choice point whose alternative is the next
+// instruction, and jumps to the clause at l.
+func Try(l int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		if !m.reserveFrame() {
+			return nil, ""
+		}
+		m.pushChoicePoint(m.PReg, m.NumArgs)
+		m.PReg = l
+		return nil, ""
+	}, fmt.Sprintf("try %d", l)
+}
+
+// Retry restores the state saved in the current choice point,
+// updates its alternative to the next instruction, and jumps to the
+// clause at l.
+func Retry(l int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		b := m.OrStack[m.BReg]
+		m.restoreChoicePoint(b)
+		b.BP = m.PReg
+		m.PReg = l
+		return nil, ""
+	}, fmt.Sprintf("retry %d", l)
+}
+
+// Trust discards the current choice point, and jumps to the last
+// clause, at l.
+func Trust(l int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.popChoicePoint()
+		m.PReg = l
+		return nil, ""
+	}, fmt.Sprintf("trust %d", l)
+}
+
+// Cut
+
+// cutTo discards all choice points newer than b
+func (m *Machine) cutTo(b int) {
+	if m.BReg <= b {
+		return
+	}
+	m.BReg = b
+	if m.BReg != -1 {
+		m.HBReg = m.OrStack[m.BReg].H
+	} else {
+		m.HBReg = 0
+	}
+}
+
+// NeckCut discards the choice points created since the current
+// predicate was called. It is used for a cut that comes before any
+// call in the clause body, while the cut level is still in B0.
+func NeckCut() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.cutTo(m.GBReg)
+		return nil, ""
+	}, "neck_cut"
+}
+
+// GetLevel saves the cut level of the current predicate in yn, so
+// that it survives the calls made before a cut.
+func GetLevel(yn Reg) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.setReg(yn, intCell(int64(m.GBReg)))
+		return nil, ""
+	}, fmt.Sprintf("get_level %s", yn)
+}
+
+// Cut discards the choice points created since the cut level saved
+// in yn.
+func Cut(yn Reg) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.cutTo(int(m.getReg(yn).Int()))
+		return nil, ""
+	}, fmt.Sprintf("cut %s", yn)
+}
+
+// Control constructs
+//
+// Disjunction, if-then-else and negation are compiled inline in the
+// clause body. Their labels are offsets from the instruction itself,
+// as the position of the clause is not known until it is linked.
+
+// TryElse creates a choice point within a clause body, whose
+// alternative is the code off instructions on. No argument
+// registers are saved, the variables of the body that are needed by
+// the alternative are held in the environment.
+func TryElse(off int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		if !m.reserveFrame() {
+			return nil, ""
+		}
+		m.pushChoicePoint(m.PReg-1+off, 0)
+		return nil, ""
+	}, fmt.Sprintf("try_else %+d", off)
+}
+
+// Jump transfers control to the code off instructions on
+func Jump(off int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.PReg = m.PReg - 1 + off
+		return nil, ""
+	}, fmt.Sprintf("jump %+d", off)
+}
+
+// Fail backtracks to the most recent choice point
+func Fail() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.fail()
+		return nil, ""
+	}, "fail"
+}
+
+// GetChoice saves the current choice point in vn, so that a later cut
+// can discard the choice points created since.
+func GetChoice(vn Reg) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		m.setReg(vn, intCell(int64(m.BReg)))
+		return nil, ""
+	}, fmt.Sprintf("get_choice %s", vn)
+}
+
+// SoftCut commits to the condition of a soft-cut. The choice point
+// created after the one saved in vn holds the else branch, if it is
+// the most recent choice point it is discarded, otherwise the
+// condition left choice points of its own, and its alternative is
+// replaced with the code off instructions on, which fails.
+func SoftCut(vn Reg, off int) (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		b := int(m.getReg(vn).Int()) + 1
+		if m.BReg == b {
+			m.cutTo(b - 1)
+			return nil, ""
+		}
+		m.OrStack[b].BP = m.PReg - 1 + off
+		return nil, ""
+	}, fmt.Sprintf("soft_cut %s, %+d", vn, off)
+}
+
 // Optimisations
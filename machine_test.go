@@ -32,76 +32,59 @@ type mtestL0 struct {
 }
 
 var mtestsL0 = []mtestL0{
-	/*
-		{
-			`p(Z,h(Z,W),f(W)).`,
-			`p(f(X),h(Y,f(a)),Y).`,
-			false,
-		},
-		{
-			`p(Z,h(Z,W)).`,
-			`p(f(X),h(Y,f(a)),Y).`,
-			true,
-		},
-		{
-			`p(Z,h(Z,a())).`,
-			`p(Z,h(Z,Z)).`,
-			false,
-		},
-		{
-			`p(A,h(A,a(),D)).`,
-			`p(a(),h(Z,B,B)).`,
-			false,
-		},
-		{
-			`a().`,
-			`a().`,
-			false,
-		},
-		{
-			`a().`,
-			`b().`,
-			true,
-		},
-		{
-			`a().`,
-			`X.`,
-			false,
-		},
-		{
-			`a(X,b()).`,
-			`a(Y,b()).`,
-			false,
-		},
-		{
-			`a(X,b()).`,
-			`a(c(),Y).`,
-			false,
-		},
-		{
-			`a(X,b(),X).`,
-			`a(b(),Y,Y).`,
-			false,
-		},
-		{
-			`X.`,
-			`Y.`,
-			false,
-		},
-		{
-			`a(X,f(Y,Y),Y).`,
-			`a(X,X,f(Y,Y)).`,
-			false,
-		},
-		{
-			`a(f(Z,Z),f(Z,Z,Z)).`,
-			`a(Y,Y).`,
-			true,
-		},
-	*/
 	{
 		`p(Z,h(Z,W),f(W)).`,
 		`p(f(X),h(Y,f(a)),Y).`,
+		false,
+	},
+	{
+		`p(Z,h(Z,W),f(W)).`,
+		`p(f(X),h(Y,f(a)),f(b())).`,
+		true,
+	},
+	{
+		`p(Z,h(Z,a())).`,
+		`p(Z,h(Z,Z)).`,
+		false,
+	},
+	{
+		`p(A,h(A,a(),D)).`,
+		`p(a(),h(Z,B,B)).`,
+		false,
+	},
+	{
+		`a().`,
+		`a().`,
+		false,
+	},
+	{
+		`a(X,b()).`,
+		`a(Y,b()).`,
+		false,
+	},
+	{
+		`a(X,b()).`,
+		`a(c(),Y).`,
+		false,
+	},
+	{
+		`a(X,b(),X).`,
+		`a(b(),Y,Y).`,
+		false,
+	},
+	{
+		`a(X,f(Y,Y),Y).`,
+		`a(X,X,f(Y,Y)).`,
+		false,
+	},
+	{
+		`a(f(Z,Z),f(Z,Z,Z)).`,
+		`a(Y,Y).`,
+		true,
+	},
+	{
+		`a(b(),c()).`,
+		`a(X,X).`,
 		true,
 	},
 }
@@ -119,21 +102,21 @@ func TestMachine0(t *testing.T) {
 			q, _ := qt.NextTerm()
 			p, _ := pt.NextTerm()
 
-			cs := compileL1(q, []term.Term{p})
 			m := NewMachine()
+			m.Load(compileL1Program([]term.Term{p}))
 
 			defer func() {
 				if r := recover(); r != nil {
-					fmt.Println("Recovered in f", r)
 					fmt.Println(m.String())
-					return
+					t.Fatalf("machine panicked, %v", r)
 				}
 				if !m.Finished {
 					t.Fatalf("test failed, did not finish")
 				}
 			}()
 
-			m.run(cs)
+			qcs, _ := compileL1Query(q)
+			m.run(qcs)
 
 			if st.fail != m.Failed {
 				fmt.Println(m.String())
@@ -144,3 +127,244 @@ func TestMachine0(t *testing.T) {
 		})
 	}
 }
+
+// l2Program is p(X,Y) :- q(X,Z), r(Z,Y). q(a,b). r(b,c). compiled by hand
+var l2Program = CodeCells{
+	// p/2
+	cc(Allocate(2)),
+	cc(GetVariable(X(2), 0)),
+	cc(GetVariable(Y(0), 1)),
+	cc(PutValue(X(2), 0)),
+	cc(PutVariable(Y(1), 1)),
+	cc(Call("q", 2, 2)),
+	cc(PutValue(Y(1), 0)),
+	cc(PutValue(Y(0), 1)),
+	cc(Call("r", 2, 2)),
+	cc(Deallocate()),
+	cc(Proceeed()),
+	// q/2
+	cc(GetStructure("a", 0, 0)),
+	cc(GetStructure("b", 0, 1)),
+	cc(Proceeed()),
+	// r/2
+	cc(GetStructure("b", 0, 0)),
+	cc(GetStructure("c", 0, 1)),
+	cc(Proceeed()),
+}
+
+var l2Labels = map[Functor]int{NewFunctor("p", 2): 0, NewFunctor("q", 2): 11, NewFunctor("r", 2): 14}
+
+type mtestL2 struct {
+	q    CodeCells
+	fail bool
+}
+
+var mtestsL2 = []mtestL2{
+	{
+		// p(a,c)
+		CodeCells{
+			cc(PutStructure("a", 0, 0)),
+			cc(PutStructure("c", 0, 1)),
+			cc(Call("p", 2, 0)),
+			cc(Halt()),
+		},
+		false,
+	},
+	{
+		// p(a,b)
+		CodeCells{
+			cc(PutStructure("a", 0, 0)),
+			cc(PutStructure("b", 0, 1)),
+			cc(Call("p", 2, 0)),
+			cc(Halt()),
+		},
+		true,
+	},
+	{
+		// p(A,B), p(A,c), with A and B held in permanent registers
+		CodeCells{
+			cc(Allocate(2)),
+			cc(PutVariable(Y(0), 0)),
+			cc(PutVariable(Y(1), 1)),
+			cc(Call("p", 2, 2)),
+			cc(PutValue(Y(0), 0)),
+			cc(PutStructure("c", 0, 1)),
+			cc(Call("p", 2, 2)),
+			cc(PutValue(Y(1), 0)),
+			cc(PutStructure("c", 0, 1)),
+			cc(GetValue(X(0), 1)),
+			cc(Deallocate()),
+			cc(Halt()),
+		},
+		false,
+	},
+	{
+		// p(A,B), B = a
+		CodeCells{
+			cc(Allocate(1)),
+			cc(PutVariable(X(2), 0)),
+			cc(PutVariable(Y(0), 1)),
+			cc(Call("p", 2, 1)),
+			cc(PutValue(Y(0), 0)),
+			cc(GetStructure("a", 0, 0)),
+			cc(Deallocate()),
+			cc(Halt()),
+		},
+		true,
+	},
+}
+
+func TestMachine2(t *testing.T) {
+	for i, st := range mtestsL2 {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m := NewMachine()
+			m.Load(l2Program, l2Labels)
+
+			m.run(st.q)
+
+			if st.fail != m.Failed {
+				t.Fatalf("%s failed, expected %v, got %v\n%s", t.Name(), st.fail, m.Failed, m)
+			}
+			if !m.Failed && m.EReg != -1 {
+				t.Fatalf("%s environment not deallocated, E = %d", t.Name(), m.EReg)
+			}
+		})
+	}
+}
+
+// l3Program is likes(sam,orange). likes(sam,apple). likes(sam,ham).
+// p(X) :- likes(sam,X), true. q(X) :- X = ham, true.
+// r(X) :- X = eggs, true. compiled by hand
+var l3Program = CodeCells{
+	cc(TryMeElse(4)),
+	cc(GetStructure("sam", 0, 0)),
+	cc(GetStructure("orange", 0, 1)),
+	cc(Proceeed()),
+	cc(RetryMeElse(8)),
+	cc(GetStructure("sam", 0, 0)),
+	cc(GetStructure("apple", 0, 1)),
+	cc(Proceeed()),
+	cc(TrustMe()),
+	cc(GetStructure("sam", 0, 0)),
+	cc(GetStructure("ham", 0, 1)),
+	cc(Proceeed()),
+	// p/1
+	cc(Allocate(1)),
+	cc(GetVariable(Y(0), 0)),
+	cc(PutStructure("sam", 0, 0)),
+	cc(PutValue(Y(0), 1)),
+	cc(Call("likes", 2, 1)),
+	cc(Deallocate()),
+	cc(Proceeed()),
+	// q/1
+	cc(Allocate(1)),
+	cc(GetVariable(Y(0), 0)),
+	cc(PutValue(Y(0), 0)),
+	cc(GetStructure("ham", 0, 0)),
+	cc(Deallocate()),
+	cc(Proceeed()),
+	// r/1
+	cc(Allocate(1)),
+	cc(GetVariable(Y(0), 0)),
+	cc(PutValue(Y(0), 0)),
+	cc(GetStructure("eggs", 0, 0)),
+	cc(Deallocate()),
+	cc(Proceeed()),
+}
+
+var l3Labels = map[Functor]int{NewFunctor("likes", 2): 0, NewFunctor("p", 1): 12, NewFunctor("q", 1): 19, NewFunctor("r", 1): 25}
+
+var mtestsL3 = []mtestL2{
+	{
+		// likes(sam,ham)
+		CodeCells{
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutStructure("ham", 0, 1)),
+			cc(Call("likes", 2, 0)),
+			cc(Halt()),
+		},
+		false,
+	},
+	{
+		// likes(sam,eggs)
+		CodeCells{
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutStructure("eggs", 0, 1)),
+			cc(Call("likes", 2, 0)),
+			cc(Halt()),
+		},
+		true,
+	},
+	{
+		// likes(sam,X), X = ham, the binding of X must be undone
+		// when backtracking into each alternative
+		CodeCells{
+			cc(Allocate(1)),
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutVariable(Y(0), 1)),
+			cc(Call("likes", 2, 1)),
+			cc(PutValue(Y(0), 0)),
+			cc(GetStructure("ham", 0, 0)),
+			cc(Deallocate()),
+			cc(Halt()),
+		},
+		false,
+	},
+	{
+		// likes(X,Y), likes(Y,Z)
+		CodeCells{
+			cc(Allocate(1)),
+			cc(PutVariable(X(2), 0)),
+			cc(PutVariable(Y(0), 1)),
+			cc(Call("likes", 2, 1)),
+			cc(PutValue(Y(0), 0)),
+			cc(PutVariable(X(2), 1)),
+			cc(Call("likes", 2, 1)),
+			cc(Deallocate()),
+			cc(Halt()),
+		},
+		true,
+	},
+	{
+		// p(X), q(X), the environment of p/1 must survive the
+		// allocation by q/1, as the choice point in likes/2 needs it
+		CodeCells{
+			cc(Allocate(1)),
+			cc(PutVariable(Y(0), 0)),
+			cc(Call("p", 1, 1)),
+			cc(PutValue(Y(0), 0)),
+			cc(Call("q", 1, 1)),
+			cc(Deallocate()),
+			cc(Halt()),
+		},
+		false,
+	},
+	{
+		// p(X), r(X)
+		CodeCells{
+			cc(Allocate(1)),
+			cc(PutVariable(Y(0), 0)),
+			cc(Call("p", 1, 1)),
+			cc(PutValue(Y(0), 0)),
+			cc(Call("r", 1, 1)),
+			cc(Deallocate()),
+			cc(Halt()),
+		},
+		true,
+	},
+}
+
+func TestMachine3(t *testing.T) {
+	for i, st := range mtestsL3 {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m := NewMachine()
+			m.Load(l3Program, l3Labels)
+
+			m.run(st.q)
+
+			if st.fail != m.Failed {
+				t.Fatalf("%s failed, expected %v, got %v\n%s", t.Name(), st.fail, m.Failed, m)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parse
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tcolgate/golorp/context"
+	"github.com/tcolgate/golorp/scan"
+	"github.com/tcolgate/golorp/term"
+)
+
+// charEscapes maps the escape sequences allowed in character codes to
+// the characters they represent
+var charEscapes = map[rune]rune{
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'0':  0,
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+	'`':  '`',
+}
+
+// number returns the term for the number literal s. Integers, of any
+// size, are read as term.Integer, floats as term.Float, and rationals
+// as term.Rational.
+func number(s string) (term.Term, error) {
+	switch {
+	case strings.HasPrefix(s, "0'"):
+		r, _ := utf8.DecodeRuneInString(s[2:])
+		if r == '\\' {
+			e, _ := utf8.DecodeRuneInString(s[3:])
+			c, ok := charEscapes[e]
+			if !ok {
+				return nil, fmt.Errorf("could not parse number, unknown escape in %s", s)
+			}
+			r = c
+		}
+		return term.NewInteger(int64(r)), nil
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0o"), strings.HasPrefix(s, "0b"):
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[s[1]]
+		i, ok := new(big.Int).SetString(s[2:], base)
+		if !ok {
+			return nil, fmt.Errorf("could not parse number %s", s)
+		}
+		return term.NewBigInteger(i), nil
+	case strings.Contains(s, "r"):
+		r, ok := new(big.Rat).SetString(strings.Replace(s, "r", "/", 1))
+		if !ok {
+			return nil, fmt.Errorf("could not parse number %s", s)
+		}
+		if r.IsInt() {
+			return term.NewBigInteger(r.Num()), nil
+		}
+		return term.NewRational(r), nil
+	case strings.ContainsAny(s, ".eE"):
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse number, %s", err)
+		}
+		return term.NewFloat(f), nil
+	default:
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return nil, fmt.Errorf("could not parse number %s", s)
+		}
+		return term.NewBigInteger(i), nil
+	}
+}
+
+// Number returns the number read from the text s, which may be
+// preceded by layout and a minus sign directly before the number, as
+// by number_codes/2.
+func Number(s string) (term.Term, error) {
+	sc := scan.New(context.Context{}, "", strings.NewReader(s))
+	tok := sc.Next()
+	for tok.Type == scan.Newline {
+		tok = sc.Next()
+	}
+	neg := tok.Type == scan.SpecialAtom && tok.Text == "-"
+	if neg {
+		tok = sc.Next()
+	}
+	if tok.Type != scan.Number || neg && tok.Layout || sc.Next().Type != scan.EOF {
+		return nil, fmt.Errorf("could not parse number %q", s)
+	}
+	n, err := number(tok.Text)
+	if err != nil {
+		return nil, err
+	}
+	if neg {
+		n = negate(n)
+	}
+	return n, nil
+}
+
+// negate returns the negation of the number n
+func negate(n term.Term) term.Term {
+	switch n := n.(type) {
+	case *term.Integer:
+		return term.NewBigInteger(new(big.Int).Neg(n.Value()))
+	case term.Float:
+		return -n
+	default:
+		return term.NewRational(new(big.Rat).Neg(n.(*term.Rational).Value()))
+	}
+}
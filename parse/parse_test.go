@@ -30,19 +30,30 @@ type test struct {
 
 var tests = []test{
 	{"clause0", `likes.`, `("likes"/0 [])`},
-	{"clause1", `1 + 2.`, `("+"/2 [(number 1) (number 2)])`},
-	{"clause1", `2 / 3.`, `("/"/2 [(number 2) (number 3)])`},
-	{"clause2", `print(1 + 2 + 3 + 4 + 5).`, `("print"/1 [("+"/2 [("+"/2 [("+"/2 [("+"/2 [(number 1) (number 2)]) (number 3)]) (number 4)]) (number 5)])])`},
-	{"clause2", `1 + (2 * 3).`, `("+"/2 [(number 1) ("*"/2 [(number 2) (number 3)])])`},
-	{"clause3", `-2.`, `("-"/1 [(number 2)])`},
+	{"clause1", `1 + 2.`, `("+"/2 [(integer 1) (integer 2)])`},
+	{"clause1", `2 / 3.`, `("/"/2 [(integer 2) (integer 3)])`},
+	{"clause2", `print(1 + 2 + 3 + 4 + 5).`, `("print"/1 [("+"/2 [("+"/2 [("+"/2 [("+"/2 [(integer 1) (integer 2)]) (integer 3)]) (integer 4)]) (integer 5)])])`},
+	{"clause2", `1 + (2 * 3).`, `("+"/2 [(integer 1) ("*"/2 [(integer 2) (integer 3)])])`},
+	{"clause3", `-2.`, `(integer -2)`},
 	{"clause4", `likes(sam).`, `("likes"/1 [("sam"/0 [])])`},
 	{"clause5", `likes(sam,Food).`, `("likes"/2 [("sam"/0 []) (var Food)])`},
 	{"clause6", `likes(sam,orange).`, `("likes"/2 [("sam"/0 []) ("orange"/0 [])])`},
 	{"clause7", `likes(sam,_).`, `("likes"/2 [("sam"/0 []) (var _)])`},
-	{"clause8", `likes/2(sam,__thing).`, `("likes/2"/2 [("sam"/0 []) (var __thing)])`},
-	{"clause9", `likes/2(sam,Thing) :- yummy(Thing).`, `(":-"/2 [("likes/2"/2 [("sam"/0 []) (var Thing)]) ("yummy"/1 [(var Thing)])])`},
-	{"clause10", `eatenChocs(tristan,1000000).`, `("eatenChocs"/2 [("tristan"/0 []) (number 1e+06)])`},
-	{"clause11", `eatenChocs(tristan + 4,1000000).`, `("eatenChocs"/2 [("+"/2 [("tristan"/0 []) (number 4)]) (number 1e+06)])`},
+	{"clause8", `likes(sam,__thing).`, `("likes"/2 [("sam"/0 []) (var __thing)])`},
+	{"clause9", `likes(sam,Thing) :- yummy(Thing).`, `(":-"/2 [("likes"/2 [("sam"/0 []) (var Thing)]) ("yummy"/1 [(var Thing)])])`},
+	{"indicator", `:- dynamic foo/1.`, `(":-"/1 [("dynamic"/1 [("/"/2 [("foo"/0 []) (integer 1)])])])`},
+	{"disjunction", `a ; b, c.`, `(";"/2 [("a"/0 []) (","/2 [("b"/0 []) ("c"/0 [])])])`},
+	{"ifthenelse", `(a -> b ; c).`, `(";"/2 [("->"/2 [("a"/0 []) ("b"/0 [])]) ("c"/0 [])])`},
+	{"negation", `\+ a, b.`, `(","/2 [("\\+"/1 [("a"/0 [])]) ("b"/0 [])])`},
+	{"clause10", `eatenChocs(tristan,1000000).`, `("eatenChocs"/2 [("tristan"/0 []) (integer 1000000)])`},
+	{"clause11", `eatenChocs(tristan + 4,1000000).`, `("eatenChocs"/2 [("+"/2 [("tristan"/0 []) (integer 4)]) (integer 1000000)])`},
+	{"bigint", `123456789012345678901234567890.`, `(integer 123456789012345678901234567890)`},
+	{"float", `f(1.5, 1.0e10, 2.5E-3, 1e3).`, `("f"/4 [(float 1.5) (float 1.0e+10) (float 0.0025) (float 1000.0)])`},
+	{"rational", `1r3.`, `(rational 1r3)`},
+	{"radix", `f(0x1F, 0o17, 0b101).`, `("f"/3 [(integer 31) (integer 15) (integer 5)])`},
+	{"charcode", `f(0'a, 0'\n, 0''', 0'λ).`, `("f"/4 [(integer 97) (integer 10) (integer 39) (integer 955)])`},
+	{"negative", `f(-1, - 2.5, 3 - 1, -(4)).`, `("f"/4 [(integer -1) ("-"/1 [(float 2.5)]) ("-"/2 [(integer 3) (integer 1)]) ("-"/1 [(integer 4)])])`},
+	{"quoted", `'f'('abc', 'a b', 'it\'s', '=..', 'π').`, `("f"/5 [("abc"/0 []) ("'a b'"/0 []) ("'it\\'s'"/0 []) ("=.."/0 []) ("π"/0 [])])`},
 }
 
 func TestNew(t *testing.T) {
@@ -60,3 +71,35 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestNumber(t *testing.T) {
+	ntests := []struct {
+		src string
+		exp string
+	}{
+		{"42", "(integer 42)"},
+		{"  -42", "(integer -42)"},
+		{"1.5e3", "(float 1500.0)"},
+		{"0'a", "(integer 97)"},
+		{"0x1f", "(integer 31)"},
+		{"1r3", "(rational 1r3)"},
+		{"", "error"},
+		{"12a", "error"},
+		{"1 + 2", "error"},
+		{"foo", "error"},
+		{"--1", "error"},
+		{"- 1", "error"},
+	}
+	for _, st := range ntests {
+		t.Run(st.src, func(t *testing.T) {
+			n, err := Number(st.src)
+			str := "error"
+			if err == nil {
+				str = fmt.Sprintf("%v", n)
+			}
+			if str != st.exp {
+				t.Fatalf("expected: %s, got: %s", st.exp, str)
+			}
+		})
+	}
+}
@@ -16,7 +16,7 @@ package parse
 import (
 	"fmt"
 	"io"
-	"math/big"
+	"strings"
 
 	"github.com/tcolgate/golorp/scan"
 	"github.com/tcolgate/golorp/term"
@@ -78,14 +78,24 @@ func (p *Parser) readTerm(pri int) (term.Term, error) {
 			return p.readRest(0, pri, term.NewVariable(l.Text))
 
 		case scan.Number:
-			f, _, err := big.ParseFloat(l.Text, 10, 1000, big.ToNearestEven)
+			n, err := number(l.Text)
 			if err != nil {
-				return nil, fmt.Errorf("could not parse number, %s", err)
+				return nil, err
 			}
 
-			return p.readRest(0, pri, term.NewNumber(f))
+			return p.readRest(0, pri, n)
 
 		case scan.Atom, scan.SpecialAtom, scan.Comma:
+			// a minus sign directly before a number is part of the
+			// number, - 1 is the term -(1)
+			if l.Text == "-" && p.peek().Type == scan.Number && !p.peek().Layout {
+				n, err := number(p.next().Text)
+				if err != nil {
+					return nil, err
+				}
+				return p.readRest(0, pri, negate(n))
+			}
+
 			opp, argp, ok := p.operators.Prefix(l.Text)
 			if ok && opp <= pri {
 				t0, err := p.readTerm(argp)
@@ -94,7 +104,7 @@ func (p *Parser) readTerm(pri int) (term.Term, error) {
 				}
 			}
 
-			return p.readRest(0, pri, term.NewCallable(l.Text, []term.Term{}))
+			return p.readRest(0, pri, term.NewCallable(atomName(l.Text), []term.Term{}))
 
 		case scan.FunctorAtom:
 			tb := p.next()
@@ -112,7 +122,7 @@ func (p *Parser) readTerm(pri int) (term.Term, error) {
 				return nil, fmt.Errorf("Unterminated functor arguments")
 			}
 			p.next() // discard ')'
-			return p.readRest(0, pri, term.NewCallable(l.Text, fargs))
+			return p.readRest(0, pri, term.NewCallable(atomName(l.Text), fargs))
 
 		case scan.LeftParen:
 			t0, err := p.readTerm(1200)
@@ -174,7 +184,7 @@ func (p *Parser) readRest(lpri, pri int, lt term.Term) (term.Term, error) {
 		case scan.Newline:
 			p.next()
 			continue
-		case scan.Atom, scan.Comma, scan.SpecialAtom:
+		case scan.Atom, scan.Comma, scan.SpecialAtom, scan.SemiColon:
 			loppri, oppri, roppri, ok := p.operators.Infix(l.Text)
 			if ok && pri >= oppri && lpri <= loppri {
 				p.next() // consume the token
@@ -266,3 +276,13 @@ func (p *Parser) readListItems() ([]term.Term, error) {
 
 	return lis, nil
 }
+
+// atomName returns the name of the atom read as the token text s. A
+// quoted atom is named as term.TextAtom names its text, so that 'abc'
+// and abc are the same atom.
+func atomName(s string) string {
+	if !strings.HasPrefix(s, "'") {
+		return s
+	}
+	return string(term.TextAtom(term.Atom(s).Text()))
+}
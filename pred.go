@@ -0,0 +1,296 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// Functor identifies a predicate, or structure, by name and arity
+type Functor struct {
+	Name  AtomID
+	Arity int
+}
+
+// NewFunctor returns the functor name/arity, interning name
+func NewFunctor(name term.Atom, arity int) Functor {
+	return Functor{Intern(name), arity}
+}
+
+func (f Functor) String() string {
+	return fmt.Sprintf("%s/%d", f.Name, f.Arity)
+}
+
+// keyType classifies the first argument of a clause head, for
+// indexing
+type keyType int
+
+const (
+	keyVar  keyType = iota // a variable, matching any argument
+	keyCon                 // an atom
+	keyNum                 // a number
+	keyList                // a list pair
+	keyStr                 // a structure
+)
+
+// argKey is the index key for the first argument of a clause head
+type argKey struct {
+	Type    keyType
+	Functor Functor // the atom, or functor of a structure
+	Num     Cell    // the INT cell of a small integer
+	Text    string  // the text of any other number
+}
+
+func (k argKey) String() string {
+	switch k.Type {
+	case keyVar:
+		return "var"
+	case keyCon:
+		return k.Functor.Name.String()
+	case keyNum:
+		if k.Text != "" {
+			return k.Text
+		}
+		return strconv.FormatInt(k.Num.Int(), 10)
+	case keyList:
+		return "list"
+	default:
+		return k.Functor.String()
+	}
+}
+
+// cellKey returns the index key for the dereferenced cell c
+func (m *Machine) cellKey(c Cell) argKey {
+	switch c.Tag() {
+	case CON:
+		return argKey{Type: keyCon, Functor: Functor{Name: c.Atom()}}
+	case INT:
+		return argKey{Type: keyNum, Num: c}
+	case NUM:
+		return argKey{Type: keyNum, Text: term.Format(m.constant(c))}
+	case LIS:
+		return argKey{Type: keyList}
+	case STR:
+		return argKey{Type: keyStr, Functor: m.cell(c.Addr()).Functor()}
+	default:
+		return argKey{Type: keyVar}
+	}
+}
+
+// constArgKey returns the index key for the atom or number c
+func constArgKey(c term.Term) argKey {
+	switch c := c.(type) {
+	case term.Atom:
+		return argKey{Type: keyCon, Functor: Functor{Name: Intern(c)}}
+	default:
+		if cell, ok := fixedCell(c); ok {
+			return argKey{Type: keyNum, Num: cell}
+		}
+		return argKey{Type: keyNum, Text: term.Format(c)}
+	}
+}
+
+// Clause is the compiled code of a single clause
+type Clause struct {
+	Code CodeCells
+	key  argKey
+}
+
+// Predicate holds the compiled clauses of a single predicate, in
+// the order they were defined.
+type Predicate struct {
+	Functor Functor
+	Clauses []*Clause
+}
+
+// predTable groups clauses by predicate. Clauses for a predicate
+// need not be contiguous in the source.
+type predTable struct {
+	preds map[Functor]*Predicate
+	order []Functor // the order predicates were first defined
+}
+
+func newPredTable() *predTable {
+	return &predTable{
+		preds: map[Functor]*Predicate{},
+	}
+}
+
+// add appends the clause c to the predicate f
+func (pt *predTable) add(f Functor, c *Clause) {
+	p, ok := pt.preds[f]
+	if !ok {
+		p = &Predicate{Functor: f}
+		pt.preds[f] = p
+		pt.order = append(pt.order, f)
+	}
+	p.Clauses = append(p.Clauses, c)
+}
+
+// link lays out the code for all predicates, starting at offset
+// base. Predicates with more than one clause have their clauses
+// chained with try_me_else, retry_me_else and trust_me. The
+// returned labels give the entry point of each predicate.
+func (pt *predTable) link(base int) (CodeCells, map[Functor]int) {
+	code := CodeCells{}
+	labels := map[Functor]int{}
+
+	for _, f := range pt.order {
+		p := pt.preds[f]
+		labels[f] = base + len(code)
+		code = append(code, p.link(base+len(code))...)
+	}
+
+	return code, labels
+}
+
+// link lays out the code for the clauses of p, starting at offset
+// base. If the first arguments of the clause heads distinguish them,
+// the clauses are preceded by a switch on the first argument, so that
+// calls only try the clauses that can match.
+func (p *Predicate) link(base int) CodeCells {
+	if len(p.Clauses) == 1 {
+		return p.Clauses[0].Code
+	}
+
+	code := CodeCells{}
+	indexed := p.indexed()
+	if indexed {
+		// switch_on_term, filled in once the index is laid out
+		code = append(code, CodeCell{})
+	}
+
+	starts := make([]int, len(p.Clauses))
+	for i, c := range p.Clauses {
+		// The next alternative follows this clause, and its
+		// choice point instruction
+		next := base + len(code) + 1 + len(c.Code)
+		switch i {
+		case 0:
+			code = append(code, cc(TryMeElse(next)))
+		case len(p.Clauses) - 1:
+			code = append(code, cc(TrustMe()))
+		default:
+			code = append(code, cc(RetryMeElse(next)))
+		}
+		starts[i] = base + len(code)
+		code = append(code, c.Code...)
+	}
+
+	if !indexed {
+		return code
+	}
+
+	// The clauses to try for each key include those with a
+	// variable first argument, in the order they were defined.
+	vars := []int{}
+	lists := []int{}
+	keys := []argKey{}
+	cands := map[argKey][]int{}
+	for i, c := range p.Clauses {
+		switch c.key.Type {
+		case keyVar:
+			vars = append(vars, i)
+			lists = append(lists, i)
+			for _, k := range keys {
+				cands[k] = append(cands[k], i)
+			}
+		case keyList:
+			lists = append(lists, i)
+		default:
+			if _, ok := cands[c.key]; !ok {
+				keys = append(keys, c.key)
+				cands[c.key] = append([]int{}, vars...)
+			}
+			cands[c.key] = append(cands[c.key], i)
+		}
+	}
+
+	// block lays out a sequence of clauses to try, returning its label
+	block := func(cs []int) int {
+		switch len(cs) {
+		case 0:
+			return -1
+		case 1:
+			return starts[cs[0]]
+		}
+		l := base + len(code)
+		for i, ci := range cs {
+			switch i {
+			case 0:
+				code = append(code, cc(Try(starts[ci])))
+			case len(cs) - 1:
+				code = append(code, cc(Trust(starts[ci])))
+			default:
+				code = append(code, cc(Retry(starts[ci])))
+			}
+		}
+		return l
+	}
+
+	def := block(vars)
+	ll := block(lists)
+
+	// table lays out a switch over the keys for which match returns
+	// true, returning its label
+	table := func(match func(argKey) bool, sw func(map[argKey]int, int) (machineFunc, string)) int {
+		ks := []argKey{}
+		for _, k := range keys {
+			if match(k) {
+				ks = append(ks, k)
+			}
+		}
+		if len(ks) == 0 {
+			return def
+		}
+
+		l := len(code)
+		code = append(code, CodeCell{})
+		t := map[argKey]int{}
+		for _, k := range ks {
+			t[k] = block(cands[k])
+		}
+		code[l] = cc(sw(t, def))
+		return base + l
+	}
+
+	lc := table(func(k argKey) bool { return k.Type == keyCon || k.Type == keyNum }, SwitchOnConstant)
+	ls := table(func(k argKey) bool { return k.Type == keyStr }, SwitchOnStructure)
+
+	code[0] = cc(SwitchOnTerm(base+1, lc, ll, ls))
+
+	return code
+}
+
+// indexed reports whether indexing on the first argument of p could
+// reduce the clauses tried by a call.
+func (p *Predicate) indexed() bool {
+	if p.Functor.Arity == 0 {
+		return false
+	}
+	for _, c := range p.Clauses {
+		if c.key.Type != keyVar {
+			return true
+		}
+	}
+	return false
+}
+
+// cc builds a CodeCell from the output of an instruction constructor
+func cc(fn machineFunc, str string) CodeCell {
+	return CodeCell{fn, str}
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// ErrCyclicTerm is returned when decoding a binding whose value
+// contains itself, and so cannot be represented as a term.Term.
+var ErrCyclicTerm = errors.New("cyclic term")
+
+// Solutions iterates over the answers to a query. The first call to
+// Next runs the query, subsequent calls backtrack into the most recent
+// choice point to find the next answer.
+//
+//	sols := m.Query(q)
+//	defer sols.Close()
+//	for sols.Next() {
+//		...
+//	}
+type Solutions struct {
+	m       *Machine
+	base    int // the start of the query code
+	closed  bool
+	started bool
+	done    bool
+}
+
+// Query prepares the query code cs to be run against the loaded
+// program. The query is placed after the program code, followed by
+// any code compiled while it runs. Only one query may be active on a
+// machine at a time, the previous query should be closed before a
+// new one is started.
+func (m *Machine) Query(cs CodeCells) *Solutions {
+	base := len(m.Code)
+	m.Code = append(m.Code[:base:base], cs...)
+	m.PReg = base
+	m.Finished = false
+	m.Failed = false
+	m.Err = nil
+	m.ball = nil
+	m.dynCode = map[string]int{}
+	m.libLabels = nil
+	m.HReg = 0
+	m.nums.reset()
+	m.nbArgs = nil
+	m.EReg = -1
+	m.LiveReg = 0
+	m.BReg = -1
+	m.HBReg = 0
+	m.TRReg = 0
+	m.GBReg = -1
+	m.gcNext = 0
+
+	return &Solutions{m: m, base: base}
+}
+
+// Next finds the next solution to the query, it returns false if
+// there are no more solutions.
+func (s *Solutions) Next() bool {
+	if s.done {
+		return false
+	}
+
+	m := s.m
+	if s.started {
+		// Reject the previous solution
+		m.Finished = false
+		m.fail()
+	}
+	s.started = true
+
+	m.execute()
+
+	if m.Failed {
+		s.done = true
+		return false
+	}
+	return true
+}
+
+// Err returns the error that stopped the query, if any
+func (s *Solutions) Err() error {
+	return s.m.Err
+}
+
+// Close discards any remaining solutions, and removes the query
+// code from the machine.
+func (s *Solutions) Close() {
+	if s.closed {
+		return
+	}
+	s.done = true
+	s.closed = true
+	s.m.Code = s.m.Code[:s.base]
+	s.m.dynCode = nil
+	s.m.libLabels = nil
+	s.m.BReg = -1
+}
+
+// Bindings decodes the values of the query variables in vars, as
+// returned by the query compiler, for the current solution.
+func (s *Solutions) Bindings(vars map[term.Variable]Reg) (map[term.Variable]term.Term, error) {
+	bs := map[term.Variable]term.Term{}
+	for v, r := range vars {
+		t, err := s.m.Binding(r)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s, %w", string(v), err)
+		}
+		bs[v] = t
+	}
+	return bs, nil
+}
+
+// Binding decodes the value held in register r into a term.
+// Unbound variables are returned as fresh variables named after
+// their heap address.
+func (m *Machine) Binding(r Reg) (term.Term, error) {
+	return m.decode(m.regPtr(r), map[Addr]bool{})
+}
+
+// encode builds the term t on the heap, returning the cell that
+// refers to it. Variables of the same name are built as the same
+// variable, other than _, which is always a new variable. If the heap
+// is full, encode returns false.
+func (m *Machine) encode(t term.Term, vars map[term.Variable]Cell) (Cell, bool) {
+	if c, ok := constant(t); ok {
+		return m.constCell(c), true
+	}
+	switch t := t.(type) {
+	case term.Variable:
+		if c, ok := vars[t]; ok {
+			return c, true
+		}
+		if !m.reserve(1) {
+			return 0, false
+		}
+		c := refCell(heapAddr(m.HReg))
+		m.Heap[m.HReg] = c
+		m.HReg++
+		if t != "_" {
+			vars[t] = c
+		}
+		return c, true
+	case *term.Callable:
+		fn, n := t.Functor()
+		// list pairs are held without a functor cell
+		h, args := m.HReg, m.HReg
+		if !isList(t) {
+			args++
+		}
+		if !m.reserve(args - h + n) {
+			return 0, false
+		}
+		m.HReg = args + n
+		if !isList(t) {
+			m.Heap[h] = funCell(NewFunctor(term.Atom(fn), n))
+		}
+		for i, at := range t.Args() {
+			c, ok := m.encode(at, vars)
+			if !ok {
+				return 0, false
+			}
+			m.Heap[args+i] = c
+		}
+		if isList(t) {
+			return lisCell(heapAddr(h)), true
+		}
+		return strCell(heapAddr(h)), true
+	default:
+		panic(fmt.Errorf("cannot encode %s", t))
+	}
+}
+
+// decode reconstructs the term at a, path holds the structures
+// currently being decoded, so that cycles can be detected.
+func (m *Machine) decode(a Addr, path map[Addr]bool) (term.Term, error) {
+	a = m.deref(a)
+	switch c := m.cell(a); c.Tag() {
+	case REF:
+		return term.NewVariable(fmt.Sprintf("_G%d", a.offset())), nil
+	case CON:
+		if c.Atom() == atomNil {
+			return term.NewCallable("cons", nil), nil
+		}
+		return term.NewCallable(c.Atom().String(), nil), nil
+	case INT, NUM:
+		return m.constant(c), nil
+	case LIS:
+		if path[c.Addr()] {
+			return nil, ErrCyclicTerm
+		}
+		path[c.Addr()] = true
+		defer delete(path, c.Addr())
+
+		args := make([]term.Term, 2)
+		for i := range args {
+			at, err := m.decode(c.Addr()+Addr(i), path)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = at
+		}
+		return term.NewCallable("cons", args), nil
+	case STR:
+		if path[c.Addr()] {
+			return nil, ErrCyclicTerm
+		}
+		path[c.Addr()] = true
+		defer delete(path, c.Addr())
+
+		fc := m.cell(c.Addr())
+		if fc.Tag() != FUN {
+			return nil, fmt.Errorf("structure does not point to a functor, %s", fc)
+		}
+		f := fc.Functor()
+		args := make([]term.Term, f.Arity)
+		for i := range args {
+			at, err := m.decode(c.Addr()+Addr(1+i), path)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = at
+		}
+		return term.NewCallable(f.Name.String(), args), nil
+	default:
+		return nil, fmt.Errorf("cannot decode cell %s", c)
+	}
+}
@@ -0,0 +1,709 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/tcolgate/golorp/context"
+	"github.com/tcolgate/golorp/parse"
+	"github.com/tcolgate/golorp/scan"
+	"github.com/tcolgate/golorp/term"
+)
+
+type qtest struct {
+	name string
+	q    CodeCells
+	n    int
+}
+
+var qtests = []qtest{
+	{
+		"likes(sam,X)",
+		CodeCells{
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutVariable(X(2), 1)),
+			cc(Call("likes", 2, 0)),
+			cc(Halt()),
+		},
+		3,
+	},
+	{
+		"likes(sam,apple)",
+		CodeCells{
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutStructure("apple", 0, 1)),
+			cc(Call("likes", 2, 0)),
+			cc(Halt()),
+		},
+		1,
+	},
+	{
+		"likes(sam,eggs)",
+		CodeCells{
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutStructure("eggs", 0, 1)),
+			cc(Call("likes", 2, 0)),
+			cc(Halt()),
+		},
+		0,
+	},
+	{
+		"likes(X,Y), likes(sam,Z)",
+		CodeCells{
+			cc(PutVariable(X(2), 0)),
+			cc(PutVariable(X(3), 1)),
+			cc(Call("likes", 2, 0)),
+			cc(PutStructure("sam", 0, 0)),
+			cc(PutVariable(X(2), 1)),
+			cc(Call("likes", 2, 0)),
+			cc(Halt()),
+		},
+		9,
+	},
+}
+
+func TestQuerySolutions(t *testing.T) {
+	for _, st := range qtests {
+		t.Run(st.name, func(t *testing.T) {
+			m := NewMachine()
+			m.Load(l3Program, l3Labels)
+
+			sols := m.Query(st.q)
+			defer sols.Close()
+
+			n := 0
+			for sols.Next() {
+				n++
+			}
+			if n != st.n {
+				t.Fatalf("expected %d solutions, got %d", st.n, n)
+			}
+			if sols.Next() {
+				t.Fatalf("expected no more solutions")
+			}
+		})
+	}
+}
+
+func TestQueryClose(t *testing.T) {
+	m := NewMachine()
+	m.Load(l3Program, l3Labels)
+
+	sols := m.Query(qtests[0].q)
+	if !sols.Next() {
+		t.Fatalf("expected a solution")
+	}
+	sols.Close()
+	if sols.Next() {
+		t.Fatalf("expected no solutions after close")
+	}
+	if len(m.Code) != len(l3Program) {
+		t.Fatalf("query code was not removed")
+	}
+
+	sols = m.Query(qtests[1].q)
+	defer sols.Close()
+	if !sols.Next() {
+		t.Fatalf("expected a solution from a second query")
+	}
+}
+
+type btest struct {
+	q    string
+	p    string
+	exp  map[term.Variable]string
+	err  error
+	same []term.Variable // variables expected to be bound to one another
+}
+
+var btests = []btest{
+	{
+		q:   `p(Z,h(Z,W),f(W)).`,
+		p:   `p(f(X),h(Y,f(a)),Y).`,
+		exp: map[term.Variable]string{"Z": "f(f(a))", "W": "f(a)"},
+	},
+	{
+		q:   `likes(sam,X).`,
+		p:   `likes(sam,cons(apple,cons(ham,cons))).`,
+		exp: map[term.Variable]string{"X": "[apple,ham]"},
+	},
+	{
+		q:    `p(X,Y).`,
+		p:    `p(A,A).`,
+		same: []term.Variable{"X", "Y"},
+	},
+	{
+		q:   `p(X,X).`,
+		p:   `p(Y,f(Y)).`,
+		err: ErrCyclicTerm,
+	},
+	{
+		q:   `p(a,Y).`,
+		p:   `p(X,Y) :- q(X,Z), r(Z,Y). q(a,b). r(b,f(c)).`,
+		exp: map[term.Variable]string{"Y": "f(c)"},
+	},
+	{
+		q: `gp(a,Y), likes(Y,Z).`,
+		p: `gp(X,Z) :- p(X,Y), p(Y,Z).
+p(X,f(X,_)) :- true.
+true.
+likes(f(f(_,_),_),cheese).`,
+		exp: map[term.Variable]string{"Z": "cheese"},
+	},
+}
+
+func TestQueryBindings(t *testing.T) {
+	var ctx context.Context
+	for _, st := range btests {
+		t.Run(st.q, func(t *testing.T) {
+			s := scan.New(ctx, "file.pl", bytes.NewBuffer([]byte(st.q)))
+			q, _ := parse.New("file.pl", s).NextTerm()
+
+			s = scan.New(ctx, "file.pl", bytes.NewBuffer([]byte(st.p)))
+			pp := parse.New("file.pl", s)
+			ps := []term.Term{}
+			for {
+				p, err := pp.NextTerm()
+				if err != nil {
+					break
+				}
+				ps = append(ps, p)
+			}
+
+			m := NewMachine()
+			m.Load(compileL1Program(ps))
+
+			qcs, vars := compileL1Query(q)
+			sols := m.Query(qcs)
+			defer sols.Close()
+
+			if !sols.Next() {
+				t.Fatalf("expected a solution")
+			}
+
+			bs, err := sols.Bindings(vars)
+			if st.err != nil {
+				if !errors.Is(err, st.err) {
+					t.Fatalf("expected error %v, got %v", st.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+
+			for v, exp := range st.exp {
+				if got := term.Format(bs[v]); got != exp {
+					t.Fatalf("expected %s = %s, got %s", string(v), exp, got)
+				}
+			}
+			for _, v := range st.same {
+				if _, ok := bs[v].(term.Variable); !ok {
+					t.Fatalf("expected %s to be unbound, got %s", string(v), bs[v])
+				}
+				if bs[v] != bs[st.same[0]] {
+					t.Fatalf("expected %s = %s, got %s", string(v), bs[st.same[0]], bs[v])
+				}
+			}
+		})
+	}
+}
+
+// loadProgram parses and compiles src, and loads it into a new machine
+func loadProgram(t testing.TB, src string) *Machine {
+	m := NewMachine()
+	m.Load(compileL1Program(parseProgram(t, src)))
+	return m
+}
+
+// parseProgram parses all the clauses in src
+func parseProgram(t testing.TB, src string) []term.Term {
+	var ctx context.Context
+	s := scan.New(ctx, "file.pl", bytes.NewBuffer([]byte(src)))
+	pp := parse.New("file.pl", s)
+	ps := []term.Term{}
+	for {
+		p, err := pp.NextTerm()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("parsing program failed, %v", err)
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// allSolutions runs the query src on m, returning the value of v for
+// each solution, and the error that stopped the query, if any.
+func allSolutions(t *testing.T, m *Machine, src string, v term.Variable) ([]string, error) {
+	var ctx context.Context
+	s := scan.New(ctx, "file.pl", bytes.NewBuffer([]byte(src)))
+	q, err := parse.New("file.pl", s).NextTerm()
+	if err != nil {
+		t.Fatalf("parsing query failed, %v", err)
+	}
+
+	qcs, vars := compileL1Query(q)
+	sols := m.Query(qcs)
+	defer sols.Close()
+
+	res := []string{}
+	for sols.Next() {
+		bs, err := sols.Bindings(vars)
+		if err != nil {
+			t.Fatalf("decoding bindings failed, %v", err)
+		}
+		res = append(res, term.Format(bs[v]))
+	}
+	return res, sols.Err()
+}
+
+type atest struct {
+	q   string
+	p   string
+	v   term.Variable
+	exp []string
+	err error
+}
+
+var atests = []atest{
+	{
+		q:   `likes(sam,X).`,
+		p:   `likes(sam,orange). likes(sam,apple). likes(bob,ham). likes(sam,eggs).`,
+		v:   "X",
+		exp: []string{"orange", "apple", "eggs"},
+	},
+	{
+		q: `likes(sam,X).`,
+		p: `likes(sam,orange).
+food(orange).
+likes(sam,apple).
+food(apple).`,
+		v:   "X",
+		exp: []string{"orange", "apple"},
+	},
+	{
+		q: `eats(X,F).`,
+		p: `eats(X,F) :- likes(X,F), food(F).
+likes(sam,orange). likes(bob,stone). likes(bob,apple).
+food(orange). food(apple).`,
+		v:   "X",
+		exp: []string{"sam", "bob"},
+	},
+	{
+		q:   `p(a,X).`,
+		p:   `p(a,one). p(X,two). p(b,three). p(a,four). p(f(X),five).`,
+		v:   "X",
+		exp: []string{"one", "two", "four"},
+	},
+	{
+		q:   `p(b,X).`,
+		p:   `p(a,one). p(X,two). p(b,three). p(a,four). p(f(X),five).`,
+		v:   "X",
+		exp: []string{"two", "three"},
+	},
+	{
+		q:   `p(c,X).`,
+		p:   `p(a,one). p(X,two). p(b,three). p(a,four). p(f(X),five).`,
+		v:   "X",
+		exp: []string{"two"},
+	},
+	{
+		q:   `p(f(x),X).`,
+		p:   `p(a,one). p(X,two). p(b,three). p(a,four). p(f(X),five).`,
+		v:   "X",
+		exp: []string{"two", "five"},
+	},
+	{
+		q:   `p(Y,X).`,
+		p:   `p(a,one). p(X,two). p(b,three). p(a,four). p(f(X),five).`,
+		v:   "X",
+		exp: []string{"one", "two", "three", "four", "five"},
+	},
+	{
+		q:   `p(c,X).`,
+		p:   `p(a,one). p(b,two).`,
+		v:   "X",
+		exp: []string{},
+	},
+	{
+		q:   `app(X,Y,[a,b]).`,
+		p:   `app([],L,L). app([H|T],L,[H|R]) :- app(T,L,R).`,
+		v:   "X",
+		exp: []string{"[]", "[a]", "[a,b]"},
+	},
+	{
+		q:   `app([a],[b,c],X).`,
+		p:   `app([],L,L). app([H|T],L,[H|R]) :- app(T,L,R).`,
+		v:   "X",
+		exp: []string{"[a,b,c]"},
+	},
+	{
+		q:   `n(X,two).`,
+		p:   `n(1,one). n(2,two). n(f(1),three).`,
+		v:   "X",
+		exp: []string{"2"},
+	},
+	{
+		q:   `n(f(1),X).`,
+		p:   `n(1,one). n(2,two). n(f(1),three).`,
+		v:   "X",
+		exp: []string{"three"},
+	},
+	{
+		q:   `first(X).`,
+		p:   `p(a). p(b). p(c). first(X) :- p(X), !.`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `t(X).`,
+		p:   `p(a). p(b). p(c). t(X) :- !, p(X). t(z).`,
+		v:   "X",
+		exp: []string{"a", "b", "c"},
+	},
+	{
+		q:   `p(X), !.`,
+		p:   `p(a). p(b). p(c).`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `c(a,X).`,
+		p:   `p(a). p(b). p(c). c(a,one) :- !. c(_,other).`,
+		v:   "X",
+		exp: []string{"one"},
+	},
+	{
+		q:   `c(b,X).`,
+		p:   `p(a). p(b). p(c). c(a,one) :- !. c(_,other).`,
+		v:   "X",
+		exp: []string{"other"},
+	},
+	{
+		q:   `outer(X).`,
+		p:   `p(a). p(b). p(c). outer(X) :- inner(X). outer(d). inner(X) :- p(X), !.`,
+		v:   "X",
+		exp: []string{"a", "d"},
+	},
+	{
+		q:   `two(X,Y).`,
+		p:   `p(a). p(b). p(c). two(X,Y) :- p(X), p(Y), !.`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `both(X).`,
+		p:   `p(a). p(b). p(c). both(X) :- p(X), q(X), !. q(b). q(c).`,
+		v:   "X",
+		exp: []string{"b"},
+	},
+	{
+		q:   `or(X).`,
+		p:   `p(a). p(b). or(X) :- (p(X) ; X = c ; X = d). X = X.`,
+		v:   "X",
+		exp: []string{"a", "b", "c", "d"},
+	},
+	{
+		q:   `(p(X) ; X = z), q(X).`,
+		p:   `p(a). p(b). q(b). q(z). X = X.`,
+		v:   "X",
+		exp: []string{"b", "z"},
+	},
+	{
+		q:   `ite(X,Y).`,
+		p:   `p(a). p(b). ite(X,Y) :- (p(X) -> Y = yes ; Y = no). X = X.`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `ite(c,Y).`,
+		p:   `p(a). p(b). ite(X,Y) :- (p(X) -> Y = yes ; Y = no). X = X.`,
+		v:   "Y",
+		exp: []string{"no"},
+	},
+	{
+		q:   `(p(X) -> true).`,
+		p:   `p(a). p(b).`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `(q(X) -> true).`,
+		p:   `p(a). q(X) :- fail.`,
+		v:   "X",
+		exp: []string{},
+	},
+	{
+		q:   `soft(X).`,
+		p:   `p(a). p(b). soft(X) :- (p(X) *-> true ; X = none). X = X.`,
+		v:   "X",
+		exp: []string{"a", "b"},
+	},
+	{
+		q:   `soft(X).`,
+		p:   `soft(X) :- (q(X) *-> true ; X = none). q(X) :- fail. X = X.`,
+		v:   "X",
+		exp: []string{"none"},
+	},
+	{
+		q:   `soft(X), !.`,
+		p:   `p(a). p(b). soft(X) :- (p(X) *-> true ; X = none). X = X.`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `p(X), \+ q(X).`,
+		p:   `p(a). p(b). p(c). q(b).`,
+		v:   "X",
+		exp: []string{"a", "c"},
+	},
+	{
+		q:   `p(X), \+ \+ q(X).`,
+		p:   `p(a). p(b). p(c). q(b).`,
+		v:   "X",
+		exp: []string{"b"},
+	},
+	{
+		q:   `max(a,X).`,
+		p:   `p(a). p(b). p(c). max(X,Y) :- (p(Z), Z = c -> Y = Z ; Y = X), !. max(_,none). X = X.`,
+		v:   "X",
+		exp: []string{"c"},
+	},
+	{
+		q:   `t(X).`,
+		p:   `p(a). p(b). t(X) :- (p(X), ! ; X = c). t(d). X = X.`,
+		v:   "X",
+		exp: []string{"a"},
+	},
+	{
+		q:   `t(X).`,
+		p:   `p(a). p(b). t(X) :- (p(_) -> ! ; true), p(X). t(d).`,
+		v:   "X",
+		exp: []string{"a", "b"},
+	},
+	{
+		q:   `t(X).`,
+		p:   `p(a). p(b). t(X) :- ((p(X), !) -> true ; true). t(d).`,
+		v:   "X",
+		exp: []string{"a", "d"},
+	},
+	{
+		q:   `t(X).`,
+		p:   `t(X) :- ((!, fail) -> X = then ; X = else). X = X.`,
+		v:   "X",
+		exp: []string{"else"},
+	},
+	{
+		q:   `t(X).`,
+		p:   `t(X) :- \+ (!, fail), X = ok. X = X.`,
+		v:   "X",
+		exp: []string{"ok"},
+	},
+	{
+		q:   `likes(sam,X).`,
+		p:   `hates(sam,orange).`,
+		v:   "X",
+		exp: []string{},
+		err: ExistenceError{NewFunctor("likes", 2)},
+	},
+	{
+		q:   `likes(sam,X,Y).`,
+		p:   `likes(sam,orange).`,
+		v:   "X",
+		exp: []string{},
+		err: ExistenceError{NewFunctor("likes", 3)},
+	},
+}
+
+func TestQueryAllSolutions(t *testing.T) {
+	for _, st := range atests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, st.p)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if err != st.err {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
+
+func TestQueryIndexingDeterministic(t *testing.T) {
+	m := loadProgram(t, `colour(red,warm). colour(blue,cold). colour(green,cold).`)
+
+	var ctx context.Context
+	s := scan.New(ctx, "file.pl", bytes.NewBuffer([]byte(`colour(blue,X).`)))
+	q, _ := parse.New("file.pl", s).NextTerm()
+
+	qcs, _ := compileL1Query(q)
+	sols := m.Query(qcs)
+	defer sols.Close()
+
+	if !sols.Next() {
+		t.Fatalf("expected a solution")
+	}
+	if m.BReg != -1 {
+		t.Fatalf("expected no choice points, got B = %d", m.BReg)
+	}
+}
+
+func TestQueryGrowsStorage(t *testing.T) {
+	m := NewMachine()
+	m.Heap = make([]Cell, 4)
+	m.XRegisters = make([]Cell, 1)
+	m.Load(compileL1Program(parseProgram(t, `len([],z). len([H|T],s(N)) :- len(T,N).`)))
+
+	res, err := allSolutions(t, m, `len([a,b,c,d,e,f,g,h,i,j],N).`, "N")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	exp := []string{"s(s(s(s(s(s(s(s(s(s(z))))))))))"}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v, got %v", exp, res)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	ltests := []struct {
+		name  string
+		limit func(m *Machine)
+		p     string
+		q     string
+		err   error
+	}{
+		{
+			"heap",
+			func(m *Machine) { m.MaxHeap = 100 },
+			`grow(X) :- grow(f(X)).`,
+			`grow(a).`,
+			ResourceError{"heap"},
+		},
+		{
+			"stack",
+			func(m *Machine) { m.MaxStack = 100 },
+			`deep :- deep, back. back.`,
+			`deep.`,
+			ResourceError{"stack"},
+		},
+		{
+			"trail",
+			func(m *Machine) { m.MaxTrail = 10 },
+			`bind([]). bind([a|T]) :- bind(T). bind([b|T]) :- bind(T).`,
+			`bind([A,B,C,D,E,F,G,H,I,J,K,L]).`,
+			ResourceError{"trail"},
+		},
+	}
+
+	for _, st := range ltests {
+		t.Run(st.name, func(t *testing.T) {
+			m := loadProgram(t, st.p)
+			st.limit(m)
+			_, err := allSolutions(t, m, st.q, "X")
+			if err != st.err {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+		})
+	}
+}
+
+func TestQueryTailRecursion(t *testing.T) {
+	m := loadProgram(t, `
+junk(X, X).
+walk(z, done).
+walk(s(N), R) :- junk(f(N), _), walk(N, R).
+`)
+	res, err := allSolutions(t, m, "walk("+nat(20000)+",R).", "R")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(res, []string{"done"}) {
+		t.Fatalf("expected [done], got %v", res)
+	}
+	if len(m.AndStack) > 2 {
+		t.Fatalf("expected constant stack, got %d environments", len(m.AndStack))
+	}
+	if len(m.Stack) > initialStack {
+		t.Fatalf("expected constant stack, got %d permanent variables", len(m.Stack))
+	}
+}
+
+func TestQueryTailRecursionInBranch(t *testing.T) {
+	m := loadProgram(t, `
+walk(N, R) :- (N = z -> R = done ; N = s(M), walk(M, R)).
+X = X.
+`)
+	res, err := allSolutions(t, m, "walk("+nat(20000)+",R).", "R")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(res, []string{"done"}) {
+		t.Fatalf("expected [done], got %v", res)
+	}
+	if len(m.AndStack) > 2 {
+		t.Fatalf("expected constant stack, got %d environments", len(m.AndStack))
+	}
+	if len(m.OrStack) > 1 {
+		t.Fatalf("expected choice points to be cut, got %d", len(m.OrStack))
+	}
+}
+
+func TestQueryTrimmingBacktracking(t *testing.T) {
+	p := `
+member(X, [X|_]).
+member(X, [_|T]) :- member(X, T).
+app([], L, L).
+app([H|T], L, [H|R]) :- app(T, L, R).
+nrev([], []).
+nrev([H|T], R) :- nrev(T, RT), app(RT, [H], R).
+eq(X, X).
+r(A, B) :- member(A, [1,2,3,4,5]), eq(B, A), nrev([1], _).
+s(L) :- findall(X, (member(X, [1,2,3]), X = Y, nrev([1,2], _)), L).
+c(A, B) :- call(member(A, [1,2,3])), eq(B, A), nrev([1,2], _).
+k(A, B) :- catch(member(A, [1,2,3]), _, true), eq(B, A), nrev([1,2], _).
+X = X.
+`
+	ttests := []struct {
+		q   string
+		v   term.Variable
+		exp []string
+	}{
+		{`r(X, Y).`, "Y", []string{"1", "2", "3", "4", "5"}},
+		{`s(L).`, "L", []string{"[1,2,3]"}},
+		{`c(X, Y).`, "Y", []string{"1", "2", "3"}},
+		{`k(X, Y).`, "Y", []string{"1", "2", "3"}},
+	}
+
+	for _, st := range ttests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, p)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
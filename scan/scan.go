@@ -31,9 +31,10 @@ import (
 
 // Token represents a token or text string returned from the scanner.
 type Token struct {
-	Type Type   // The type of this item.
-	Line int    // The line number on which this token appears
-	Text string // The text of this item.
+	Type   Type   // The type of this item.
+	Line   int    // The line number on which this token appears
+	Text   string // The text of this item.
+	Layout bool   // Whether layout text came before this item.
 }
 
 //go:generate stringer -type Type
@@ -63,7 +64,12 @@ const (
 	SemiColon   // ;
 )
 
-const special = "=+-*/<>=:.&_~"
+const special = "=+-*/\\<>=:.&_~?@#$^"
+
+const (
+	digits    = "0123456789"
+	hexDigits = "0123456789abcdefABCDEF"
+)
 
 func (i Token) String() string {
 	switch {
@@ -95,6 +101,7 @@ type Scanner struct {
 	leftDelim  string  // start of action
 	rightDelim string  // end of action
 	state      stateFn // the next lexing function to enter
+	layout     bool    // layout text has been skipped since the last item
 	line       int     // line number in input
 	pos        int     // current position in the input
 	start      int     // start position of this item
@@ -158,9 +165,10 @@ func (l *Scanner) emit(t Type) {
 	}
 	s := l.input[l.start:l.pos]
 	if l.context.Debug {
-		fmt.Fprintf(os.Stderr, "%s:%d: emit %s\n", l.name, l.line, Token{t, l.line, s})
+		fmt.Fprintf(os.Stderr, "%s:%d: emit %s\n", l.name, l.line, Token{t, l.line, s, l.layout})
 	}
-	l.tokens <- Token{t, l.line, s}
+	l.tokens <- Token{t, l.line, s, l.layout}
+	l.layout = false
 	l.start = l.pos
 	l.width = 0
 }
@@ -179,6 +187,22 @@ func (l *Scanner) accept(valid string) bool {
 	return false
 }
 
+// acceptSuffix consumes a rune from the prefix set, an optional rune
+// from the sign set, and a non-empty run of runes from the valid set.
+// If they are not all present nothing is consumed.
+func (l *Scanner) acceptSuffix(prefix, sign, valid string) bool {
+	mark := l.pos - l.start
+	if l.accept(prefix) {
+		l.accept(sign)
+		if l.accept(valid) {
+			l.acceptRun(valid)
+			return true
+		}
+	}
+	l.pos = l.start + mark
+	return false
+}
+
 // acceptRun consumes a run of runes from the valid set.
 func (l *Scanner) acceptRun(valid string) {
 	for strings.IndexRune(valid, l.next()) >= 0 {
@@ -188,7 +212,7 @@ func (l *Scanner) acceptRun(valid string) {
 
 // errorf returns an error token and continues to scan.
 func (l *Scanner) errorf(format string, args ...interface{}) stateFn {
-	l.tokens <- Token{Error, l.start, fmt.Sprintf(format, args...)}
+	l.tokens <- Token{Error, l.start, fmt.Sprintf(format, args...), l.layout}
 	return lexAny
 }
 
@@ -223,7 +247,7 @@ func (l *Scanner) Next() Token {
 		close(l.tokens)
 		l.tokens = nil
 	}
-	return Token{EOF, l.pos, "EOF"}
+	return Token{EOF, l.pos, "EOF", l.layout}
 }
 
 // state functions
@@ -271,7 +295,10 @@ func lexAny(l *Scanner) stateFn {
 	case r == ',':
 		l.emit(Comma)
 		return lexAny
-	case unicode.IsDigit(r):
+	case r == '!':
+		l.emit(Atom)
+		return lexAny
+	case isDigit(r):
 		return lexNumber
 	case unicode.IsLower(r):
 		return lexAtom
@@ -337,6 +364,7 @@ func lexSpace(l *Scanner) stateFn {
 		l.next()
 	}
 	l.ignore()
+	l.layout = true
 	return lexAny
 }
 
@@ -372,7 +400,6 @@ Loop:
 		c := l.next()
 		switch {
 		case isAlphaNumeric(c):
-		case c == '/':
 		case c == '_':
 		default:
 			l.backup()
@@ -388,18 +415,38 @@ Loop:
 	return lexAny
 }
 
-// lexNumber
+// lexNumber scans a number, the first digit has been consumed. As
+// well as decimal integers, numbers may be floats, 1.5 or 1.0e10,
+// rationals, 1r3, character codes, 0'a, or 0x, 0o and 0b integers.
 func lexNumber(l *Scanner) stateFn {
-Loop:
-	for {
-		c := l.next()
+	if l.input[l.start:l.pos] == "0" {
 		switch {
-		case unicode.IsDigit(c):
-		default:
-			l.backup()
-			break Loop
+		case l.accept("'"):
+			switch l.next() {
+			case '\\':
+				l.next()
+			case '\'':
+				l.accept("'")
+			case eof, '\n':
+				return l.errorf("unterminated character code")
+			}
+			l.emit(Number)
+			return lexAny
+		case l.acceptSuffix("x", "", hexDigits),
+			l.acceptSuffix("o", "", "01234567"),
+			l.acceptSuffix("b", "", "01"):
+			l.emit(Number)
+			return lexAny
 		}
 	}
+
+	l.acceptRun(digits)
+	switch {
+	case l.acceptSuffix(".", "", digits):
+		l.acceptSuffix("eE", "+-", digits)
+	case l.acceptSuffix("eE", "+-", digits):
+	case l.acceptSuffix("r", "", digits):
+	}
 	l.emit(Number)
 	return lexAny
 }
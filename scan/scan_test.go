@@ -41,13 +41,23 @@ var tests = []test{
 	{"atom0", `cheese_a_thing`, []Token{Token{Type: Atom, Line: 1, Text: "cheese_a_thing"}}},
 	{"atom1", `'this atom'`, []Token{Token{Type: Atom, Line: 1, Text: "'this atom'"}}},
 	{"atom2", `'this \' atom'`, []Token{Token{Type: Atom, Line: 1, Text: "'this \\' atom'"}}},
+	{"cut", `!`, []Token{Token{Type: Atom, Line: 1, Text: "!"}}},
+	{"semicolon", `;`, []Token{Token{Type: SemiColon, Line: 1, Text: ";"}}},
+	{"negation", `\+`, []Token{Token{Type: SpecialAtom, Line: 1, Text: "\\+"}}},
+	{"float", `1.5e-3`, []Token{Token{Type: Number, Line: 1, Text: "1.5e-3"}}},
+	{"rational", `1r3`, []Token{Token{Type: Number, Line: 1, Text: "1r3"}}},
+	{"hex", `0xff`, []Token{Token{Type: Number, Line: 1, Text: "0xff"}}},
+	{"charcode", `0'a`, []Token{Token{Type: Number, Line: 1, Text: "0'a"}}},
+	{"stop", `1.`, []Token{Token{Type: Number, Line: 1, Text: "1"}, Token{Type: Stop, Line: 1, Text: "."}}},
+	{"exponent", `1e`, []Token{Token{Type: Number, Line: 1, Text: "1"}, Token{Type: Atom, Line: 1, Text: "e"}}},
 	{"variable0", `X`, []Token{Token{Type: Variable, Line: 1, Text: "X"}}},
 	{"variable1", `Food`, []Token{Token{Type: Variable, Line: 1, Text: "Food"}}},
 	{"cluase0", `likes(sam,Food).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Variable, Line: 1, Text: "Food"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
 	{"cluase1", `likes(sam,orange).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Atom, Line: 1, Text: "orange"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
 	{"cluase2", `likes(sam,_).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Unbound, Line: 1, Text: "_"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
-	{"cluase2", `likes/2(sam,__thing).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes/2"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Variable, Line: 1, Text: "__thing"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
-	{"cluase4", `likes/2(sam,Thing) :- yummy(Thing).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes/2"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Variable, Line: 1, Text: "Thing"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: SpecialAtom, Line: 1, Text: ":-"}, Token{Type: FunctorAtom, Line: 1, Text: "yummy"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Variable, Line: 1, Text: "Thing"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
+	{"cluase3", `likes(sam,__thing).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Variable, Line: 1, Text: "__thing"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
+	{"cluase4", `likes(sam,Thing) :- yummy(Thing).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "likes"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "sam"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Variable, Line: 1, Text: "Thing"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: SpecialAtom, Line: 1, Text: ":-", Layout: true}, Token{Type: FunctorAtom, Line: 1, Text: "yummy", Layout: true}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Variable, Line: 1, Text: "Thing"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
+	{"indicator", `foo/1`, []Token{Token{Type: Atom, Line: 1, Text: "foo"}, Token{Type: SpecialAtom, Line: 1, Text: "/"}, Token{Type: Number, Line: 1, Text: "1"}}},
 	{"cluase5", `eatenChocs(tristan,1000000).`, []Token{Token{Type: FunctorAtom, Line: 1, Text: "eatenChocs"}, Token{Type: LeftParen, Line: 1, Text: "("}, Token{Type: Atom, Line: 1, Text: "tristan"}, Token{Type: Comma, Line: 1, Text: ","}, Token{Type: Number, Line: 1, Text: "1000000"}, Token{Type: RightParen, Line: 1, Text: ")"}, Token{Type: Stop, Line: 1, Text: "."}}},
 }
 
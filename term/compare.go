@@ -0,0 +1,117 @@
+package term
+
+import (
+	"math/big"
+	"strings"
+)
+
+// The classes of terms, in the standard order
+const (
+	classVar = iota
+	classNumber
+	classAtom
+	classCompound
+)
+
+// Compare compares a and b in the standard order of terms, returning
+// -1, 0 or 1. Variables come before numbers, which come before atoms,
+// which come before compound terms. Variables are ordered by name,
+// numbers by value, with a float before an equal integer, and atoms
+// alphabetically. Compound terms are ordered by arity, then name, then
+// by their arguments from left to right. Lists are compared as '.'/2.
+func Compare(a, b Term) int {
+	ca, cb := class(a), class(b)
+	switch {
+	case ca < cb:
+		return -1
+	case ca > cb:
+		return 1
+	}
+
+	switch ca {
+	case classVar:
+		return strings.Compare(string(a.(Variable)), string(b.(Variable)))
+	case classNumber:
+		if c := numberRat(a).Cmp(numberRat(b)); c != 0 {
+			return c
+		}
+		_, fa := a.(Float)
+		_, fb := b.(Float)
+		switch {
+		case fa && !fb:
+			return -1
+		case fb && !fa:
+			return 1
+		}
+		return 0
+	case classAtom:
+		return strings.Compare(Atom(atomName(a)).Text(), Atom(atomName(b)).Text())
+	}
+
+	fa, as := compound(a)
+	fb, bs := compound(b)
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	if c := strings.Compare(Atom(fa).Text(), Atom(fb).Text()); c != 0 {
+		return c
+	}
+	for i := range as {
+		if c := Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func class(t Term) int {
+	switch t := t.(type) {
+	case Variable:
+		return classVar
+	case *Integer, Float, *Rational:
+		return classNumber
+	case *Callable:
+		if len(t.args) == 0 {
+			return classAtom
+		}
+		return classCompound
+	default:
+		return classAtom
+	}
+}
+
+// numberRat returns the exact value of the number t
+func numberRat(t Term) *big.Rat {
+	switch t := t.(type) {
+	case *Integer:
+		return new(big.Rat).SetInt(t.Value())
+	case Float:
+		return new(big.Rat).SetFloat64(float64(t))
+	default:
+		return t.(*Rational).Value()
+	}
+}
+
+// atomName returns the name of an atom, the parser builds atoms as
+// callables with no arguments, and the empty list as cons/0.
+func atomName(t Term) string {
+	if c, ok := t.(*Callable); ok {
+		if c.fn == "cons" {
+			return "[]"
+		}
+		return c.fn
+	}
+	return string(t.(Atom))
+}
+
+// compound returns the name and arguments of a compound term
+func compound(t Term) (string, []Term) {
+	c := t.(*Callable)
+	if c.fn == "cons" {
+		return ".", c.args
+	}
+	return c.fn, c.args
+}
@@ -0,0 +1,73 @@
+package term
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Format renders t using Prolog syntax. Compound terms are written
+// in canonical functional notation, and cons/2 chains as lists.
+func Format(t Term) string {
+	switch t := t.(type) {
+	case Atom:
+		return string(t)
+	case *Integer:
+		if t.big != nil {
+			return t.big.String()
+		}
+		return strconv.FormatInt(t.small, 10)
+	case Float:
+		return formatFloat(float64(t))
+	case *Rational:
+		return t.r.Num().String() + "r" + t.r.Denom().String()
+	case Variable:
+		return string(t)
+	case *Callable:
+		switch {
+		case t.fn == "cons" && len(t.args) == 0:
+			return "[]"
+		case t.fn == "cons" && len(t.args) == 2:
+			return formatList(t)
+		case len(t.args) == 0:
+			return t.fn
+		}
+		ss := []string{}
+		for _, at := range t.args {
+			ss = append(ss, Format(at))
+		}
+		return t.fn + "(" + strings.Join(ss, ",") + ")"
+	default:
+		return t.String()
+	}
+}
+
+func formatList(t *Callable) string {
+	ss := []string{}
+	var tail Term = t
+	for {
+		c, ok := tail.(*Callable)
+		if !ok || c.fn != "cons" || len(c.args) != 2 {
+			break
+		}
+		ss = append(ss, Format(c.args[0]))
+		tail = c.args[1]
+	}
+	if c, ok := tail.(*Callable); ok && c.fn == "cons" && len(c.args) == 0 {
+		return "[" + strings.Join(ss, ",") + "]"
+	}
+	return "[" + strings.Join(ss, ",") + "|" + Format(tail) + "]"
+}
+
+// formatFloat renders f so that it always reads back as a float, with
+// a fraction, or an exponent with a fraction.
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	switch {
+	case strings.ContainsAny(s, ".IN"): // has a fraction, or is Inf or NaN
+		return s
+	case strings.Contains(s, "e"):
+		return strings.Replace(s, "e", ".0e", 1)
+	default:
+		return s + ".0"
+	}
+}
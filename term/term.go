@@ -23,18 +23,75 @@ func NewAtom(s string) Term {
 	return Atom(s)
 }
 
-type Number struct {
-	n *big.Float
+// Integer is an integer of any size. Integers that fit in an int64
+// are held without a big.Int.
+type Integer struct {
+	small int64
+	big   *big.Int // nil if the value fits in small
 }
 
-func (n *Number) String() string {
-	return fmt.Sprintf("(number %v)", n.n)
+func (i *Integer) String() string {
+	return fmt.Sprintf("(integer %s)", Format(i))
 }
 
-func (*Number) isTerm() {}
+func (*Integer) isTerm() {}
 
-func NewNumber(n *big.Float) Term {
-	return &Number{n}
+func NewInteger(i int64) Term {
+	return &Integer{small: i}
+}
+
+// NewBigInteger returns the term for the integer i, which is copied
+func NewBigInteger(i *big.Int) Term {
+	if i.IsInt64() {
+		return &Integer{small: i.Int64()}
+	}
+	return &Integer{big: new(big.Int).Set(i)}
+}
+
+// Int64 returns the value of i, if it fits in an int64
+func (i *Integer) Int64() (int64, bool) {
+	return i.small, i.big == nil
+}
+
+// Value returns a copy of the value of i
+func (i *Integer) Value() *big.Int {
+	if i.big == nil {
+		return big.NewInt(i.small)
+	}
+	return new(big.Int).Set(i.big)
+}
+
+// Float is a double precision floating point number
+type Float float64
+
+func (f Float) String() string {
+	return fmt.Sprintf("(float %s)", Format(f))
+}
+
+func (Float) isTerm() {}
+
+func NewFloat(f float64) Term {
+	return Float(f)
+}
+
+// Rational is an exact fraction, such as the result of rdiv
+type Rational struct {
+	r *big.Rat
+}
+
+func (r *Rational) String() string {
+	return fmt.Sprintf("(rational %s)", Format(r))
+}
+
+func (*Rational) isTerm() {}
+
+func NewRational(r *big.Rat) Term {
+	return &Rational{r}
+}
+
+// Value returns a copy of the value of r
+func (r *Rational) Value() *big.Rat {
+	return new(big.Rat).Set(r.r)
 }
 
 type TermList []Term
@@ -0,0 +1,154 @@
+package term
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The parser keeps the quotes of a quoted atom in its name, so that
+// 'hello world' is named "'hello world'". Text and TextAtom convert
+// between the names of atoms and the text they stand for.
+
+// escapes maps the characters that follow a backslash in a quoted
+// atom to the characters they represent
+var escapes = map[rune]rune{
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'0':  0,
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+	'`':  '`',
+}
+
+// symbolChars are the characters of atoms such as =.. and \==
+const symbolChars = "=+-*/\\<>:.&~?@#$^"
+
+// Text returns the text of the atom a. The quotes of a quoted atom
+// are removed, and its escape sequences replaced by the characters
+// they represent.
+func (a Atom) Text() string {
+	s := string(a)
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.ContainsAny(s, "'\\") {
+		return s
+	}
+
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			n, r := unescape(s[i+1:])
+			if n == 0 {
+				b.WriteByte('\\')
+				continue
+			}
+			if r >= 0 {
+				b.WriteRune(r)
+			}
+			i += n
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// unescape returns the length of the escape sequence at the start of
+// s, which follows a backslash, and the character it represents, or
+// -1 for a continuation line. A length of 0 means s does not start
+// with an escape sequence.
+func unescape(s string) (int, rune) {
+	r, w := utf8.DecodeRuneInString(s)
+	if r == '\n' {
+		return w, -1
+	}
+	base, digits := 8, s
+	if r == 'x' {
+		base, digits = 16, s[1:]
+	}
+	if end := strings.IndexByte(digits, '\\'); end > 0 {
+		if c, err := strconv.ParseUint(digits[:end], base, 32); err == nil {
+			return len(s) - len(digits) + end + 1, rune(c)
+		}
+	}
+	if c, ok := escapes[r]; ok {
+		return w, c
+	}
+	return 0, 0
+}
+
+// TextAtom returns the atom whose text is s. Atoms that can be read
+// without quotes are named by their text, others are quoted, as they
+// would be by the parser.
+func TextAtom(s string) Atom {
+	if !needsQuotes(s) {
+		return Atom(s)
+	}
+	b := strings.Builder{}
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch {
+		case r == '\'' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString("\\n")
+		case r == '\t':
+			b.WriteString("\\t")
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, "\\x%x\\", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return Atom(b.String())
+}
+
+// needsQuotes reports whether the atom with the text s must be quoted
+func needsQuotes(s string) bool {
+	switch s {
+	case "":
+		return true
+	case "[]", "!", ";", ",":
+		return false
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+	switch {
+	case unicode.IsLower(r):
+		for _, r := range s {
+			if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return true
+			}
+		}
+		return false
+	case strings.ContainsRune(symbolChars, r):
+		if r == '.' || strings.HasPrefix(s, "/*") {
+			return true
+		}
+		for _, r := range s {
+			if !strings.ContainsRune(symbolChars, r) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import "github.com/tcolgate/golorp/term"
+
+// Term inspection and construction
+
+// listFunctor is the functor of a list pair, '.'/2, as seen by
+// functor/3 and =../2
+var listFunctor = NewFunctor(".", 2)
+
+// unifyCell unifies the term at a with the cell c, reporting whether
+// they unified. c is held in the register after the arguments of the
+// current call while they are unified.
+func (m *Machine) unifyCell(a Addr, c Cell) bool {
+	r := X(m.NumArgs)
+	m.setReg(r, c)
+	return m.unifies(a, m.regPtr(r))
+}
+
+// heapCell returns a cell for the term at a that can be stored on
+// the heap. An unbound variable in a register or an environment is
+// first bound to a fresh variable on the heap. If the heap is full,
+// heapCell returns false.
+func (m *Machine) heapCell(a Addr) (Cell, bool) {
+	a = m.deref(a)
+	c := m.cell(a)
+	if c.Tag() != REF || a.area() == heapArea {
+		return c, true
+	}
+	if !m.reserve(1) {
+		return 0, false
+	}
+	v := refCell(heapAddr(m.HReg))
+	m.Heap[m.HReg] = v
+	m.HReg++
+	m.bindCell(a, v)
+	return v, true
+}
+
+// newCompound builds the compound term f on the heap, with fresh
+// variables as its arguments, returning the cell that refers to it
+// and the address of its first argument. A '.'/2 term is built as a
+// list pair. If the heap is full, newCompound returns false.
+func (m *Machine) newCompound(f Functor) (Cell, Addr, bool) {
+	h, args := m.HReg, m.HReg+1
+	if f == listFunctor {
+		args = h
+	}
+	if !m.reserve(args - h + f.Arity) {
+		return 0, 0, false
+	}
+	for i := 0; i < f.Arity; i++ {
+		m.Heap[args+i] = refCell(heapAddr(args + i))
+	}
+	m.HReg = args + f.Arity
+	if f == listFunctor {
+		return lisCell(heapAddr(h)), heapAddr(args), true
+	}
+	m.Heap[h] = funCell(f)
+	return strCell(heapAddr(h)), heapAddr(args), true
+}
+
+// functor3 implements functor(Term, Name, Arity)
+func functor3(m *Machine) {
+	t := m.derefReg(0)
+	switch c := m.cell(t); c.Tag() {
+	case REF:
+	case STR, LIS:
+		f, _ := m.compound(c)
+		if !m.unifyCell(m.regPtr(X(1)), atomCell(f.Name)) ||
+			!m.unifyCell(m.regPtr(X(2)), intCell(int64(f.Arity))) {
+			m.fail()
+		}
+		return
+	default:
+		if !m.unifyCell(m.regPtr(X(1)), c) ||
+			!m.unifyCell(m.regPtr(X(2)), intCell(0)) {
+			m.fail()
+		}
+		return
+	}
+
+	na, aa := m.derefReg(1), m.derefReg(2)
+	name, arity := m.cell(na), m.cell(aa)
+	switch {
+	case name.Tag() == REF || arity.Tag() == REF:
+		m.throw(InstantiationError{})
+		return
+	case !arity.isInteger():
+		m.throw(TypeError{"integer", m.culprit(aa)})
+		return
+	case numSign(m.cellNum(arity)) < 0:
+		m.throw(DomainError{"not_less_than_zero", m.culprit(aa)})
+		return
+	case arity.Tag() != INT || arity.Int() > arityMask:
+		m.throw(RepresentationError{"max_arity"})
+		return
+	case name.Tag() == STR || name.Tag() == LIS:
+		m.throw(TypeError{"atomic", m.culprit(na)})
+		return
+	case arity.Int() == 0:
+		if !m.unifyCell(t, name) {
+			m.fail()
+		}
+		return
+	case name.Tag() != CON:
+		m.throw(TypeError{"atom", m.culprit(na)})
+		return
+	}
+
+	c, _, ok := m.newCompound(Functor{name.Atom(), int(arity.Int())})
+	if ok && !m.unifyCell(t, c) {
+		m.fail()
+	}
+}
+
+// arg3 implements arg(N, Term, Arg), it fails if N is not the
+// position of an argument of Term.
+func arg3(m *Machine) {
+	na, t := m.derefReg(0), m.derefReg(1)
+	n, c := m.cell(na), m.cell(t)
+	switch {
+	case n.Tag() == REF || c.Tag() == REF:
+		m.throw(InstantiationError{})
+		return
+	case !n.isInteger():
+		m.throw(TypeError{"integer", m.culprit(na)})
+		return
+	case c.Tag() != STR && c.Tag() != LIS:
+		m.throw(TypeError{"compound", m.culprit(t)})
+		return
+	}
+	f, args := m.compound(c)
+	if n.Tag() != INT || n.Int() < 1 || n.Int() > int64(f.Arity) {
+		m.fail()
+		return
+	}
+	if !m.unifies(m.regPtr(X(2)), args+Addr(n.Int()-1)) {
+		m.fail()
+	}
+}
+
+// univ implements Term =.. List
+func univ(m *Machine) {
+	t := m.derefReg(0)
+	switch c := m.cell(t); c.Tag() {
+	case REF:
+	case STR, LIS:
+		f, args := m.compound(c)
+		cs := make([]Cell, 1+f.Arity)
+		cs[0] = atomCell(f.Name)
+		for i := 0; i < f.Arity; i++ {
+			cs[1+i] = m.cell(args + Addr(i))
+		}
+		l, ok := m.newList(cs, atomCell(atomNil))
+		if ok && !m.unifyCell(m.regPtr(X(1)), l) {
+			m.fail()
+		}
+		return
+	default:
+		l, ok := m.newList([]Cell{c}, atomCell(atomNil))
+		if ok && !m.unifyCell(m.regPtr(X(1)), l) {
+			m.fail()
+		}
+		return
+	}
+
+	es, err := m.list(m.regPtr(X(1)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	if len(es) == 0 {
+		m.throw(DomainError{"non_empty_list", atom("[]")})
+		return
+	}
+	ha := m.deref(es[0])
+	h := m.cell(ha)
+	switch {
+	case h.Tag() == REF:
+		m.throw(InstantiationError{})
+		return
+	case h.Tag() == STR || h.Tag() == LIS:
+		m.throw(TypeError{"atomic", m.culprit(ha)})
+		return
+	case len(es) == 1:
+		if !m.unifyCell(t, h) {
+			m.fail()
+		}
+		return
+	case h.Tag() != CON:
+		m.throw(TypeError{"atom", m.culprit(ha)})
+		return
+	case len(es)-1 > arityMask:
+		m.throw(RepresentationError{"max_arity"})
+		return
+	}
+
+	c, args, ok := m.newCompound(Functor{h.Atom(), len(es) - 1})
+	if !ok {
+		return
+	}
+	for i, e := range es[1:] {
+		m.setCell(args+Addr(i), m.cell(e))
+	}
+	if !m.unifyCell(t, c) {
+		m.fail()
+	}
+}
+
+// copyTerm2 implements copy_term(Term, Copy)
+func copyTerm2(m *Machine) {
+	c, ok := m.copyTerm(m.regPtr(X(0)))
+	if ok && !m.unifyCell(m.regPtr(X(1)), c) {
+		m.fail()
+	}
+}
+
+// copyTerm builds a copy of the term at a on the heap, with fresh
+// variables, returning the cell that refers to it. Structures shared
+// within the term are shared within the copy, so cyclic terms can be
+// copied. If the heap is full, copyTerm returns false.
+func (m *Machine) copyTerm(a Addr) (Cell, bool) {
+	vars := map[Addr]Cell{}
+	copied := map[Addr]Cell{}
+
+	// copyCell returns the copy of the term at a, to be stored at
+	// the heap offset dst, or anywhere if dst is -1. Structures are
+	// allocated with their arguments unfilled, and queued in todo.
+	type job struct {
+		src Addr
+		dst int
+	}
+	todo := []job{}
+	copyCell := func(a Addr, dst int) (Cell, bool) {
+		a = m.deref(a)
+		c := m.cell(a)
+		switch c.Tag() {
+		case REF:
+			if v, ok := vars[a]; ok {
+				return v, true
+			}
+			if dst < 0 {
+				if !m.reserve(1) {
+					return 0, false
+				}
+				dst = m.HReg
+				m.Heap[dst] = refCell(heapAddr(dst))
+				m.HReg++
+			}
+			v := refCell(heapAddr(dst))
+			vars[a] = v
+			return v, true
+		case STR, LIS:
+			if v, ok := copied[c.Addr()]; ok {
+				return v, true
+			}
+			f, args := m.compound(c)
+			h := m.HReg
+			n := f.Arity
+			if c.Tag() == STR {
+				n++
+			}
+			if !m.reserve(n) {
+				return 0, false
+			}
+			m.HReg = h + n
+			v := lisCell(heapAddr(h))
+			first := h
+			if c.Tag() == STR {
+				m.Heap[h] = m.cell(c.Addr())
+				v = strCell(heapAddr(h))
+				first = h + 1
+			}
+			copied[c.Addr()] = v
+			for i := f.Arity - 1; i >= 0; i-- {
+				todo = append(todo, job{args + Addr(i), first + i})
+			}
+			return v, true
+		default:
+			return c, true
+		}
+	}
+
+	top, ok := copyCell(a, -1)
+	for ok && len(todo) > 0 {
+		j := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		var c Cell
+		if c, ok = copyCell(j.src, j.dst); ok {
+			m.Heap[j.dst] = c
+		}
+	}
+	return top, ok
+}
+
+// termVariables2 implements term_variables(Term, Vars)
+func termVariables2(m *Machine) {
+	vs := m.termVars(m.regPtr(X(0)), map[Addr]bool{})
+	cs := make([]Cell, len(vs))
+	for i, v := range vs {
+		c, ok := m.heapCell(v)
+		if !ok {
+			return
+		}
+		cs[i] = c
+	}
+	l, ok := m.newList(cs, atomCell(atomNil))
+	if ok && !m.unifyCell(m.regPtr(X(1)), l) {
+		m.fail()
+	}
+}
+
+// setArg returns a builtin that implements setarg(N, Term, Value),
+// replacing the Nth argument of Term with Value. The change is undone
+// on backtracking, unless backtrack is false, in which case a copy of
+// Value is kept, as by nb_setarg/3.
+func setArg(backtrack bool) builtin {
+	return func(m *Machine) {
+		na, t := m.derefReg(0), m.derefReg(1)
+		n, c := m.cell(na), m.cell(t)
+		switch {
+		case n.Tag() == REF || c.Tag() == REF:
+			m.throw(InstantiationError{})
+			return
+		case !n.isInteger():
+			m.throw(TypeError{"integer", m.culprit(na)})
+			return
+		case c.Tag() != STR && c.Tag() != LIS:
+			m.throw(TypeError{"compound", m.culprit(t)})
+			return
+		}
+		f, args := m.compound(c)
+		if n.Tag() != INT || n.Int() < 1 || n.Int() > int64(f.Arity) {
+			m.fail()
+			return
+		}
+		a := args + Addr(n.Int()-1)
+
+		if backtrack {
+			v, ok := m.heapCell(m.regPtr(X(2)))
+			if ok && m.trailCell(a, m.cell(a)) {
+				m.setCell(a, v)
+			}
+			return
+		}
+
+		val, err := m.decode(m.regPtr(X(2)), map[Addr]bool{})
+		if err != nil {
+			m.stop(err)
+			return
+		}
+		v, ok := m.copyTerm(m.regPtr(X(2)))
+		if !ok {
+			return
+		}
+		m.setCell(a, v)
+		m.keepArg(a, val)
+	}
+}
+
+// nbArg is an argument changed by nb_setarg/3. The copy of its value
+// on the heap is discarded on backtracking, like any other cells, so
+// the value is kept outside the heap, and built again once the
+// machine has backtracked.
+type nbArg struct {
+	Addr  Addr      // the argument
+	Value term.Term // the value it was set to
+}
+
+// keepArg records that the argument at a was set to val by
+// nb_setarg/3, replacing any earlier value.
+func (m *Machine) keepArg(a Addr, val term.Term) {
+	for i := range m.nbArgs {
+		if m.nbArgs[i].Addr == a {
+			m.nbArgs[i].Value = val
+			return
+		}
+	}
+	m.nbArgs = append(m.nbArgs, nbArg{a, val})
+}
+
+// restoreArgs builds the values of the arguments changed by
+// nb_setarg/3 again, after backtracking has discarded the heap above
+// HReg. Arguments of terms that were discarded are forgotten.
+func (m *Machine) restoreArgs() {
+	n := 0
+	for _, e := range m.nbArgs {
+		if e.Addr.offset() >= m.HReg {
+			continue
+		}
+		v, ok := m.encode(e.Value, map[term.Variable]Cell{})
+		if !ok {
+			break
+		}
+		m.setCell(e.Addr, v)
+		m.nbArgs[n] = e
+		n++
+	}
+	m.nbArgs = m.nbArgs[:n]
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+var termstests = []atest{
+	{q: `functor(foo(a, b), N, A), R = N-A.`, v: "R", exp: []string{"-(foo,2)"}},
+	{q: `functor(foo, N, A), R = N-A.`, v: "R", exp: []string{"-(foo,0)"}},
+	{q: `functor(1.5, N, A), R = N-A.`, v: "R", exp: []string{"-(1.5,0)"}},
+	{q: `functor([a], N, A), R = N-A.`, v: "R", exp: []string{"-(.,2)"}},
+	{q: `functor(foo(a), foo, 2), X = yes.`, v: "X", exp: []string{}},
+	{q: `functor(T, foo, 3), T = foo(a, b, c), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `functor(T, foo, 0).`, v: "T", exp: []string{"foo"}},
+	{q: `functor(T, 1, 0).`, v: "T", exp: []string{"1"}},
+	{q: `functor(T, N, 1).`, v: "T", exp: []string{}, err: InstantiationError{}},
+	{q: `functor(T, foo, A).`, v: "T", exp: []string{}, err: InstantiationError{}},
+	{q: `functor(T, foo, a).`, v: "T", exp: []string{}, err: TypeError{"integer", atom("a")}},
+	{q: `functor(T, foo, -1).`, v: "T", exp: []string{}, err: DomainError{"not_less_than_zero", numTerm(int64(-1))}},
+	{q: `functor(T, foo(a), 1).`, v: "T", exp: []string{}, err: TypeError{"atomic", term.NewCallable("foo", []term.Term{atom("a")})}},
+	{q: `functor(T, 1, 2).`, v: "T", exp: []string{}, err: TypeError{"atom", numTerm(int64(1))}},
+	{q: `functor(T, foo, 100000000).`, v: "T", exp: []string{}, err: RepresentationError{"max_arity"}},
+
+	{q: `arg(2, foo(a, b, c), X).`, v: "X", exp: []string{"b"}},
+	{q: `arg(1, [h|t], X).`, v: "X", exp: []string{"h"}},
+	{q: `arg(2, [h|t], X).`, v: "X", exp: []string{"t"}},
+	{q: `arg(1, foo(X), b), X == b, Y = yes.`, v: "Y", exp: []string{"yes"}},
+	{q: `arg(4, foo(a), X).`, v: "X", exp: []string{}},
+	{q: `arg(0, foo(a), X).`, v: "X", exp: []string{}},
+	{q: `arg(N, foo(a), X).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `arg(a, foo(a), X).`, v: "X", exp: []string{}, err: TypeError{"integer", atom("a")}},
+	{q: `arg(1, foo, X).`, v: "X", exp: []string{}, err: TypeError{"compound", atom("foo")}},
+
+	{q: `foo(a, b) =.. L.`, v: "L", exp: []string{"[foo,a,b]"}},
+	{q: `foo =.. L.`, v: "L", exp: []string{"[foo]"}},
+	{q: `1.5 =.. L.`, v: "L", exp: []string{"[1.5]"}},
+	{q: `[a] =.. L.`, v: "L", exp: []string{"[.,a,[]]"}},
+	{q: `T =.. [foo, a, B], T == foo(a, B), X = yes.`, v: "X", exp: []string{"yes"}},
+	{q: `T =.. [foo].`, v: "T", exp: []string{"foo"}},
+	{q: `T =.. [1].`, v: "T", exp: []string{"1"}},
+	{q: `T =.. L.`, v: "T", exp: []string{}, err: InstantiationError{}},
+	{q: `T =.. [foo|_].`, v: "T", exp: []string{}, err: InstantiationError{}},
+	{q: `T =.. [X, a].`, v: "T", exp: []string{}, err: InstantiationError{}},
+	{q: `T =.. [].`, v: "T", exp: []string{}, err: DomainError{"non_empty_list", atom("[]")}},
+	{q: `T =.. [f(a), b].`, v: "T", exp: []string{}, err: TypeError{"atomic", term.NewCallable("f", []term.Term{atom("a")})}},
+	{q: `T =.. [1, a].`, v: "T", exp: []string{}, err: TypeError{"atom", numTerm(int64(1))}},
+	{q: `T =.. foo.`, v: "T", exp: []string{}, err: TypeError{"list", atom("foo")}},
+
+	{q: `copy_term(f(a, [1, 2]), C).`, v: "C", exp: []string{"f(a,[1,2])"}},
+	{q: `copy_term(f(X, Y, X), C), C = f(A, B, D), A == D, A \== B, A \== X, B \== Y, R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `copy_term(X, Y), X \== Y, R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `cyclic_copy(R).`, v: "R", exp: []string{"yes"}},
+
+	{q: `term_variables(f(X, g(Y, X), Z), L), L == [X, Y, Z], R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `term_variables(f(a, [b]), L).`, v: "L", exp: []string{"[]"}},
+
+	{q: `T = f(a, b), setarg(1, T, c).`, v: "T", exp: []string{"f(c,b)"}},
+	{q: `T = [a, b], setarg(2, T, []).`, v: "T", exp: []string{"[a]"}},
+	{q: `T = f(a), (setarg(1, T, b), fail ; true).`, v: "T", exp: []string{"f(a)"}},
+	{q: `T = f(a), (setarg(1, T, b) ; true).`, v: "T", exp: []string{"f(b)", "f(a)"}},
+	{q: `T = f(a), (nb_setarg(1, T, b), fail ; true).`, v: "T", exp: []string{"f(b)"}},
+	{q: `T = c(0), (p(X), arg(1, T, C0), C is C0 + X, nb_setarg(1, T, C), fail ; true), arg(1, T, R).`, v: "R", exp: []string{"6"}},
+	{q: `T = f(a), (nb_setarg(1, T, g(Y, Y)), fail ; true), T = f(g(A, B)), A == B, R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `setarg(X, f(a), b).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `setarg(1, foo, b).`, v: "X", exp: []string{}, err: TypeError{"compound", atom("foo")}},
+	{q: `setarg(2, f(a), b).`, v: "X", exp: []string{}},
+	{q: `nb_setarg(1, T, b).`, v: "X", exp: []string{}, err: InstantiationError{}},
+}
+
+func TestTerms(t *testing.T) {
+	for _, st := range termstests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `p(1). p(2). p(3).
+				cyclic_copy(R) :- X = f(X), copy_term(X, Y), Y = f(Z), Z == Y, R = yes.`)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
+
+func TestTermsNbSetargHeap(t *testing.T) {
+	m := loadProgram(t, `
+nat(I, _, I).
+nat(I, N, X) :- I < N, I1 is I + 1, nat(I1, N, X).
+sum(N, R) :-
+	T = c(s(0)),
+	(nat(1, N, X), arg(1, T, s(C0)), C is C0 + X, nb_setarg(1, T, s(C)), fail ; true),
+	arg(1, T, s(R)).
+`)
+	m.GCThreshold = 0
+
+	res, err := allSolutions(t, m, `sum(1000, R).`, "R")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if exp := []string{"500500"}; !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v, got %v", exp, res)
+	}
+	if m.HReg > 100 {
+		t.Fatalf("expected backtracking to reclaim the heap, %d cells remain", m.HReg)
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tcolgate/golorp/parse"
+	"github.com/tcolgate/golorp/term"
+)
+
+// Atoms and text
+//
+// The text built-ins work on the text of atoms, as runes, so that
+// lengths and positions count characters rather than bytes.
+
+// textCell returns the cell for the atom whose text is s
+func textCell(s string) Cell {
+	return atomCell(Intern(term.TextAtom(s)))
+}
+
+// atomText returns the text of the atom at a. It returns an
+// instantiation error if a is unbound, and a type error if it is not
+// an atom.
+func (m *Machine) atomText(a Addr) (string, error) {
+	a = m.deref(a)
+	switch c := m.cell(a); c.Tag() {
+	case REF:
+		return "", InstantiationError{}
+	case CON:
+		return c.Atom().Name().Text(), nil
+	default:
+		return "", TypeError{"atom", m.culprit(a)}
+	}
+}
+
+// char returns the character at a, which must be a character code,
+// or a single character atom if chars is set.
+func (m *Machine) char(a Addr, chars bool) (rune, error) {
+	a = m.deref(a)
+	c := m.cell(a)
+	switch {
+	case c.isVar():
+		return 0, InstantiationError{}
+	case chars:
+		if c.isAtom() {
+			s := c.Atom().Name().Text()
+			if r, n := utf8.DecodeRuneInString(s); n > 0 && n == len(s) {
+				return r, nil
+			}
+		}
+		return 0, TypeError{"character", m.culprit(a)}
+	case !c.isInteger():
+		return 0, TypeError{"integer", m.culprit(a)}
+	case c.Tag() != INT || c.Int() < 0 || c.Int() > utf8.MaxRune || !utf8.ValidRune(rune(c.Int())):
+		return 0, RepresentationError{"character_code"}
+	}
+	return rune(c.Int()), nil
+}
+
+// listText returns the text of the list of character codes at a, or
+// of characters if chars is set.
+func (m *Machine) listText(a Addr, chars bool) (string, error) {
+	es, err := m.list(a)
+	if err != nil {
+		return "", err
+	}
+	b := strings.Builder{}
+	for _, e := range es {
+		r, err := m.char(e, chars)
+		if err != nil {
+			return "", err
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// textList builds the list of the character codes of s on the heap,
+// or of its characters if chars is set, returning the cell that
+// refers to it. If the heap is full, textList returns false.
+func (m *Machine) textList(s string, chars bool) (Cell, bool) {
+	cs := make([]Cell, 0, len(s))
+	for _, r := range s {
+		if chars {
+			cs = append(cs, textCell(string(r)))
+			continue
+		}
+		cs = append(cs, intCell(int64(r)))
+	}
+	return m.newList(cs, atomCell(atomNil))
+}
+
+// text returns the text of the atom, number, or list of character
+// codes or characters at a. The empty list is taken to be an empty
+// list of codes.
+func (m *Machine) text(a Addr) (string, error) {
+	a = m.deref(a)
+	c := m.cell(a)
+	switch {
+	case c.isVar():
+		return "", InstantiationError{}
+	case c.isNumber():
+		return term.Format(m.constant(c)), nil
+	case c.isAtom() && c.Atom() != atomNil:
+		return c.Atom().Name().Text(), nil
+	}
+	chars := c.Tag() == LIS && m.cell(m.deref(c.Addr())).isAtom()
+	return m.listText(a, chars)
+}
+
+// atomList returns a builtin that implements atom_codes(Atom, Codes),
+// or atom_chars(Atom, Chars) if chars is set.
+func atomList(chars bool) builtin {
+	return func(m *Machine) {
+		a := m.derefReg(0)
+		if !m.cell(a).isVar() {
+			s, err := m.atomText(a)
+			if err != nil {
+				m.throw(err)
+				return
+			}
+			l, ok := m.textList(s, chars)
+			if ok && !m.unifyCell(m.regPtr(X(1)), l) {
+				m.fail()
+			}
+			return
+		}
+
+		s, err := m.listText(m.regPtr(X(1)), chars)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		if !m.unifyCell(a, textCell(s)) {
+			m.fail()
+		}
+	}
+}
+
+// charCode implements char_code(Char, Code)
+func charCode(m *Machine) {
+	a := m.derefReg(0)
+	if !m.cell(a).isVar() {
+		r, err := m.char(a, true)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		if !m.unifyCell(m.regPtr(X(1)), intCell(int64(r))) {
+			m.fail()
+		}
+		return
+	}
+
+	r, err := m.char(m.regPtr(X(1)), false)
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	if !m.unifyCell(a, textCell(string(r))) {
+		m.fail()
+	}
+}
+
+// atomLength implements atom_length(Atom, Length)
+func atomLength(m *Machine) {
+	s, err := m.atomText(m.regPtr(X(0)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	la := m.derefReg(1)
+	switch l := m.cell(la); {
+	case l.isVar():
+	case !l.isInteger():
+		m.throw(TypeError{"integer", m.culprit(la)})
+		return
+	case numSign(m.cellNum(l)) < 0:
+		m.throw(DomainError{"not_less_than_zero", m.culprit(la)})
+		return
+	}
+	if !m.unifyCell(la, intCell(int64(utf8.RuneCountInString(s)))) {
+		m.fail()
+	}
+}
+
+// upcaseAtom implements upcase_atom(Atom, Upper)
+func upcaseAtom(m *Machine) {
+	s, err := m.atomText(m.regPtr(X(0)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	if !m.unifyCell(m.regPtr(X(1)), textCell(strings.ToUpper(s))) {
+		m.fail()
+	}
+}
+
+// numberCodes implements number_codes(Number, Codes). If Codes is a
+// list it is read as a number, otherwise it is unified with the codes
+// of Number.
+func numberCodes(m *Machine) {
+	na := m.derefReg(0)
+	n := m.cell(na)
+	if !n.isVar() && !n.isNumber() {
+		m.throw(TypeError{"number", m.culprit(na)})
+		return
+	}
+
+	s, err := m.listText(m.regPtr(X(1)), false)
+	if err == nil {
+		t, err := parse.Number(s)
+		if err != nil {
+			m.throw(SyntaxError{"illegal_number"})
+			return
+		}
+		if !m.unifyCell(na, m.constCell(t)) {
+			m.fail()
+		}
+		return
+	}
+	if n.isVar() {
+		m.throw(err)
+		return
+	}
+
+	l, ok := m.textList(term.Format(m.constant(n)), false)
+	if ok && !m.unifyCell(m.regPtr(X(1)), l) {
+		m.fail()
+	}
+}
+
+// atomNumber implements atom_number(Atom, Number), it fails if Atom
+// is not the text of a number.
+func atomNumber(m *Machine) {
+	a := m.derefReg(0)
+	if !m.cell(a).isVar() {
+		s, err := m.atomText(a)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		t, err := parse.Number(s)
+		if err != nil || !m.unifyCell(m.regPtr(X(1)), m.constCell(t)) {
+			m.fail()
+		}
+		return
+	}
+
+	na := m.derefReg(1)
+	switch n := m.cell(na); {
+	case n.isVar():
+		m.throw(InstantiationError{})
+	case !n.isNumber():
+		m.throw(TypeError{"number", m.culprit(na)})
+	case !m.unifyCell(a, textCell(term.Format(m.constant(n)))):
+		m.fail()
+	}
+}
+
+// splitString implements split_string(String, SepChars, Pad, Subs).
+// String is split at each of the characters of SepChars, and the
+// characters of Pad are removed from both ends of each substring. As
+// there is no string type, the substrings are atoms.
+func splitString(m *Machine) {
+	ss := make([]string, 3)
+	for i := range ss {
+		s, err := m.text(m.regPtr(X(i)))
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		ss[i] = s
+	}
+	s, sep, pad := ss[0], ss[1], ss[2]
+
+	fields := []string{}
+	start := 0
+	for i, r := range s {
+		if strings.ContainsRune(sep, r) {
+			fields = append(fields, s[start:i])
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	fields = append(fields, s[start:])
+
+	cs := make([]Cell, len(fields))
+	for i, f := range fields {
+		cs[i] = textCell(strings.Trim(f, pad))
+	}
+	l, ok := m.newList(cs, atomCell(atomNil))
+	if ok && !m.unifyCell(m.regPtr(X(3)), l) {
+		m.fail()
+	}
+}
+
+// subAtoms enumerates the sub atoms of an atom for sub_atom/5 and
+// atom_concat/3, as the start and length of each. A sub atom may be
+// required to have a given start, length or remainder, or text.
+type subAtoms struct {
+	text    []rune
+	b, l, a int    // the required start, length and remainder, or -1
+	sub     []rune // the required text, or nil
+	nb, nl  int    // the next start and length to try
+}
+
+// next returns the start and length of the next sub atom, and false
+// if there are no more.
+func (s *subAtoms) next() (int, int, bool) {
+	n := len(s.text)
+	if s.b >= 0 && s.nb < s.b {
+		s.nb = s.b
+	}
+	for ; s.nb <= n && (s.b < 0 || s.nb == s.b); s.nb, s.nl = s.nb+1, 0 {
+		lo, hi := 0, n-s.nb
+		for _, l := range []int{s.l, s.remainderLength(), s.subLength()} {
+			if l >= 0 {
+				lo, hi = max(lo, l), min(hi, l)
+			}
+		}
+		for s.nl = max(s.nl, lo); s.nl <= hi; s.nl++ {
+			if s.sub == nil || string(s.text[s.nb:s.nb+s.nl]) == string(s.sub) {
+				s.nl++
+				return s.nb, s.nl - 1, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// remainderLength returns the length a sub atom at the next start
+// must have to leave the required remainder, or -1
+func (s *subAtoms) remainderLength() int {
+	if s.a < 0 {
+		return -1
+	}
+	if l := len(s.text) - s.nb - s.a; l >= 0 {
+		return l
+	}
+	return len(s.text) + 1
+}
+
+// subLength returns the length of the required text, or -1
+func (s *subAtoms) subLength() int {
+	if s.sub == nil {
+		return -1
+	}
+	return len(s.sub)
+}
+
+// more reports whether there is another sub atom to come
+func (s *subAtoms) more() bool {
+	t := *s
+	_, _, ok := t.next()
+	return ok
+}
+
+// trySubAtoms unifies the arguments of the call with the first sub
+// atom of s, using unify, leaving a choice point that resumes at retry
+// if there are more.
+func (m *Machine) trySubAtoms(s *subAtoms, retry int, unify func(m *Machine, s *subAtoms, b, l int) bool) {
+	b, l, ok := s.next()
+	if !ok {
+		m.fail()
+		return
+	}
+	if s.more() {
+		if !m.reserveFrame() {
+			return
+		}
+		m.pushChoicePoint(retry, m.NumArgs)
+		m.OrStack[m.BReg].Subs = s
+	}
+	if !unify(m, s, b, l) {
+		m.fail()
+	}
+}
+
+// nextSubAtom restores the state saved in the current choice point,
+// and takes the next of its sub atoms. The choice point is discarded
+// once its last sub atom has been taken.
+func (m *Machine) nextSubAtom() (*subAtoms, int, int) {
+	cp := m.OrStack[m.BReg]
+	s := cp.Subs
+	b, l, _ := s.next()
+	if s.more() {
+		m.restoreChoicePoint(cp)
+	} else {
+		m.popChoicePoint()
+	}
+	m.NumArgs = len(cp.Args)
+	m.PReg = m.CPReg
+	return s, b, l
+}
+
+// subAtom5 implements sub_atom(Atom, Before, Length, After, Sub)
+func subAtom5(m *Machine) {
+	s, err := m.atomText(m.regPtr(X(0)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	sub := &subAtoms{text: []rune(s), b: -1, l: -1, a: -1}
+	for i, p := range []*int{&sub.b, &sub.l, &sub.a} {
+		ia := m.derefReg(1 + i)
+		switch c := m.cell(ia); {
+		case c.isVar():
+		case !c.isInteger():
+			m.throw(TypeError{"integer", m.culprit(ia)})
+			return
+		case c.Tag() != INT || c.Int() < 0 || c.Int() > int64(len(sub.text)):
+			m.fail()
+			return
+		default:
+			*p = int(c.Int())
+		}
+	}
+	if sa := m.derefReg(4); !m.cell(sa).isVar() {
+		t, err := m.atomText(sa)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		sub.sub = []rune(t)
+	}
+
+	retry, _ := m.subAtomCode()
+	m.trySubAtoms(sub, retry, (*Machine).unifySubAtom)
+}
+
+// unifySubAtom unifies the arguments of sub_atom/5 with the sub atom
+// of s at b, of length l
+func (m *Machine) unifySubAtom(s *subAtoms, b, l int) bool {
+	return m.unifyCell(m.regPtr(X(1)), intCell(int64(b))) &&
+		m.unifyCell(m.regPtr(X(2)), intCell(int64(l))) &&
+		m.unifyCell(m.regPtr(X(3)), intCell(int64(len(s.text)-b-l))) &&
+		m.unifyCell(m.regPtr(X(4)), textCell(string(s.text[b:b+l])))
+}
+
+// atomConcat implements atom_concat(Atom1, Atom2, Atom3). If Atom1 or
+// Atom2 is unbound, the ways of splitting Atom3 are enumerated on
+// backtracking.
+func atomConcat(m *Machine) {
+	x, y := m.derefReg(0), m.derefReg(1)
+	if !m.cell(x).isVar() && !m.cell(y).isVar() {
+		s1, err := m.atomText(x)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		s2, err := m.atomText(y)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		za := m.derefReg(2)
+		if z := m.cell(za); !z.isVar() && !z.isAtom() {
+			m.throw(TypeError{"atom", m.culprit(za)})
+			return
+		}
+		if !m.unifyCell(za, textCell(s1+s2)) {
+			m.fail()
+		}
+		return
+	}
+
+	s, err := m.atomText(m.regPtr(X(2)))
+	if err != nil {
+		m.throw(err)
+		return
+	}
+	sub := &subAtoms{text: []rune(s), b: 0, l: -1, a: -1}
+	for i, a := range []Addr{x, y} {
+		if m.cell(a).isVar() {
+			continue
+		}
+		t, err := m.atomText(a)
+		if err != nil {
+			m.throw(err)
+			return
+		}
+		if i == 0 {
+			sub.sub = []rune(t)
+		} else {
+			sub.a = utf8.RuneCountInString(t)
+		}
+	}
+
+	_, retry := m.subAtomCode()
+	m.trySubAtoms(sub, retry, (*Machine).unifyConcat)
+}
+
+// unifyConcat unifies the arguments of atom_concat/3 with the parts of
+// s before and after the split at l
+func (m *Machine) unifyConcat(s *subAtoms, b, l int) bool {
+	return m.unifyCell(m.regPtr(X(0)), textCell(string(s.text[:l]))) &&
+		m.unifyCell(m.regPtr(X(1)), textCell(string(s.text[l:])))
+}
+
+// RetrySubAtom tries the next sub atom for the call to sub_atom/5
+// whose choice point is the most recent.
+func RetrySubAtom() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		s, b, l := m.nextSubAtom()
+		if !m.unifySubAtom(s, b, l) {
+			m.fail()
+		}
+		return nil, ""
+	}, "retry_sub_atom"
+}
+
+// RetryAtomConcat tries the next split for the call to atom_concat/3
+// whose choice point is the most recent.
+func RetryAtomConcat() (machineFunc, string) {
+	return func(m *Machine) (machineFunc, string) {
+		s, b, l := m.nextSubAtom()
+		if !m.unifyConcat(s, b, l) {
+			m.fail()
+		}
+		return nil, ""
+	}, "retry_atom_concat"
+}
+
+// subAtomCode returns the addresses of the code that resumes calls
+// to sub_atom/5, and calls to atom_concat/3, on backtracking.
+func (m *Machine) subAtomCode() (int, int) {
+	l, ok := m.dynCode["$sub_atom"]
+	if !ok {
+		l = m.addCode("$sub_atom", CodeCells{
+			cc(RetrySubAtom()),
+			cc(RetryAtomConcat()),
+		})
+	}
+	return l, l + 1
+}
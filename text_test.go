@@ -0,0 +1,127 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+var texttests = []atest{
+	{q: `atom_codes(abc, L).`, v: "L", exp: []string{"[97,98,99]"}},
+	{q: `atom_codes(A, [0'h, 0'i]).`, v: "A", exp: []string{"hi"}},
+	{q: `atom_codes('hello world', L), atom_codes(A, L).`, v: "A", exp: []string{"'hello world'"}},
+	{q: `atom_codes(π, L).`, v: "L", exp: []string{"[960]"}},
+	{q: `atom_codes([], L).`, v: "L", exp: []string{"[91,93]"}},
+	{q: `atom_codes(A, []).`, v: "A", exp: []string{"''"}},
+	{q: `atom_codes(A, L).`, v: "A", exp: []string{}, err: InstantiationError{}},
+	{q: `atom_codes(A, [0'a|_]).`, v: "A", exp: []string{}, err: InstantiationError{}},
+	{q: `atom_codes(f(a), L).`, v: "L", exp: []string{}, err: TypeError{"atom", term.NewCallable("f", []term.Term{atom("a")})}},
+	{q: `atom_codes(A, [a]).`, v: "A", exp: []string{}, err: TypeError{"integer", atom("a")}},
+	{q: `atom_codes(A, [-1]).`, v: "A", exp: []string{}, err: RepresentationError{"character_code"}},
+
+	{q: `atom_chars(λπ, L).`, v: "L", exp: []string{"[λ,π]"}},
+	{q: `atom_chars('a b', L).`, v: "L", exp: []string{"[a,' ',b]"}},
+	{q: `atom_chars(A, [a, b]).`, v: "A", exp: []string{"ab"}},
+	{q: `atom_chars(A, [a, 1]).`, v: "A", exp: []string{}, err: TypeError{"character", numTerm(int64(1))}},
+	{q: `atom_chars(A, [ab]).`, v: "A", exp: []string{}, err: TypeError{"character", atom("ab")}},
+
+	{q: `char_code(a, C).`, v: "C", exp: []string{"97"}},
+	{q: `char_code(C, 0'λ).`, v: "C", exp: []string{"λ"}},
+	{q: `char_code(C, X).`, v: "C", exp: []string{}, err: InstantiationError{}},
+	{q: `char_code(ab, C).`, v: "C", exp: []string{}, err: TypeError{"character", atom("ab")}},
+	{q: `char_code(C, a).`, v: "C", exp: []string{}, err: TypeError{"integer", atom("a")}},
+	{q: `char_code(C, -1).`, v: "C", exp: []string{}, err: RepresentationError{"character_code"}},
+
+	{q: `atom_length(hello, L).`, v: "L", exp: []string{"5"}},
+	{q: `atom_length('πλ', L).`, v: "L", exp: []string{"2"}},
+	{q: `atom_length('', L).`, v: "L", exp: []string{"0"}},
+	{q: `atom_length(abc, 2), X = yes.`, v: "X", exp: []string{}},
+	{q: `atom_length(A, L).`, v: "L", exp: []string{}, err: InstantiationError{}},
+	{q: `atom_length(1, L).`, v: "L", exp: []string{}, err: TypeError{"atom", numTerm(int64(1))}},
+	{q: `atom_length(a, foo).`, v: "X", exp: []string{}, err: TypeError{"integer", atom("foo")}},
+	{q: `atom_length(a, -1).`, v: "X", exp: []string{}, err: DomainError{"not_less_than_zero", numTerm(int64(-1))}},
+
+	{q: `atom_concat(ab, cd, X).`, v: "X", exp: []string{"abcd"}},
+	{q: `atom_concat('hello ', world, X).`, v: "X", exp: []string{"'hello world'"}},
+	{q: `atom_concat(X, Y, abc), R = X-Y.`, v: "R", exp: []string{"-('',abc)", "-(a,bc)", "-(ab,c)", "-(abc,'')"}},
+	{q: `atom_concat(X, c, abc).`, v: "X", exp: []string{"ab"}},
+	{q: `atom_concat(X, 'bc', abc).`, v: "X", exp: []string{"a"}},
+	{q: `atom_concat(ab, Y, abc).`, v: "Y", exp: []string{"c"}},
+	{q: `atom_concat(b, Y, abc).`, v: "Y", exp: []string{}},
+	{q: `atom_concat(πλ, Y, πλω).`, v: "Y", exp: []string{"ω"}},
+	{q: `atom_concat(X, Y, ab), !.`, v: "Y", exp: []string{"ab"}},
+	{q: `atom_concat(X, Y, Z).`, v: "X", exp: []string{}, err: InstantiationError{}},
+	{q: `atom_concat(f(a), b, X).`, v: "X", exp: []string{}, err: TypeError{"atom", term.NewCallable("f", []term.Term{atom("a")})}},
+	{q: `atom_concat(X, b, 1).`, v: "X", exp: []string{}, err: TypeError{"atom", numTerm(int64(1))}},
+
+	{q: `sub_atom(abc, B, 2, A, S), R = B-S.`, v: "R", exp: []string{"-(0,ab)", "-(1,bc)"}},
+	{q: `sub_atom(abcab, B, L, A, ab).`, v: "B", exp: []string{"0", "3"}},
+	{q: `findall(S, sub_atom(abc, _, _, _, S), L).`, v: "L", exp: []string{"['',a,ab,abc,'',b,bc,'',c,'']"}},
+	{q: `sub_atom(hello, 1, 3, A, S), R = A-S.`, v: "R", exp: []string{"-(1,ell)"}},
+	{q: `sub_atom(hello, B, 2, 0, S).`, v: "S", exp: []string{"lo"}},
+	{q: `sub_atom(hello, B, L, 3, S).`, v: "S", exp: []string{"he", "e", "''"}},
+	{q: `sub_atom(πλω, 1, 1, _, S).`, v: "S", exp: []string{"λ"}},
+	{q: `sub_atom(abc, 5, L, A, S).`, v: "S", exp: []string{}},
+	{q: `sub_atom(abc, B, 1, _, S), !.`, v: "S", exp: []string{"a"}},
+	{q: `sub_atom(X, B, L, A, S).`, v: "S", exp: []string{}, err: InstantiationError{}},
+	{q: `sub_atom(f(a), B, L, A, S).`, v: "S", exp: []string{}, err: TypeError{"atom", term.NewCallable("f", []term.Term{atom("a")})}},
+	{q: `sub_atom(abc, a, L, A, S).`, v: "S", exp: []string{}, err: TypeError{"integer", atom("a")}},
+	{q: `sub_atom(abc, B, L, A, 1).`, v: "S", exp: []string{}, err: TypeError{"atom", numTerm(int64(1))}},
+
+	{q: `number_codes(N, [0'4, 0'2]).`, v: "N", exp: []string{"42"}},
+	{q: `number_codes(N, [32, 0'-, 0'1]).`, v: "N", exp: []string{"-1"}},
+	{q: `number_codes(1.5, L).`, v: "L", exp: []string{"[49,46,53]"}},
+	{q: `number_codes(N, [0'a]).`, v: "N", exp: []string{}, err: SyntaxError{"illegal_number"}},
+	{q: `number_codes(a, L).`, v: "L", exp: []string{}, err: TypeError{"number", atom("a")}},
+	{q: `number_codes(N, L).`, v: "N", exp: []string{}, err: InstantiationError{}},
+	{q: `number_codes(N, [0'1|_]).`, v: "N", exp: []string{}, err: InstantiationError{}},
+
+	{q: `atom_number('42', N).`, v: "N", exp: []string{"42"}},
+	{q: `atom_number('-1.5', N).`, v: "N", exp: []string{"-1.5"}},
+	{q: `atom_number(foo, N).`, v: "N", exp: []string{}},
+	{q: `atom_number(A, 7).`, v: "A", exp: []string{"'7'"}},
+	{q: `atom_number(A, -3).`, v: "A", exp: []string{"'-3'"}},
+	{q: `atom_number(A, N).`, v: "A", exp: []string{}, err: InstantiationError{}},
+	{q: `atom_number(A, foo).`, v: "A", exp: []string{}, err: TypeError{"number", atom("foo")}},
+
+	{q: `upcase_atom('hello world', U).`, v: "U", exp: []string{"'HELLO WORLD'"}},
+	{q: `upcase_atom(πλ, U).`, v: "U", exp: []string{"'ΠΛ'"}},
+	{q: `upcase_atom(X, U).`, v: "U", exp: []string{}, err: InstantiationError{}},
+
+	{q: `split_string('a,b,,c', ',', '', L).`, v: "L", exp: []string{"[a,b,'',c]"}},
+	{q: `split_string('  hi there  ', '', ' ', L).`, v: "L", exp: []string{"['hi there']"}},
+	{q: `split_string('SWI-Prolog, 7.0', ',', ' ', L).`, v: "L", exp: []string{"['SWI-Prolog','7.0']"}},
+	{q: `split_string([0'a, 0'/, 0'b], '/', '', L).`, v: "L", exp: []string{"[a,b]"}},
+	{q: `split_string('π λ', ' ', '', L).`, v: "L", exp: []string{"[π,λ]"}},
+	{q: `split_string(X, ',', '', L).`, v: "L", exp: []string{}, err: InstantiationError{}},
+}
+
+func TestText(t *testing.T) {
+	for _, st := range texttests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `p(a).`)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+
+	"github.com/tcolgate/golorp/term"
+)
+
+// Type tests
+//
+// The type tests are compiled inline, as a TypeTest instruction on
+// the register holding the term, rather than as a call, so they do
+// not end a chunk of the clause body. They are also registered as
+// builtins, for when they are called by call/N.
+
+// typeTester reports whether the dereferenced term at a has a type
+type typeTester func(m *Machine, a Addr) bool
+
+// typeTests are the type tests the compiler emits inline
+var typeTests = map[Functor]typeTester{
+	NewFunctor("var", 1):      cellTest(Cell.isVar),
+	NewFunctor("nonvar", 1):   cellTest(func(c Cell) bool { return !c.isVar() }),
+	NewFunctor("atom", 1):     cellTest(Cell.isAtom),
+	NewFunctor("number", 1):   cellTest(Cell.isNumber),
+	NewFunctor("integer", 1):  cellTest(Cell.isInteger),
+	NewFunctor("float", 1):    cellTest(Cell.isFloat),
+	NewFunctor("atomic", 1):   cellTest(Cell.isAtomic),
+	NewFunctor("compound", 1): cellTest(Cell.isCompound),
+	NewFunctor("callable", 1): cellTest(Cell.isCallable),
+	NewFunctor("is_list", 1):  (*Machine).isList,
+	NewFunctor("ground", 1):   (*Machine).isGround,
+}
+
+// cellTest returns a typeTester that only needs the tag of the cell
+func cellTest(test func(c Cell) bool) typeTester {
+	return func(m *Machine, a Addr) bool {
+		return test(m.cell(a))
+	}
+}
+
+// isTypeTest reports whether the goal fn/n is an inline type test
+func isTypeTest(fn string, n int) bool {
+	_, ok := typeTests[NewFunctor(term.Atom(fn), n)]
+	return ok
+}
+
+// TypeTest backtracks unless the term in vn passes the type test fn
+func TypeTest(fn term.Atom, vn Reg) (machineFunc, string) {
+	test := typeTests[NewFunctor(fn, 1)]
+	return func(m *Machine) (machineFunc, string) {
+		if !test(m, m.deref(m.regPtr(vn))) {
+			m.fail()
+		}
+		return nil, ""
+	}, fmt.Sprintf("type_test %s, %s", fn, vn)
+}
+
+// isList reports whether the term at a is a proper list
+func (m *Machine) isList(a Addr) bool {
+	for n := 0; n <= m.HReg; n++ {
+		a = m.deref(a)
+		switch c := m.cell(a); c.Tag() {
+		case CON:
+			return c.Atom() == atomNil
+		case LIS:
+			a = c.Addr() + 1
+		default:
+			return false
+		}
+	}
+	// a list longer than the heap must be cyclic
+	return false
+}
+
+// isGround reports whether the term at a has no variables
+func (m *Machine) isGround(a Addr) bool {
+	return len(m.termVars(a, map[Addr]bool{})) == 0
+}
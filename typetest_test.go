@@ -0,0 +1,84 @@
+// Copyright 2016 Tristan Colgate-McFarlane
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golorp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var typetests = []atest{
+	{q: `var(X), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `X = a, var(X), R = yes.`, v: "R", exp: []string{}},
+	{q: `nonvar(f(X)), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `nonvar(X), R = yes.`, v: "R", exp: []string{}},
+	{q: `atom(foo), atom([]), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `atom(1), R = yes.`, v: "R", exp: []string{}},
+	{q: `atom(f(a)), R = yes.`, v: "R", exp: []string{}},
+	{q: `number(1), number(1.5), X is 2 ** 100, number(X), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `number(a), R = yes.`, v: "R", exp: []string{}},
+	{q: `integer(1), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `float(1.5), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `atomic(a), atomic(1), atomic(1.5), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `atomic(f(a)), R = yes.`, v: "R", exp: []string{}},
+	{q: `atomic(X), R = yes.`, v: "R", exp: []string{}},
+	{q: `compound(f(a)), compound([a]), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `compound(a), R = yes.`, v: "R", exp: []string{}},
+	{q: `compound([]), R = yes.`, v: "R", exp: []string{}},
+	{q: `callable(a), callable(f(X)), callable([a]), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `callable(1), R = yes.`, v: "R", exp: []string{}},
+	{q: `callable(X), R = yes.`, v: "R", exp: []string{}},
+	{q: `is_list([]), is_list([a, b]), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `is_list([a|T]), R = yes.`, v: "R", exp: []string{}},
+	{q: `is_list(f(a)), R = yes.`, v: "R", exp: []string{}},
+	{q: `ground(f(a, [b, 1])), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `ground(f(a, [b, X])), R = yes.`, v: "R", exp: []string{}},
+	{q: `X = a, ground(f(X)), R = yes.`, v: "R", exp: []string{"yes"}},
+
+	{q: `atomic_or_list(a, R).`, v: "R", exp: []string{"atomic"}},
+	{q: `atomic_or_list([a], R).`, v: "R", exp: []string{"list"}},
+	{q: `atomic_or_list(f(a), R).`, v: "R", exp: []string{"other"}},
+	{q: `atoms([a, 1, b, f(c), d], R).`, v: "R", exp: []string{"[a,b,d]"}},
+	{q: `checked(X).`, v: "X", exp: []string{"1", "2"}},
+	{q: `bound_after(X).`, v: "X", exp: []string{"a"}},
+	{q: `G = atom(a), call(G), R = yes.`, v: "R", exp: []string{"yes"}},
+	{q: `call(integer, a), R = yes.`, v: "R", exp: []string{}},
+	{q: `findall(X, (member2(X, [a, 1, f(b), 2.5]), atomic(X)), R).`, v: "R", exp: []string{"[a,1,2.5]"}},
+}
+
+func TestTypeTests(t *testing.T) {
+	for _, st := range typetests {
+		t.Run(st.q, func(t *testing.T) {
+			m := loadProgram(t, `
+atomic_or_list(X, R) :- (atomic(X) -> R = atomic ; is_list(X) -> R = list ; R = other).
+atoms([], []).
+atoms([X|Xs], [X|Ys]) :- atom(X), !, atoms(Xs, Ys).
+atoms([_|Xs], Ys) :- atoms(Xs, Ys).
+num(1). num(a). num(2).
+checked(X) :- num(X), integer(X).
+bound_after(X) :- var(X), X = a, nonvar(X).
+member2(X, [X|_]).
+member2(X, [_|T]) :- member2(X, T).
+`)
+			res, err := allSolutions(t, m, st.q, st.v)
+			if fmt.Sprint(err) != fmt.Sprint(st.err) {
+				t.Fatalf("expected error %v, got %v", st.err, err)
+			}
+			if !reflect.DeepEqual(res, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, res)
+			}
+		})
+	}
+}